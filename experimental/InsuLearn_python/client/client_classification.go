@@ -1,8 +1,9 @@
 package main
 
 import (
+	"../../../windows/frame"
+	"../../../windows/protocol"
 	"bufio"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"github.com/arcaneiceman/GoVector/govec"
@@ -33,6 +34,9 @@ var (
 	testg      *python.PyObject        // Client variable that holds reference to TestErrorGlobal function in client_classification.py module
 )
 
+// myhello is the protocol and features this node offers when it joins
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.ModelInsuLearn)
+
 // Local model struct
 type ILModel struct {
 	Model      string
@@ -52,17 +56,11 @@ type message struct {
 	Id       int           // Message ID (this is mainly used to determine the commit number for the model and map that back to the node ID of the original node that trained the model)
 	NodeIp   string        // String representation of sender's IP address
 	NodeName string        // Name of the node sending the mssage
-	Type     string        // The type of the message (request or response for example)
+	Type     protocol.Kind // The type of the message (request or response for example)
 	Model    ILModel       // A local model (usage in the message depends on context)
 	GModel   ILGlobalModel // Global model (usage in the message depends on context)
 }
 
-// Used to respond to client requests
-type response struct {
-	Resp  string
-	Error string
-}
-
 // Runs before the main function; starts Python interpreter and handles module importing
 func init() {
 
@@ -120,23 +118,23 @@ func listener() {
 // Responds according to message sent by the server
 func connHandler(conn *net.TCPConn) {
 	var msg message
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+	enc := frame.NewEncoder(conn)
+	dec := frame.NewDecoder(conn)
 	err := dec.Decode(&msg)
 	checkError(err)
 	switch msg.Type {
-	case "test_request":
+	case protocol.TestRequest:
 		// Server is asking me to test
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		go testModel(msg.Id, msg.Model)
-	case "global_grant":
+	case protocol.GlobalGrant:
 		// Server is sending global model
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		gmodel = msg.GModel
 		fmt.Printf("\n <-- Pulled global model from server.\nEnter command: ")
 	default:
 		// Respond to ping
-		enc.Encode(response{"NO", "Unknown Command"})
+		enc.Encode(protocol.Response{Code: protocol.Unknown, Error: string(msg.Type)})
 	}
 	conn.Close()
 }
@@ -233,21 +231,21 @@ func parseUserInput() {
 
 // Helper function which is used to send join requests to the server
 func requestJoin() {
-	msg := message{0, myaddr.String(), name, "join_request", model, gempty}
+	msg := message{0, myaddr.String(), name, protocol.JoinRequest, model, gempty}
 	fmt.Printf(" --> Asking server to join.")
 	tcpSend(msg)
 }
 
 // Helper function which is used to commit the local model to the server
 func requestCommit() {
-	msg := message{0, myaddr.String(), name, "commit_request", model, gempty}
+	msg := message{0, myaddr.String(), name, protocol.CommitRequest, model, gempty}
 	fmt.Printf(" --> Pushing local model to server.")
 	tcpSend(msg)
 }
 
 // Helper function which is used to request the global model from the server
 func requestGlobal() {
-	msg := message{0, myaddr.String(), name, "global_request", model, gempty}
+	msg := message{0, myaddr.String(), name, protocol.GlobalRequest, model, gempty}
 	fmt.Printf(" --> Requesting global model from server.")
 	tcpSend(msg)
 }
@@ -258,7 +256,7 @@ func testModel(id int, testmodel ILModel) {
 	testDict := train.CallFunction(python.PyString_FromString(testmodel.Model))
 	testmodel.LocalError = python.PyFloat_AsDouble(python.PyDict_GetItem(testDict, python.PyString_FromString("error")))
 	testmodel.Size = python.PyFloat_AsDouble(python.PyDict_GetItem(testDict, python.PyString_FromString("size")))
-	msg := message{id, myaddr.String(), name, "test_complete", testmodel, gempty}
+	msg := message{id, myaddr.String(), name, protocol.TestComplete, testmodel, gempty}
 	fmt.Printf("\n --> Sending completed test requset.")
 	tcpSend(msg)
 	fmt.Printf("Enter command: ")
@@ -268,22 +266,32 @@ func testModel(id int, testmodel ILModel) {
 func tcpSend(msg message) {
 	conn, err := net.DialTCP("tcp", nil, svaddr)
 	checkError(err)
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+	enc := frame.NewEncoder(conn)
+	dec := frame.NewDecoder(conn)
+	if msg.Type == protocol.JoinRequest {
+		// a join opens with the protocol we speak
+		err = protocol.WriteHello(conn, myhello)
+		checkError(err)
+	}
 	err = enc.Encode(&msg)
 	checkError(err)
-	var r response
+	var r protocol.Response
 	err = dec.Decode(&r)
 	checkError(err)
-	if r.Resp == "OK" {
+	if r.Accepted() {
 		fmt.Printf(" [OK]\n")
-		if r.Error == "Joined" {
+		if r.Code == protocol.Joined {
 			isjoining = false
+			if h, err := protocol.ReadHello(conn); err == nil {
+				fmt.Printf(" --- Speaking %v.\n", h)
+			}
 		}
-	} else if r.Resp == "NO" {
-		fmt.Printf(" [%s]\n *** Request was denied by server: %v.\nEnter command: ", r.Resp, r.Error)
 	} else {
-		fmt.Printf(" [%s]\n *** Something strange Happened: %v.\nEnter command: ", r.Resp, r.Error)
+		fmt.Printf(" [NO]\n *** Request was denied by server: %v.\nEnter command: ", r)
+		if r.Code == protocol.Incompatible {
+			// retrying can't help, this node has to be upgraded
+			os.Exit(1)
+		}
 	}
 }
 
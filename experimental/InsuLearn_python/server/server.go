@@ -1,8 +1,9 @@
 package main
 
 import (
+	"../../../windows/frame"
+	"../../../windows/protocol"
 	"encoding/binary"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"github.com/arcaneiceman/GoVector/govec"
@@ -33,6 +34,10 @@ var (
 	genGlobal  *python.PyObject                 // Server variable that holds reference to GenGlobal function in server.py module
 )
 
+// myhello is what this server speaks, every feature of it is required of
+// joining nodes
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.ModelInsuLearn)
+
 // Local model struct
 type ILModel struct {
 	Model      string  // Pickled string representing an Python sklearn model
@@ -61,17 +66,11 @@ type message struct {
 	Id       int           // Message ID (this is mainly used to determine the commit number for the model and map that back to the node ID of the original node that trained the model)
 	NodeIp   string        // String representation of sender's IP address
 	NodeName string        // Name of the node sending the mssage
-	Type     string        // The type of the message (request or response for example)
+	Type     protocol.Kind // The type of the message (request or response for example)
 	Model    ILModel       // A local model (usage in the message depends on context)
 	GModel   ILGlobalModel // Global model (usage in the message depends on context)
 }
 
-// Used to respond to client requests
-type response struct {
-	Resp  string
-	Error string
-}
-
 // Runs before the main function; starts Python interpreter and handles module importing
 func init() {
 
@@ -121,18 +120,39 @@ func main() {
 
 }
 
+// Function that reads a node's message, a join is preceded by the node's
+// hello, which has to be compatible before the join itself is decoded
+func receive(conn net.Conn, msg *message) (*protocol.Hello, error) {
+	hello, p, err := protocol.ReadFirst(conn)
+	if err != nil {
+		return nil, err
+	}
+	if hello != nil {
+		agreed, err := protocol.Negotiate(*hello, myhello, myhello.Features...)
+		if err != nil {
+			frame.NewEncoder(conn).Encode(protocol.Response{Code: protocol.Incompatible, Error: err.Error()})
+			return nil, err
+		}
+		hello = &agreed
+	}
+	return hello, protocol.DecodeNext(conn, p, msg)
+}
+
 // Function for handling client requests
 func connHandler(conn *net.TCPConn) {
 
 	// TODO GoVector.... use PrepareSend and UnpackReceive
 
 	var msg message
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	err := dec.Decode(&msg)
-	checkError(err)
+	enc := frame.NewEncoder(conn)
+	hello, err := receive(conn, &msg)
+	if err != nil {
+		fmt.Printf("*** Could not read message from %v: %v.\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
 	switch msg.Type {
-	case "commit_request":
+	case protocol.CommitRequest:
 		// Node is sending a model, must forward to others for testing
 		flag := checkQueue(client[msg.NodeName]) // Checks to see if the committing node has pending requests
 		fmt.Printf("<-- Received commit request from %v.\n", msg.NodeName)
@@ -141,18 +161,18 @@ func connHandler(conn *net.TCPConn) {
 			processTestRequest(msg, conn)
 		} else {
 			// Deny commit request
-			enc.Encode(response{"NO", "Pending tests are not complete"})
+			enc.Encode(protocol.Response{Code: protocol.Pending})
 			fmt.Printf("--> Denied commit request from %v.\n", msg.NodeName)
 			conn.Close()
 		}
-	case "global_request":
+	case protocol.GlobalRequest:
 		// Node is requesting the global model, server generates and sends the global model
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		fmt.Printf("<-- Received global model request from %v.\n", msg.NodeName)
 		genGlobalModel()
 		sendGlobal(msg)
 		conn.Close()
-	case "test_complete":
+	case protocol.TestComplete:
 		// Node is submitting test results
 		fmt.Printf("<-- Received completed test results from %v.\n", msg.NodeName)
 
@@ -169,22 +189,30 @@ func connHandler(conn *net.TCPConn) {
 			// If not outdated, update testqueue to resolve test and pass the test results on to the channel
 			testqueue[client[msg.NodeName]][cnumhist[msg.Id]] = false
 			channel <- msg
-			enc.Encode(response{"OK", "Test Processed"})
+			enc.Encode(protocol.Response{Code: protocol.OK})
 		} else {
 			// Duplicated or outdated results
-			enc.Encode(response{"NO", "Duplicate Test"})
+			enc.Encode(protocol.Response{Code: protocol.Duplicate})
 			fmt.Printf("--> Ignored test results from %v.\n", msg.NodeName)
 		}
 		conn.Close()
-	case "join_request":
+	case protocol.JoinRequest:
+		if hello == nil {
+			// the node's messages can't be trusted to decode
+			enc.Encode(protocol.Response{Code: protocol.Incompatible, Error: protocol.ErrNoHello.Error()})
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, protocol.ErrNoHello)
+			conn.Close()
+			break
+		}
 		// Services a joining node
 		processJoin(msg)
-		enc.Encode(response{"OK", "Joined"})
+		enc.Encode(protocol.Response{Code: protocol.Joined})
+		protocol.WriteHello(conn, *hello)
 		conn.Close()
 	default:
 		// Unknown request
 		fmt.Printf("something weird happened!\n")
-		enc.Encode(response{"NO", "Unknown Request"})
+		enc.Encode(protocol.Response{Code: protocol.Unknown, Error: string(msg.Type)})
 		conn.Close()
 	}
 
@@ -273,7 +301,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 	commitNum++
 	cnumhist[tempcnum] = client[m.NodeName]
 
-	enc := gob.NewEncoder(conn)
+	enc := frame.NewEncoder(conn)
 
 	// Creates a map for storing the model errors across nodes and initializes with error from committing node
 	temperrors := make(map[int]float64)
@@ -297,7 +325,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 	// Sanitize the model for testing (hides model information from other nodes to which test requests are sent)
 	m.Model.LocalError = 0.0
 	m.Model.Size = 0.0
-	enc.Encode(response{"OK", "Committed"})
+	enc.Encode(protocol.Response{Code: protocol.Committed})
 	conn.Close()
 
 	// The test requests for this committed model are sent to the other nodes (those created above)
@@ -311,7 +339,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 // Function that sends test requests via TCP
 func sendTestRequest(name string, id, tcnum int, tmodel ILModel) {
 	// Create test request
-	msg := message{tcnum, myaddr.String(), "server", "test_request", tmodel, gempty}
+	msg := message{tcnum, myaddr.String(), "server", protocol.TestRequest, tmodel, gempty}
 	// Send the request
 	fmt.Printf("--> Sending test request from %v to %v.", cnumhist[tcnum], name)
 	err := tcpSend(claddr[id], msg)
@@ -323,7 +351,7 @@ func sendTestRequest(name string, id, tcnum int, tmodel ILModel) {
 // Helper function that sends the global model to a requesting node
 func sendGlobal(m message) {
 	fmt.Printf("--> Sending global model to %v.", m.NodeName)
-	msg := message{m.Id, myaddr.String(), "server", "global_grant", m.Model, gmodel}
+	msg := message{m.Id, myaddr.String(), "server", protocol.GlobalGrant, m.Model, gmodel}
 	tcpSend(claddr[client[m.NodeName]], msg)
 }
 
@@ -331,17 +359,17 @@ func sendGlobal(m message) {
 func tcpSend(addr *net.TCPAddr, msg message) error {
 	conn, err := net.DialTCP("tcp", nil, addr)
 	if err == nil {
-		enc := gob.NewEncoder(conn)
-		dec := gob.NewDecoder(conn)
+		enc := frame.NewEncoder(conn)
+		dec := frame.NewDecoder(conn)
 		err := enc.Encode(msg)
 		checkError(err)
-		var r response
+		var r protocol.Response
 		err = dec.Decode(&r)
 		checkError(err)
-		if r.Resp == "OK" {
+		if r.Accepted() {
 			fmt.Printf(" [OK]\n")
 		} else {
-			fmt.Printf(" [%s]\n<-- Request was denied by node: %v.\nEnter command: ", r.Resp, r.Error)
+			fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", r)
 		}
 	}
 	return err
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"../../../windows/frame"
+	"../../../windows/protocol"
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
@@ -38,6 +40,10 @@ var (
 	genGlobal *python.PyObject
 )
 
+// myhello is what this server speaks, every feature of it is required of
+// joining nodes
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.ModelInsuLearn)
+
 type node struct {
 	id         uint64
 	ctx        context.Context
@@ -66,17 +72,11 @@ type message struct {
 	Id       int           // Message ID (this is mainly used to determine the commit number for the model and map that back to the node ID of the original node that trained the model)
 	NodeIp   string        // String representation of sender's IP address
 	NodeName string        // Name of the node sending the mssage
-	Type     string        // The type of the message (request or response for example)
+	Type     protocol.Kind // The type of the message (request or response for example)
 	Model    ILModel       // A local model (usage in the message depends on context)
 	GModel   ILGlobalModel // Global model (usage in the message depends on context)
 }
 
-// Used to respond to client requests
-type response struct {
-	Resp  string
-	Error string
-}
-
 // Local model struct
 type ILModel struct {
 	Model      string  // Pickled string representing an Python sklearn model
@@ -173,7 +173,7 @@ func (n *node) send(messages []raftpb.Message) {
 	for _, m := range messages {
 		conn, err := net.Dial("tcp", naddr[int(m.To)])
 		if err == nil {
-			enc := gob.NewEncoder(conn)
+			enc := frame.NewEncoder(conn)
 			enc.Encode(m)
 		} else {
 			fmt.Printf("*** Could not send message to Raft node: %v.\n", int(m.To))
@@ -185,7 +185,7 @@ func (n *node) send(messages []raftpb.Message) {
 func (n *node) receive(conn *net.TCPConn) {
 	// Echo all incoming data.
 	var imsg raftpb.Message
-	dec := gob.NewDecoder(conn)
+	dec := frame.NewDecoder(conn)
 	err := dec.Decode(&imsg)
 	checkError(err)
 	conn.Close()
@@ -208,7 +208,7 @@ func (n *node) process(entry raftpb.Entry) {
 		msg := repstate.Msg
 		switch msg.Type {
 
-		case "join_request":
+		case protocol.JoinRequest:
 			id := n.nodeNum
 			n.nodeNum++
 			n.client[msg.NodeName] = id
@@ -220,11 +220,11 @@ func (n *node) process(entry raftpb.Entry) {
 			n.testqueue[id] = queue
 			fmt.Printf("--- Added %v as node%v.\n", msg.NodeName, id)
 
-		case "rejoin_request":
+		case protocol.RejoinRequest:
 			id := n.client[msg.NodeName]
 			n.claddr[id], _ = net.ResolveTCPAddr("tcp", msg.NodeIp)
 
-		case "commit_request":
+		case protocol.CommitRequest:
 			tempcnum := n.commitNum
 			n.commitNum++
 			n.cnumhist[tempcnum] = n.client[msg.NodeName]
@@ -246,7 +246,7 @@ func (n *node) process(entry raftpb.Entry) {
 			}
 			fmt.Printf("--- Processed commit %v for node %v.\n", tempcnum, msg.NodeName)
 
-		case "test_complete":
+		case protocol.TestComplete:
 
 			n.testqueue[n.client[msg.NodeName]][n.cnumhist[msg.Id]] = false
 			channel <- msg
@@ -372,16 +372,37 @@ func clientListener(listen *net.TCPListener) {
 	}
 }
 
+// Function that reads a node's message, a join is preceded by the node's
+// hello, which has to be compatible before the join itself is decoded
+func receive(conn net.Conn, msg *message) (*protocol.Hello, error) {
+	hello, p, err := protocol.ReadFirst(conn)
+	if err != nil {
+		return nil, err
+	}
+	if hello != nil {
+		agreed, err := protocol.Negotiate(*hello, myhello, myhello.Features...)
+		if err != nil {
+			frame.NewEncoder(conn).Encode(protocol.Response{Code: protocol.Incompatible, Error: err.Error()})
+			return nil, err
+		}
+		hello = &agreed
+	}
+	return hello, protocol.DecodeNext(conn, p, msg)
+}
+
 // Function for handling client requests and replicating on Raft if necessary
 func connHandler(conn *net.TCPConn) {
 	var msg message
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	err := dec.Decode(&msg)
-	checkError(err)
+	enc := frame.NewEncoder(conn)
+	hello, err := receive(conn, &msg)
+	if err != nil {
+		fmt.Printf("*** Could not read message from %v: %v.\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
 	switch msg.Type {
 
-	case "commit_request":
+	case protocol.CommitRequest:
 		// node is sending a model, checking to see if testing is complete
 		flag := checkQueue(mynode.client[msg.NodeName])
 		fmt.Printf("<-- Received commit request from %v.\n", msg.NodeName)
@@ -390,20 +411,20 @@ func connHandler(conn *net.TCPConn) {
 			processTestRequest(msg, conn)
 		} else {
 			// deny commit request
-			enc.Encode(response{"NO", "Pending tests are not complete"})
+			enc.Encode(protocol.Response{Code: protocol.Pending})
 			fmt.Printf("--> Denied commit request from %v.\n", msg.NodeName)
 			conn.Close()
 		}
 
-	case "global_request":
+	case protocol.GlobalRequest:
 		// node is requesting the global model -> generate and forward
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		fmt.Printf("<-- Received global model request from %v.\n", msg.NodeName)
 		genGlobalModel()
 		sendGlobal(msg)
 		conn.Close()
 
-	case "test_complete":
+	case protocol.TestComplete:
 		// node is submitting test results, update testqueue on all replicas
 		fmt.Printf("<-- Received completed test results from %v.\n", msg.NodeName)
 
@@ -420,33 +441,41 @@ func connHandler(conn *net.TCPConn) {
 			repstate := state{0, msg}
 			flag := replicate(repstate)
 			if flag {
-				enc.Encode(response{"OK", "Test Processed"})
+				enc.Encode(protocol.Response{Code: protocol.OK})
 			} else {
 				// if testqueue could not be replicated
-				enc.Encode(response{"NO", "Try Again"})
+				enc.Encode(protocol.Response{Code: protocol.Retry})
 			}
 		} else {
 			// if testqueue is already empty
-			enc.Encode(response{"NO", "Duplicate Test"})
+			enc.Encode(protocol.Response{Code: protocol.Duplicate})
 			fmt.Printf("--> Ignored test results from %v.\n", msg.NodeName)
 		}
 		conn.Close()
 
-	case "join_request":
+	case protocol.JoinRequest:
+		if hello == nil {
+			// the node's messages can't be trusted to decode
+			enc.Encode(protocol.Response{Code: protocol.Incompatible, Error: protocol.ErrNoHello.Error()})
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, protocol.ErrNoHello)
+			conn.Close()
+			break
+		}
 		// node is requesting to join or rejoin
 		fmt.Printf("<-- Received join request from %v.\n", msg.NodeName)
 		flag := processJoin(msg)
 		if flag {
-			enc.Encode(response{"OK", "Joined"})
+			enc.Encode(protocol.Response{Code: protocol.Joined})
+			protocol.WriteHello(conn, *hello)
 		} else {
 			fmt.Printf("*** Could not process join for node %v.\n", msg.NodeName)
-			enc.Encode(response{"NO", "Failed Join"})
+			enc.Encode(protocol.Response{Code: protocol.Retry, Error: "join was not replicated"})
 		}
 		conn.Close()
 
 	default:
 		fmt.Printf("something weird happened!\n")
-		enc.Encode(response{"NO", "Unknown Request"})
+		enc.Encode(protocol.Response{Code: protocol.Unknown, Error: string(msg.Type)})
 		conn.Close()
 	}
 }
@@ -532,7 +561,7 @@ func genGlobalModel() {
 func processTestRequest(m message, conn *net.TCPConn) {
 	repstate := state{0, m}
 	flag := replicate(repstate)
-	enc := gob.NewEncoder(conn)
+	enc := frame.NewEncoder(conn)
 	if flag {
 		//sanitize the model for testing
 		m.Model.LocalError = 0.0
@@ -544,7 +573,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 				tempcnum = k
 			}
 		}
-		enc.Encode(response{"OK", "Committed"})
+		enc.Encode(protocol.Response{Code: protocol.Committed})
 		conn.Close()
 		for name, id := range mynode.client {
 			if id != mynode.client[m.NodeName] {
@@ -552,7 +581,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 			}
 		}
 	} else {
-		enc.Encode(response{"NO", "Try Again!"})
+		enc.Encode(protocol.Response{Code: protocol.Retry})
 		conn.Close()
 		fmt.Printf("--> Failed to commit request from %v.\n", m.NodeName)
 	}
@@ -561,7 +590,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 // Function that sends test requests via TCP
 func sendTestRequest(name string, id, tcnum int, tmodel ILModel) {
 	//create test request
-	msg := message{tcnum, "server", "server", "test_request", tmodel, gempty}
+	msg := message{tcnum, "server", "server", protocol.TestRequest, tmodel, gempty}
 	//send the request
 	fmt.Printf("--> Sending test request from %v to %v.", mynode.cnumhist[tcnum], name)
 	err := tcpSend(mynode.claddr[id], msg)
@@ -573,7 +602,7 @@ func sendTestRequest(name string, id, tcnum int, tmodel ILModel) {
 // Function to forward global model
 func sendGlobal(m message) {
 	fmt.Printf("--> Sending global model to %v.", m.NodeName)
-	msg := message{m.Id, myaddr.String(), "server", "global_grant", m.Model, gmodel}
+	msg := message{m.Id, myaddr.String(), "server", protocol.GlobalGrant, m.Model, gmodel}
 	tcpSend(mynode.claddr[mynode.client[m.NodeName]], msg)
 }
 
@@ -581,17 +610,17 @@ func sendGlobal(m message) {
 func tcpSend(addr *net.TCPAddr, msg message) error {
 	conn, err := net.DialTCP("tcp", nil, addr)
 	if err == nil {
-		enc := gob.NewEncoder(conn)
-		dec := gob.NewDecoder(conn)
+		enc := frame.NewEncoder(conn)
+		dec := frame.NewDecoder(conn)
 		err := enc.Encode(msg)
 		checkError(err)
-		var r response
+		var r protocol.Response
 		err = dec.Decode(&r)
 		checkError(err)
-		if r.Resp == "OK" {
+		if r.Accepted() {
 			fmt.Printf(" [OK]\n")
 		} else {
-			fmt.Printf(" [%s]\n<-- Request was denied by node: %v.\nEnter command: ", r.Resp, r.Error)
+			fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", r)
 		}
 	}
 	return err
@@ -623,7 +652,7 @@ func processJoin(m message) bool {
 		}
 	} else {
 		//node is rejoining, update address and resend the unfinished test requests
-		m.Type = "rejoin_request"
+		m.Type = protocol.RejoinRequest
 		repstate := state{0, m}
 		flag = replicate(repstate)
 		if flag {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"../../../windows/liveness"
 	"bufio"
 	"flag"
 	"fmt"
@@ -42,6 +43,7 @@ var (
 	claddr      map[int]*net.TCPAddr
 	tcplistener *net.TCPListener
 	logger      *govec.GoLog
+	live        *liveness.Tracker
 	globalW     Weights
 	deltas      Weights
 	modelType   string
@@ -64,6 +66,7 @@ func main() {
 	// Initialize data/parse arguments
 	client = make(map[string]int)
 	claddr = make(map[int]*net.TCPAddr)
+	live = liveness.NewTracker()
 	parseArgs()
 
 	switch modelType {
@@ -110,11 +113,13 @@ func (t *Server) RequestJoin(args RegisterArgs, reply *int) error {
 		maxnode++
 		client[args.Node.NodeName] = id
 		claddr[id], _ = net.ResolveTCPAddr("tcp", args.Node.NodeIp)
+		live.Beat(id)
 		fmt.Printf("\n--- Added %v as node%v.\n", args.Node.NodeName, id)
 	} else {
 		// node is rejoining, update address and resend the unfinished test requests
 		id := client[args.Node.NodeName]
 		claddr[id], _ = net.ResolveTCPAddr("tcp", args.Node.NodeIp)
+		live.Beat(id)
 		fmt.Printf("\n--- %v at node%v is back online.\n", args.Node.NodeName, id)
 	}
 
@@ -156,21 +161,25 @@ func parseUserInput() {
 			for i := 1; i <= 1000; i++ {
 				fmt.Printf("Iteration %d started.\n", i)
 				for name, id := range client {
+					if !live.Alive(id) {
+						continue
+					}
 					rpcCaller, err := rpc.DialHTTP("tcp", claddr[id].String())
 					//fmt.Println("Post dial")
 					if err != nil {
-						// TODO: Deregistration of dead clients (so that you don't contact it again)
-						fmt.Printf("\nUnable to contact %s(%s).\n\n", name, claddr[id].String())
-						os.Exit(1)
+						// leave the node out until it rejoins
+						fmt.Printf("\nUnable to contact %s(%s), dropped until it rejoins.\n\n", name, claddr[id].String())
+						live.Set(id, liveness.Dead)
 					} else {
 						deltas.Array = []float64{}
 						err = rpcCaller.Call("Node.RequestUpdateLog", globalW, &deltas)
 						rpcCaller.Close()
 						if err != nil {
 							//fmt.Println(err)
-							fmt.Printf("\nRemote procedure call to %s(%s) failed.\n\n", name, claddr[id].String())
-							os.Exit(1)
+							fmt.Printf("\nRemote procedure call to %s(%s) failed, dropped until it rejoins.\n\n", name, claddr[id].String())
+							live.Set(id, liveness.Dead)
 						} else {
+							live.Beat(id)
 							for j := 0; j < len(deltas.Array); j++ {
 								globalW.Array[j] += deltas.Array[j]
 							}
@@ -189,19 +198,23 @@ func parseUserInput() {
 			for i := 1; i <= 15000; i++ {
 				fmt.Printf("Iteration %d started.\n", i)
 				for name, id := range client {
+					if !live.Alive(id) {
+						continue
+					}
 					rpcCaller, err := rpc.DialHTTP("tcp", claddr[id].String())
 					if err != nil {
-						// TODO: Deregistration of dead clients (so that you don't contact it again)
-						fmt.Printf("\nUnable to contact %s(%s).\n\n", name, claddr[id].String())
-						os.Exit(1)
+						// leave the node out until it rejoins
+						fmt.Printf("\nUnable to contact %s(%s), dropped until it rejoins.\n\n", name, claddr[id].String())
+						live.Set(id, liveness.Dead)
 					} else {
 						deltas.Array = []float64{}
 						err = rpcCaller.Call("Node.RequestUpdateLin", globalW, &deltas)
 						rpcCaller.Close()
 						if err != nil {
-							fmt.Printf("\nRemote procedure call to %s(%s) failed.\n\n", name, claddr[id].String())
-							os.Exit(1)
+							fmt.Printf("\nRemote procedure call to %s(%s) failed, dropped until it rejoins.\n\n", name, claddr[id].String())
+							live.Set(id, liveness.Dead)
 						} else {
+							live.Beat(id)
 							for j := 0; j < len(deltas.Array); j++ {
 								globalW.Array[j] += deltas.Array[j]
 							}
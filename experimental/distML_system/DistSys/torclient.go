@@ -1,6 +1,8 @@
 package main
 
 import (
+	"../../../windows/frame"
+	"../../../windows/protocol"
 	"encoding/binary"
 	"flag"
 	"fmt"
@@ -45,6 +47,9 @@ var (
 	pulledGradient  []float64
 )
 
+// The protocol and features this client offers when it joins
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.FeatureGovec, protocol.ModelLogistic)
+
 func init() {
 	err := python.Initialize()
 	if err != nil {
@@ -116,15 +121,14 @@ func heartbeat(logger *govec.GoLog, torDialer proxy.Dialer) {
 
 		outBuf := logger.PrepareSend("Sending packet to torserver", msg)
 		
-		_, err = conn.Write(outBuf)
+		err = frame.Write(conn, outBuf)
 		if err != nil {
 			fmt.Println("Got a Conn Write failure, retrying...")
 			conn.Close()
 			continue
 		}
 		
-		inBuf := make([]byte, 512)
-		n, errRead := conn.Read(inBuf)
+		inBuf, errRead := frame.Read(conn)
 		if errRead != nil {
 			fmt.Println("Got a Conn Read failure, retrying...")
 			conn.Close()
@@ -132,7 +136,7 @@ func heartbeat(logger *govec.GoLog, torDialer proxy.Dialer) {
 		}
 
 		var reply int
-		logger.UnpackReceive("Received Message from server", inBuf[0:n], &reply)
+		logger.UnpackReceive("Received Message from server", inBuf, &reply)
 
 		fmt.Println("Send heartbeat success")
 		conn.Close()
@@ -213,15 +217,14 @@ func sendGradMessage(logger *govec.GoLog,
 
 		outBuf := logger.PrepareSend("Sending packet to torserver", msg)
 		
-		_, err = conn.Write(outBuf)
+		err = frame.Write(conn, outBuf)
 		if err != nil {
 			fmt.Println("Got a conn write failure, retrying...")
 			conn.Close()
 			continue
 		}
 		
-		inBuf := make([]byte, 2048)
-		n, errRead := conn.Read(inBuf)
+		inBuf, errRead := frame.Read(conn)
 		if errRead != nil {
 			fmt.Println("Got a reply read failure, retrying...")
 			conn.Close()
@@ -229,7 +232,7 @@ func sendGradMessage(logger *govec.GoLog,
 		}
 
 		var incomingMsg []float64
-		logger.UnpackReceive("Received Message from server", inBuf[0:n], &incomingMsg)
+		logger.UnpackReceive("Received Message from server", inBuf, &incomingMsg)
 
 		conn.Close()
 
@@ -271,16 +274,30 @@ func sendJoinMessage(logger *govec.GoLog, torDialer proxy.Dialer) int {
     msg.Deltas = make([]float64, study.NumFeatures)
 
     outBuf := logger.PrepareSend("Sending packet to torserver", msg)
+
+	// A join opens with the protocol we speak
+	errHello := protocol.WriteHello(conn, myhello)
+	checkError(errHello)
     	
-	_, errWrite := conn.Write(outBuf)
+	errWrite := frame.Write(conn, outBuf)
 	checkError(errWrite)
 	
-	inBuf := make([]byte, 512)
-	n, errRead := conn.Read(inBuf)
+	inBuf, errRead := frame.Read(conn)
 	checkError(errRead)
 
+	if r, refused := protocol.Refused(inBuf); refused {
+		fmt.Printf("Server refused the join: %v\n", r)
+		conn.Close()
+		return 0
+	}
+
 	var incomingMsg int
-	logger.UnpackReceive("Received Message from server", inBuf[0:n], &incomingMsg)
+	logger.UnpackReceive("Received Message from server", inBuf, &incomingMsg)
+	if incomingMsg == 1 {
+		if h, err := protocol.ReadHello(conn); err == nil {
+			fmt.Printf("Speaking %v\n", h)
+		}
+	}
 
 	conn.Close()
 
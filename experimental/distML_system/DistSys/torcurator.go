@@ -1,6 +1,7 @@
 package main
 
 import (
+"../../../windows/frame"
 "flag"
 "fmt"
 "net"
@@ -93,15 +94,14 @@ func sendCurateMessage(logger *govec.GoLog, torDialer proxy.Dialer) int {
 
   outBuf := logger.PrepareSend("Sending packet to torserver", msg)
       
-  _, errWrite := conn.Write(outBuf)
+  errWrite := frame.Write(conn, outBuf)
   checkError(errWrite)
   
-  inBuf := make([]byte, 2048)
-  n, errRead := conn.Read(inBuf)
+  inBuf, errRead := frame.Read(conn)
   checkError(errRead)
 
   var incomingMsg int
-  logger.UnpackReceive("Received Message from server", inBuf[0:n], &incomingMsg)
+  logger.UnpackReceive("Received Message from server", inBuf, &incomingMsg)
 
   conn.Close()
 
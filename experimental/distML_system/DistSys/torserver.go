@@ -1,6 +1,8 @@
 package main
 
 import (
+	"../../../windows/frame"
+	"../../../windows/protocol"
 	"fmt"
 	"math/rand"
 	"net"
@@ -40,6 +42,10 @@ var (
 	trainFunc   *python.PyObject
 )
 
+// The protocol and features this server speaks, all of them are required
+// of joining clients
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.FeatureGovec, protocol.ModelLogistic)
+
 /*
 	Executes when the .onion domain is accessed via the TorBrowser
 */
@@ -118,8 +124,7 @@ func runRouter(address string) {
 	ln, err := net.ListenTCP("tcp", myaddr)
 	checkError(err)
 
-	buf := make([]byte, 2048)
-	outBuf := make([]byte, 2048)
+	var outBuf []byte
 	registeredNodes = make(map[string]string)
 	myStudies = make(map[string]Study)
 
@@ -135,11 +140,25 @@ func runRouter(address string) {
 
 		fmt.Println("Got message")
 
-		// Get the message from client
-		conn.Read(buf)
+		// Get the message from client, a join comes after the client's protocol hello
+		hello, buf, err := protocol.ReadFirst(conn)
+		if err == nil && hello != nil {
+			var agreed protocol.Hello
+			if agreed, err = protocol.Negotiate(*hello, myhello, myhello.Features...); err != nil {
+				frame.NewEncoder(conn).Encode(protocol.Response{Code: protocol.Incompatible, Error: err.Error()})
+			} else {
+				hello = &agreed
+				buf, err = frame.Read(conn)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Could not read message: %s\n", err)
+			conn.Close()
+			continue
+		}
 
 		var incomingData MessageData
-		Logger.UnpackReceive("Received Message From Client", buf[0:], &incomingData)
+		Logger.UnpackReceive("Received Message From Client", buf, &incomingData)
 	
 		var ok bool
 
@@ -156,6 +175,11 @@ func runRouter(address string) {
 			
 			// Add new nodes
 			case "join":
+				if hello == nil {
+					fmt.Printf("Refused join from %s: %v\n", incomingData.SourceNode, protocol.ErrNoHello)
+					outBuf = Logger.PrepareSend("Replying", 0)
+					break
+				}
 				ok = processJoin(incomingData.SourceNode, incomingData.Study)
 				if ok {
 			  		outBuf = Logger.PrepareSend("Replying", 1)
@@ -184,7 +208,11 @@ func runRouter(address string) {
 				
 		}
 
-	  	conn.Write(outBuf)
+	  	frame.Write(conn, outBuf)
+		if incomingData.Type == "join" && ok {
+			protocol.WriteHello(conn, *hello)
+		}
+		conn.Close()
 		fmt.Printf("Done processing data from %s\n", incomingData.SourceNode)
 
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"../../windows/liveness"
 	"bufio"
 	"flag"
 	"fmt"
@@ -34,6 +35,7 @@ var (
 	claddr      map[int]*net.TCPAddr
 	tcplistener *net.TCPListener
 	logger      *govec.GoLog
+	live        *liveness.Tracker
 	globalW     Gradient
 	deltas      Gradient
 )
@@ -42,6 +44,7 @@ func main() {
 	// Initialize data/parse arguments
 	client = make(map[string]int)
 	claddr = make(map[int]*net.TCPAddr)
+	live = liveness.NewTracker()
 	parseArgs()
 
 	// Registering the server's remote procedure
@@ -75,11 +78,13 @@ func (t *Server) RequestJoin(args NodeInfo, reply *int) error {
 		maxnode++
 		client[args.NodeName] = id
 		claddr[id], _ = net.ResolveTCPAddr("tcp", args.NodeIp)
+		live.Beat(id)
 		fmt.Printf("\n--- Added %v as node%v.\n", args.NodeName, id)
 	} else {
 		// node is rejoining, update address and resend the unfinished test requests
 		id := client[args.NodeName]
 		claddr[id], _ = net.ResolveTCPAddr("tcp", args.NodeIp)
+		live.Beat(id)
 		fmt.Printf("\n--- %v at node%v is back online.\n", args.NodeName, id)
 	}
 	fmt.Print("Enter command: ")
@@ -110,14 +115,24 @@ func parseUserInput() {
 			fmt.Printf("getNums just received by server!!\n")
 			// TODO: This is synch for now. needs to become asynch
 			for name, id := range client {
+				if !live.Alive(id) {
+					continue
+				}
 				rpcCaller, err := rpc.DialHTTP("tcp", claddr[id].String()) // This fails only when a local node is down (possible), so we do not panic if err is not nil
 				if err != nil {
-					// TODO: Deregistration of dead clients (so that you dont contact it again)
-					fmt.Printf("\nUnable to contact %s(%s)\n\n", name, claddr[id].String())
-
+					// leave the node out until it rejoins
+					fmt.Printf("\nUnable to contact %s(%s), dropped until it rejoins\n\n", name, claddr[id].String())
+					live.Set(id, liveness.Dead)
 				} else {
 					err = rpcCaller.Call("Node.RequestUpdate", globalW, &deltas)
-					checkError(err) // Something failed during the RPC call, so we should panic
+					rpcCaller.Close()
+					if err != nil {
+						// the node went down during the call, leave it out as well
+						fmt.Printf("\nUpdate of %s(%s) failed: %v, dropped until it rejoins\n\n", name, claddr[id].String(), err)
+						live.Set(id, liveness.Dead)
+						continue
+					}
+					live.Beat(id)
 					fmt.Printf("\nFor client address: %s, globalW = %v, deltas = %v\n\n", claddr[id].String(), globalW, deltas)
 				}
 			}
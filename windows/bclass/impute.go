@@ -0,0 +1,288 @@
+package bclass
+
+import (
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+	"math"
+	"sort"
+)
+
+// ImputeStrategy selects how missing (NaN) feature values are treated.
+type ImputeStrategy int
+
+const (
+	// ImputeNone expects complete data; missing values are left as NaN.
+	ImputeNone ImputeStrategy = iota
+	// ImputeMean replaces missing values with the column mean.
+	ImputeMean
+	// ImputeMedian replaces missing values with the column median.
+	ImputeMedian
+	// ImputeIndicator replaces missing values with 0 and appends a 0/1
+	// column for every feature that had missing values in training.
+	ImputeIndicator
+	// ImputeDrop trains on complete rows only. At prediction time rows can't
+	// be dropped, so missing values are replaced with the training mean.
+	ImputeDrop
+)
+
+var imputeNames = []string{"none", "mean", "median", "indicator", "drop"}
+
+func (s ImputeStrategy) String() string {
+	if int(s) < len(imputeNames) {
+		return imputeNames[s]
+	}
+	return fmt.Sprintf("ImputeStrategy(%d)", int(s))
+}
+
+func ParseImputeStrategy(name string) (ImputeStrategy, error) {
+	for i, n := range imputeNames {
+		if n == name {
+			return ImputeStrategy(i), nil
+		}
+	}
+	return ImputeNone, fmt.Errorf("unknown imputation strategy %q", name)
+}
+
+// Imputer records the missing value treatment a model was trained with, so
+// that every node predicting with the model applies the same treatment.
+type Imputer struct {
+	Strategy ImputeStrategy
+	Fill     []float64
+	Flags    []int
+	Global   bool
+}
+
+// ColumnStats are per-column summaries of the observed (non-missing) values
+// of a node's data. They can be merged across nodes to impute from
+// federation wide statistics without sharing the data itself.
+type ColumnStats struct {
+	N      []int
+	Sum    []float64
+	Median []float64
+}
+
+func Stats(x *mat64.Dense) ColumnStats {
+	r, c := x.Dims()
+	s := ColumnStats{make([]int, c), make([]float64, c), make([]float64, c)}
+	col := make([]float64, 0, r)
+	for j := 0; j < c; j++ {
+		col = col[:0]
+		for i := 0; i < r; i++ {
+			if v := x.At(i, j); !math.IsNaN(v) {
+				col = append(col, v)
+				s.Sum[j] += v
+			}
+		}
+		s.N[j] = len(col)
+		s.Median[j] = median(col)
+	}
+	return s
+}
+
+// MergeStats combines the statistics of several nodes over the c columns of
+// the federation's schema, statistics with another width are left out. Sums
+// and counts are exact. The merged median is approximate, the exact one
+// would need the data itself: it is the median of the node medians, each
+// weighted by its node's count.
+func MergeStats(list []ColumnStats, c int) ColumnStats {
+	m := ColumnStats{make([]int, c), make([]float64, c), make([]float64, c)}
+	medians := make([][]weighted, c)
+	for _, s := range list {
+		if len(s.N) != c {
+			continue
+		}
+		for j := range s.N {
+			m.N[j] += s.N[j]
+			m.Sum[j] += s.Sum[j]
+			if s.N[j] > 0 {
+				medians[j] = append(medians[j], weighted{s.Median[j], s.N[j]})
+			}
+		}
+	}
+	for j := range medians {
+		m.Median[j] = weightedMedian(medians[j], m.N[j])
+	}
+	return m
+}
+
+type weighted struct {
+	v float64
+	n int
+}
+
+// weightedMedian returns the value below and above which half of the total
+// weight n lies, the mean of the two middle values when the weight splits
+// evenly between them.
+func weightedMedian(w []weighted, n int) float64 {
+	if len(w) == 0 {
+		return 0
+	}
+	sort.Slice(w, func(a, b int) bool { return w[a].v < w[b].v })
+	cum := 0
+	for i, x := range w {
+		cum += x.n
+		if 2*cum == n && i+1 < len(w) {
+			return (x.v + w[i+1].v) / 2
+		}
+		if 2*cum >= n {
+			return x.v
+		}
+	}
+	return w[len(w)-1].v
+}
+
+func (s ColumnStats) Mean() []float64 {
+	mean := make([]float64, len(s.N))
+	for j := range mean {
+		if s.N[j] > 0 {
+			mean[j] = s.Sum[j] / float64(s.N[j])
+		}
+	}
+	return mean
+}
+
+// NewImputer builds an imputer for the training data x. When global is not
+// nil its statistics are used for the fill values instead of x's own.
+func NewImputer(x *mat64.Dense, strategy ImputeStrategy, global *ColumnStats) Imputer {
+	im := Imputer{Strategy: strategy}
+	if strategy == ImputeNone {
+		return im
+	}
+	stats := Stats(x)
+	if global != nil && len(global.N) == len(stats.N) {
+		stats = *global
+		im.Global = true
+	}
+	switch strategy {
+	case ImputeMedian:
+		im.Fill = stats.Median
+	case ImputeIndicator:
+		im.Fill = make([]float64, len(stats.N))
+		r, c := x.Dims()
+		for j := 0; j < c; j++ {
+			for i := 0; i < r; i++ {
+				if math.IsNaN(x.At(i, j)) {
+					im.Flags = append(im.Flags, j)
+					break
+				}
+			}
+		}
+	default:
+		im.Fill = stats.Mean()
+	}
+	return im
+}
+
+// Transform returns x with missing values treated. x itself is returned
+// when there is nothing to do.
+func (im Imputer) Transform(x *mat64.Dense) *mat64.Dense {
+	if im.Strategy == ImputeNone || (CountMissing(x) == 0 && len(im.Flags) == 0) {
+		return x
+	}
+	r, c := x.Dims()
+	xt := mat64.NewDense(r, c+len(im.Flags), nil)
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			v := x.At(i, j)
+			if math.IsNaN(v) && j < len(im.Fill) {
+				v = im.Fill[j]
+			}
+			xt.Set(i, j, v)
+		}
+		for k, j := range im.Flags {
+			if math.IsNaN(x.At(i, j)) {
+				xt.Set(i, c+k, 1.0)
+			}
+		}
+	}
+	return xt
+}
+
+// DropMissing returns the rows of x and y with no missing values.
+func DropMissing(x, y *mat64.Dense) (*mat64.Dense, *mat64.Dense) {
+	return keepRows(x, y, func(i int) bool {
+		return !rowMissing(x, i) && !math.IsNaN(y.At(i, 0))
+	})
+}
+
+// RegLSImputed fits RegLSBasisC after treating missing values with im and
+// records im in the model. Rows with a missing label are always dropped.
+// Values im leaves missing, with ImputeNone or a column without a fill
+// value, are an error rather than NaN weights.
+func RegLSImputed(x, y *mat64.Dense, lambda float64, deg int, im Imputer) (Model, error) {
+	if im.Strategy == ImputeDrop {
+		x, y = DropMissing(x, y)
+	} else {
+		x, y = dropMissingLabels(x, y)
+	}
+	xt := im.Transform(x)
+	if n := CountMissing(xt); n > 0 {
+		return Model{}, fmt.Errorf("%v values still missing with imputation %v", n, im.Strategy)
+	}
+	model := RegLSBasisC(xt, y, lambda, deg)
+	model.Impute = im
+	return model, nil
+}
+
+func CountMissing(x *mat64.Dense) int {
+	r, c := x.Dims()
+	n := 0
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			if math.IsNaN(x.At(i, j)) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func dropMissingLabels(x, y *mat64.Dense) (*mat64.Dense, *mat64.Dense) {
+	return keepRows(x, y, func(i int) bool {
+		return !math.IsNaN(y.At(i, 0))
+	})
+}
+
+func keepRows(x, y *mat64.Dense, keep func(i int) bool) (*mat64.Dense, *mat64.Dense) {
+	r, c := x.Dims()
+	rows := make([]int, 0, r)
+	for i := 0; i < r; i++ {
+		if keep(i) {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) == r {
+		return x, y
+	}
+	xk := mat64.NewDense(len(rows), c, nil)
+	yk := mat64.NewDense(len(rows), 1, nil)
+	for k, i := range rows {
+		for j := 0; j < c; j++ {
+			xk.Set(k, j, x.At(i, j))
+		}
+		yk.Set(k, 0, y.At(i, 0))
+	}
+	return xk, yk
+}
+
+func rowMissing(x *mat64.Dense, i int) bool {
+	_, c := x.Dims()
+	for j := 0; j < c; j++ {
+		if math.IsNaN(x.At(i, j)) {
+			return true
+		}
+	}
+	return false
+}
+
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
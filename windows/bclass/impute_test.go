@@ -0,0 +1,88 @@
+package bclass
+
+import (
+	"github.com/gonum/matrix/mat64"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMergeStats(t *testing.T) {
+	stats := func(n []int, sum, median []float64) ColumnStats {
+		return ColumnStats{N: n, Sum: sum, Median: median}
+	}
+	tests := []struct {
+		name string
+		list []ColumnStats
+		c    int
+		want ColumnStats
+	}{
+		{"none", nil, 2, stats([]int{0, 0}, []float64{0, 0}, []float64{0, 0})},
+		{"one", []ColumnStats{stats([]int{3, 1}, []float64{6, 5}, []float64{2, 5})}, 2,
+			stats([]int{3, 1}, []float64{6, 5}, []float64{2, 5})},
+		// the larger node's median wins
+		{"weighted", []ColumnStats{
+			stats([]int{1}, []float64{10}, []float64{10}),
+			stats([]int{5}, []float64{5}, []float64{1}),
+		}, 1, stats([]int{6}, []float64{15}, []float64{1})},
+		{"even split", []ColumnStats{
+			stats([]int{2}, []float64{2}, []float64{1}),
+			stats([]int{2}, []float64{6}, []float64{3}),
+		}, 1, stats([]int{4}, []float64{8}, []float64{2})},
+		// the order nodes are merged in doesn't matter
+		{"order", []ColumnStats{
+			stats([]int{2}, []float64{6}, []float64{3}),
+			stats([]int{2}, []float64{2}, []float64{1}),
+		}, 1, stats([]int{4}, []float64{8}, []float64{2})},
+		{"three", []ColumnStats{
+			stats([]int{1}, []float64{9}, []float64{9}),
+			stats([]int{1}, []float64{1}, []float64{1}),
+			stats([]int{1}, []float64{4}, []float64{4}),
+		}, 1, stats([]int{3}, []float64{14}, []float64{4})},
+		// a column a node never observed has no median to weigh
+		{"unobserved", []ColumnStats{
+			stats([]int{0, 2}, []float64{0, 4}, []float64{0, 2}),
+			stats([]int{3, 2}, []float64{21, 8}, []float64{7, 4}),
+		}, 2, stats([]int{3, 4}, []float64{21, 12}, []float64{7, 3})},
+		{"other width", []ColumnStats{
+			stats([]int{1, 1, 1}, []float64{1, 1, 1}, []float64{1, 1, 1}),
+			stats([]int{2, 2}, []float64{4, 6}, []float64{2, 3}),
+		}, 2, stats([]int{2, 2}, []float64{4, 6}, []float64{2, 3})},
+	}
+	for _, tt := range tests {
+		if got := MergeStats(tt.list, tt.c); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: MergeStats = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRegLSImputed(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name string
+		x, y []float64
+		im   Imputer
+		ok   bool
+	}{
+		{"complete", []float64{1, 2, 3, 4}, []float64{1, -1, 1, -1}, Imputer{}, true},
+		{"none", []float64{1, nan, 3, 4}, []float64{1, -1, 1, -1}, Imputer{}, false},
+		{"mean", []float64{1, nan, 3, 4}, []float64{1, -1, 1, -1}, Imputer{Strategy: ImputeMean, Fill: []float64{2}}, true},
+		{"drop", []float64{1, nan, 3, 4}, []float64{1, -1, 1, -1}, Imputer{Strategy: ImputeDrop}, true},
+		// a missing label drops its row, missing value and all
+		{"unlabeled", []float64{1, nan, 3, 4}, []float64{1, nan, 1, -1}, Imputer{}, true},
+		// a column without a fill value keeps its missing values
+		{"no fill", []float64{1, nan, 3, 4}, []float64{1, -1, 1, -1}, Imputer{Strategy: ImputeMean}, false},
+	}
+	for _, tt := range tests {
+		x := mat64.NewDense(len(tt.x), 1, tt.x)
+		y := mat64.NewDense(len(tt.y), 1, tt.y)
+		m, err := RegLSImputed(x, y, 0.1, 1, tt.im)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil && CountMissing(&m.W) > 0 {
+			t.Errorf("%s: weights %v", tt.name, m.W.RawRowView(0))
+		}
+	}
+}
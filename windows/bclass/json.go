@@ -0,0 +1,50 @@
+package bclass
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+)
+
+// jsonModel is the JSON form of a Model, mat64 matrices have none of their
+// own so the weights are written as a list of rows.
+type jsonModel struct {
+	W      [][]float64
+	Deg    int
+	Lambda float64
+	Impute Imputer
+	Labels LabelMap
+}
+
+func (model Model) MarshalJSON() ([]byte, error) {
+	r, c := model.W.Dims()
+	w := make([][]float64, r)
+	for i := range w {
+		w[i] = make([]float64, c)
+		for j := range w[i] {
+			w[i][j] = model.W.At(i, j)
+		}
+	}
+	return json.Marshal(jsonModel{w, model.Deg, model.Lambda, model.Impute, model.Labels})
+}
+
+func (model *Model) UnmarshalJSON(b []byte) error {
+	var j jsonModel
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*model = Model{mat64.Dense{}, j.Deg, j.Lambda, j.Impute, j.Labels}
+	if len(j.W) == 0 || len(j.W[0]) == 0 {
+		return nil
+	}
+	r, c := len(j.W), len(j.W[0])
+	w := make([]float64, 0, r*c)
+	for i, row := range j.W {
+		if len(row) != c {
+			return fmt.Errorf("weight row %v has %v columns, expected %v", i, len(row), c)
+		}
+		w = append(w, row...)
+	}
+	model.W = *mat64.NewDense(r, c, w)
+	return nil
+}
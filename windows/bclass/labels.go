@@ -0,0 +1,84 @@
+package bclass
+
+import (
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+)
+
+// LabelMap maps the two original class labels of a dataset onto the -1/+1
+// encoding the models are trained with. The zero value stands for data that
+// was already encoded as -1/+1.
+type LabelMap struct {
+	Neg string
+	Pos string
+}
+
+var DefaultLabels = LabelMap{"-1", "1"}
+
+func (l LabelMap) OrDefault() LabelMap {
+	if l.Neg == "" && l.Pos == "" {
+		return DefaultLabels
+	}
+	return l
+}
+
+func (l LabelMap) Equal(o LabelMap) bool {
+	return l.OrDefault() == o.OrDefault()
+}
+
+func (l LabelMap) String() string {
+	l = l.OrDefault()
+	return fmt.Sprintf("{%s -> -1, %s -> +1}", l.Neg, l.Pos)
+}
+
+// Encode returns -1 or +1 for an original label.
+func (l LabelMap) Encode(label string) (float64, error) {
+	l = l.OrDefault()
+	switch label {
+	case l.Neg:
+		return -1.0, nil
+	case l.Pos:
+		return 1.0, nil
+	}
+	return 0, fmt.Errorf("label %q is not in %v", label, l)
+}
+
+// Decode returns the original label of every row of a prediction.
+func (l LabelMap) Decode(yh *mat64.Dense) []string {
+	l = l.OrDefault()
+	r, _ := yh.Dims()
+	out := make([]string, r)
+	for i := range out {
+		if yh.At(i, 0) < 0 {
+			out[i] = l.Neg
+		} else {
+			out[i] = l.Pos
+		}
+	}
+	return out
+}
+
+// Labels returns the label map shared by the member models.
+func (model GlobalModel) Labels() LabelMap {
+	for _, k := range model.Keys() {
+		return model.ModelList[k].Labels
+	}
+	return LabelMap{}
+}
+
+// ClassResults is TestResults split by true class: index 0 counts the
+// negative rows and index 1 the positive ones.
+func ClassResults(predict, test *mat64.Dense) (c, d [2]int) {
+	r, _ := predict.Dims()
+	for i := 0; i < r; i++ {
+		k := 0
+		if test.At(i, 0) > 0 {
+			k = 1
+		}
+		d[k]++
+		if (predict.At(i, 0) * test.At(i, 0)) > 0 {
+			c[k]++
+		}
+	}
+	return c, d
+}
@@ -0,0 +1,176 @@
+package bclass
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+	"math"
+)
+
+// Precision is how many bits a weight is sent with.
+type Precision int
+
+const (
+	Float64 Precision = iota
+	Float32
+	// int8 values scaled by the largest weight of the matrix
+	Int8
+)
+
+var precisionNames = []string{"float64", "float32", "int8"}
+
+func (p Precision) String() string {
+	if p >= 0 && int(p) < len(precisionNames) {
+		return precisionNames[p]
+	}
+	return fmt.Sprintf("Precision(%d)", int(p))
+}
+
+// ParsePrecision maps a -quantize flag value to its Precision.
+func ParsePrecision(name string) (Precision, error) {
+	for i, n := range precisionNames {
+		if n == name {
+			return Precision(i), nil
+		}
+	}
+	return Float64, fmt.Errorf("unknown precision %q, use float64, float32 or int8", name)
+}
+
+// Weights is a weight matrix in a given precision, row by row. Int8 values
+// are multiples of Scale.
+type Weights struct {
+	R, C  int
+	Prec  Precision
+	Scale float64
+	Data  []byte
+}
+
+// Quantize returns w in precision p and the largest error of a weight.
+func Quantize(w *mat64.Dense, p Precision) (Weights, float64) {
+	r, c := w.Dims()
+	q := Weights{r, c, p, 0, nil}
+	switch p {
+	case Float32:
+		q.Data = make([]byte, 4*r*c)
+	case Int8:
+		q.Data = make([]byte, r*c)
+		for i := 0; i < r; i++ {
+			for j := 0; j < c; j++ {
+				q.Scale = math.Max(q.Scale, math.Abs(w.At(i, j)))
+			}
+		}
+		q.Scale /= 127
+	default:
+		q.Data = make([]byte, 8*r*c)
+	}
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			k, v := i*c+j, w.At(i, j)
+			switch p {
+			case Float32:
+				binary.BigEndian.PutUint32(q.Data[4*k:], math.Float32bits(float32(v)))
+			case Int8:
+				if q.Scale > 0 {
+					q.Data[k] = byte(int8(math.Round(v / q.Scale)))
+				}
+			default:
+				binary.BigEndian.PutUint64(q.Data[8*k:], math.Float64bits(v))
+			}
+		}
+	}
+	maxErr := 0.0
+	if r > 0 && c > 0 {
+		d := q.Dense()
+		for i := 0; i < r; i++ {
+			for j := 0; j < c; j++ {
+				maxErr = math.Max(maxErr, math.Abs(d.At(i, j)-w.At(i, j)))
+			}
+		}
+	}
+	return q, maxErr
+}
+
+// Dense returns the weights as a matrix, an empty one when there are none.
+func (q Weights) Dense() *mat64.Dense {
+	if q.R == 0 || q.C == 0 {
+		return &mat64.Dense{}
+	}
+	w := make([]float64, q.R*q.C)
+	for k := range w {
+		switch q.Prec {
+		case Float32:
+			w[k] = float64(math.Float32frombits(binary.BigEndian.Uint32(q.Data[4*k:])))
+		case Int8:
+			w[k] = float64(int8(q.Data[k])) * q.Scale
+		default:
+			w[k] = math.Float64frombits(binary.BigEndian.Uint64(q.Data[8*k:]))
+		}
+	}
+	return mat64.NewDense(q.R, q.C, w)
+}
+
+// Check reports whether Data holds R×C values of precision Prec.
+func (q Weights) Check() error {
+	size := map[Precision]int{Float64: 8, Float32: 4, Int8: 1}[q.Prec]
+	if size == 0 || q.R < 0 || q.C < 0 || len(q.Data) != size*q.R*q.C {
+		return fmt.Errorf("%v weights of %vx%v in %v bytes", q.Prec, q.R, q.C, len(q.Data))
+	}
+	return nil
+}
+
+// Unsure counts the rows of xt the model could classify differently if
+// every weight was off by up to maxErr, as it is after quantization: the
+// rows whose score is closer to the threshold than the error can move it.
+func (model Model) Unsure(xt *mat64.Dense, maxErr float64) int {
+	n := 0
+	for _, u := range model.unsure(xt, maxErr) {
+		if u {
+			n++
+		}
+	}
+	return n
+}
+
+func (model Model) unsure(xt *mat64.Dense, maxErr float64) []bool {
+	xpoly := PolyBasis(model.Impute.Transform(xt), model.Deg)
+	r, _ := xpoly.Dims()
+	yt := mat64.NewDense(r, 1, nil)
+	yt.Mul(xpoly, &model.W)
+	u := make([]bool, r)
+	for i := range u {
+		bound := 0.0
+		for _, v := range xpoly.RawRowView(i) {
+			bound += math.Abs(v)
+		}
+		bound *= maxErr
+		u[i] = yt.At(i, 0)-bound < 0 && yt.At(i, 0)+bound >= 0
+	}
+	return u
+}
+
+// Unsure counts the rows of xt the global model could classify differently
+// if the weights of member k were off by up to maxErr[k]. The vote of a
+// member that is unsure of a row may go either way.
+func (model GlobalModel) Unsure(xt *mat64.Dense, maxErr map[int]float64) int {
+	r, _ := xt.Dims()
+	sure := make([]float64, r)
+	open := make([]float64, r)
+	for _, k := range model.Keys() {
+		weight := float64(model.TestSize[k]) / float64(model.D)
+		vote := model.ModelList[k].Predict(xt)
+		for i, u := range model.ModelList[k].unsure(xt, maxErr[k]) {
+			if u {
+				open[i] += weight
+			} else {
+				sure[i] += weight * vote.At(i, 0)
+			}
+		}
+	}
+	n := 0
+	for i := range sure {
+		if sure[i]-open[i] < 0 && sure[i]+open[i] >= 0 {
+			n++
+		}
+	}
+	return n
+}
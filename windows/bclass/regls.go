@@ -3,12 +3,17 @@ package bclass
 import (
 	"fmt"
 	"github.com/gonum/matrix/mat64"
+	"runtime"
+	"sort"
+	"sync"
 )
 
 type Model struct {
 	W      mat64.Dense
 	Deg    int
 	Lambda float64
+	Impute Imputer
+	Labels LabelMap
 }
 
 type GlobalModel struct {
@@ -24,7 +29,7 @@ func (model Model) Print() {
 }
 
 func (model Model) Predict(xt *mat64.Dense) *mat64.Dense {
-	xpoly := PolyBasis(xt, xt, 0, model.Deg)
+	xpoly := PolyBasis(model.Impute.Transform(xt), model.Deg)
 
 	r, _ := xt.Dims()
 	_, c := model.W.Dims()
@@ -35,70 +40,206 @@ func (model Model) Predict(xt *mat64.Dense) *mat64.Dense {
 	return yt
 }
 
+// Members are evaluated concurrently, but their weighted votes are always
+// summed in ascending model id order so the result does not depend on
+// scheduling or map iteration order.
 func (model GlobalModel) Predict(xt *mat64.Dense) *mat64.Dense {
 	r, _ := xt.Dims()
+	return model.vote(r, func(m Model) *mat64.Dense { return m.Predict(xt) })
+}
+
+// vote sums the predictions of the members on r rows, weighted by their test
+// sizes, evaluating up to one member per CPU at a time.
+func (model GlobalModel) vote(r int, predict func(Model) *mat64.Dense) *mat64.Dense {
+	keys := model.Keys()
+	votes := make([]*mat64.Dense, len(keys))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, k := range keys {
+		wg.Add(1)
+		go func(i, k int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			temp := predict(model.ModelList[k])
+			temp.Scale(float64(model.TestSize[k])/float64(model.D), temp)
+			votes[i] = temp
+		}(i, k)
+	}
+	wg.Wait()
+
 	agg := mat64.NewDense(r, 1, nil)
-	for k, m := range model.ModelList {
-		temp := m.Predict(xt)
-		temp.Scale(float64(model.TestSize[k])/float64(model.D), temp)
-		agg.Add(agg, temp)
+	for _, v := range votes {
+		agg.Add(agg, v)
 	}
 	tresh(agg)
 
 	return agg
 }
 
+// Keys returns the ids of the member models in ascending order.
+func (model GlobalModel) Keys() []int {
+	keys := make([]int, 0, len(model.ModelList))
+	for k := range model.ModelList {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// PredictChunked predicts xt in blocks of at most rows rows so the
+// polynomial basis of a very large input is never built all at once.
+func (model Model) PredictChunked(xt *mat64.Dense, rows int) *mat64.Dense {
+	return predictChunked(xt, rows, model.Predict)
+}
+
+// PredictChunked predicts xt in blocks of at most rows rows so the
+// polynomial basis of a very large input is never built all at once.
+func (model GlobalModel) PredictChunked(xt *mat64.Dense, rows int) *mat64.Dense {
+	return predictChunked(xt, rows, model.Predict)
+}
+
+func predictChunked(xt *mat64.Dense, rows int, predict func(*mat64.Dense) *mat64.Dense) *mat64.Dense {
+	r, c := xt.Dims()
+	if rows <= 0 || r <= rows {
+		return predict(xt)
+	}
+	yt := mat64.NewDense(r, 1, nil)
+	for start := 0; start < r; start += rows {
+		end := start + rows
+		if end > r {
+			end = r
+		}
+		block := mat64.NewDense(end-start, c, nil)
+		for i := start; i < end; i++ {
+			block.SetRow(i-start, xt.RawRowView(i))
+		}
+		yb := predict(block)
+		for i := start; i < end; i++ {
+			yt.Set(i, 0, yb.At(i-start, 0))
+		}
+	}
+	return yt
+}
+
+// BasisBlockRows is the number of rows whose polynomial basis is held in
+// memory at once while accumulating the normal equations.
+const BasisBlockRows = 4096
+
+// RegLSBasisC fits a ridge regression on the polynomial basis of x. XᵀX and
+// Xᵀy are accumulated over blocks of BasisBlockRows rows so the full basis
+// matrix is never materialized.
 func RegLSBasisC(x, y *mat64.Dense, lambda float64, deg int) Model {
-	xpoly := PolyBasis(x, x, 0, deg)
+	_, c := x.Dims()
+	ne := NewNormalEq(c, deg)
+	ne.Add(x, y)
+	return ne.Model(lambda)
+}
+
+// NormalEq accumulates the normal equations XᵀX and Xᵀy of a ridge
+// regression on the polynomial basis, one block of rows at a time, so data
+// streamed from disk can be trained on without holding it all in memory.
+type NormalEq struct {
+	C, Deg   int
+	xtx, xty *mat64.Dense
+	btb, bty *mat64.Dense
+	// backing of the basis block and its labels, sized for the largest block
+	// added so far
+	buf, ybuf []float64
+}
+
+func NewNormalEq(c, deg int) *NormalEq {
+	p := BasisWidth(c, deg)
+	return &NormalEq{
+		C:   c,
+		Deg: deg,
+		xtx: mat64.NewDense(p, p, nil),
+		xty: mat64.NewDense(p, 1, nil),
+		btb: mat64.NewDense(p, p, nil),
+		bty: mat64.NewDense(p, 1, nil),
+	}
+}
+
+// Add accumulates the rows of x and y, BasisBlockRows rows at a time. The
+// block holds at most as many rows as x and is reused by later calls.
+func (ne *NormalEq) Add(x, y *mat64.Dense) {
+	r, _ := x.Dims()
+	p := BasisWidth(ne.C, ne.Deg)
+	n := r
+	if n > BasisBlockRows {
+		n = BasisBlockRows
+	}
+	if len(ne.ybuf) < n {
+		ne.buf = make([]float64, n*p)
+		ne.ybuf = make([]float64, n)
+	}
+	for start := 0; start < r; start += BasisBlockRows {
+		end := start + BasisBlockRows
+		if end > r {
+			end = r
+		}
+		block := mat64.NewDense(end-start, p, ne.buf[:(end-start)*p])
+		yblock := mat64.NewDense(end-start, 1, ne.ybuf[:end-start])
+		for i := start; i < end; i++ {
+			polyRow(block.RawRowView(i-start), x.RawRowView(i), ne.Deg)
+			yblock.Set(i-start, 0, y.At(i, 0))
+		}
+		ne.btb.Mul(block.T(), block)
+		ne.xtx.Add(ne.xtx, ne.btb)
+		ne.bty.Mul(block.T(), yblock)
+		ne.xty.Add(ne.xty, ne.bty)
+	}
+}
 
-	r, c := xpoly.Dims()
-	xtx := mat64.NewDense(c, c, nil)
-	eye := Eye(c)
-	xtx.Mul(xpoly.T(), xpoly)
+// Model solves the accumulated equations with ridge parameter lambda.
+func (ne *NormalEq) Model(lambda float64) Model {
+	p := BasisWidth(ne.C, ne.Deg)
+	a := mat64.NewDense(p, p, nil)
+	a.Copy(ne.xtx)
+	eye := Eye(p)
 	eye.Scale(lambda, eye)
-	xtx.Add(xtx, eye)
+	a.Add(a, eye)
 
-	w := mat64.NewDense(c, 1, nil)
-	k := mat64.NewDense(c, r, nil)
-	k.Solve(xtx, xpoly.T())
-	w.Mul(k, y)
+	w := mat64.NewDense(p, 1, nil)
+	w.Solve(a, ne.xty)
 
-	model := Model{*w, deg, lambda}
+	model := Model{W: *w, Deg: ne.Deg, Lambda: lambda}
 
 	return model
 }
 
-func PolyBasis(xpoly, x *mat64.Dense, ind, deg int) *mat64.Dense {
-	r, c := xpoly.Dims()
-	t := mat64.NewDense(r, c, nil)
-	t.Copy(xpoly)
+// PolyBasis returns the polynomial basis [1, x, x.^2, ..., x.^deg] of x,
+// built row by row into a single preallocated matrix.
+func PolyBasis(x *mat64.Dense, deg int) *mat64.Dense {
+	r, c := x.Dims()
+	xpoly := mat64.NewDense(r, BasisWidth(c, deg), nil)
+	for i := 0; i < r; i++ {
+		polyRow(xpoly.RawRowView(i), x.RawRowView(i), deg)
+	}
+	return xpoly
+}
+
+// BasisWidth is the number of columns in the degree deg basis of c features.
+func BasisWidth(c, deg int) int {
+	return deg*c + 1
+}
 
-	if ind == deg {
-		if deg != 1 {
-			t.MulElem(t, x)
-		}
-		return t
-	} else if ind == 0 {
-		data := make([]float64, r)
-		for i := range data {
-			data[i] = 1.0
+// polyRow writes the basis of a single row xrow into dst, which must hold
+// BasisWidth(len(xrow), deg) values.
+func polyRow(dst, xrow []float64, deg int) {
+	c := len(xrow)
+	dst[0] = 1.0
+	if deg < 1 {
+		return
+	}
+	copy(dst[1:1+c], xrow)
+	for d := 2; d <= deg; d++ {
+		prev := dst[1+(d-2)*c : 1+(d-1)*c]
+		cur := dst[1+(d-1)*c : 1+d*c]
+		for j := range cur {
+			cur[j] = prev[j] * xrow[j]
 		}
-		t1 := mat64.NewDense(r, 1, data)
-		t2 := PolyBasis(t, x, ind+1, deg)
-		x2 := mat64.NewDense(r, (deg-ind)*c+1, nil)
-		x2.Augment(t1, t2)
-		return x2
-	} else if ind == 1 {
-		t2 := PolyBasis(t, x, ind+1, deg)
-		x2 := mat64.NewDense(r, (deg-ind+1)*c, nil)
-		x2.Augment(x, t2)
-		return x2
-	} else {
-		t.MulElem(t, x)
-		t2 := PolyBasis(t, x, ind+1, deg)
-		x2 := mat64.NewDense(r, (deg-ind+1)*c, nil)
-		x2.Augment(t, t2)
-		return x2
 	}
 }
 
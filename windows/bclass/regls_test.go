@@ -0,0 +1,245 @@
+package bclass
+
+import (
+	"github.com/gonum/matrix/mat64"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// recursiveBasis is PolyBasis as it was built before, by recursion over the
+// degrees and augmenting a copy of the matrix at every level.
+func recursiveBasis(xpoly, x *mat64.Dense, ind, deg int) *mat64.Dense {
+	r, c := xpoly.Dims()
+	t := mat64.NewDense(r, c, nil)
+	t.Copy(xpoly)
+
+	if ind == deg {
+		if deg != 1 {
+			t.MulElem(t, x)
+		}
+		return t
+	} else if ind == 0 {
+		data := make([]float64, r)
+		for i := range data {
+			data[i] = 1.0
+		}
+		t1 := mat64.NewDense(r, 1, data)
+		t2 := recursiveBasis(t, x, ind+1, deg)
+		x2 := mat64.NewDense(r, (deg-ind)*c+1, nil)
+		x2.Augment(t1, t2)
+		return x2
+	} else if ind == 1 {
+		t2 := recursiveBasis(t, x, ind+1, deg)
+		x2 := mat64.NewDense(r, (deg-ind+1)*c, nil)
+		x2.Augment(x, t2)
+		return x2
+	} else {
+		t.MulElem(t, x)
+		t2 := recursiveBasis(t, x, ind+1, deg)
+		x2 := mat64.NewDense(r, (deg-ind+1)*c, nil)
+		x2.Augment(t, t2)
+		return x2
+	}
+}
+
+func randDense(rnd *rand.Rand, r, c int) *mat64.Dense {
+	x := mat64.NewDense(r, c, nil)
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			x.Set(i, j, rnd.NormFloat64())
+		}
+	}
+	return x
+}
+
+// rows returns a copy of the rows from through to-1 of x.
+func rows(x *mat64.Dense, from, to int) *mat64.Dense {
+	_, c := x.Dims()
+	m := mat64.NewDense(to-from, c, nil)
+	for i := from; i < to; i++ {
+		for j := 0; j < c; j++ {
+			m.Set(i-from, j, x.At(i, j))
+		}
+	}
+	return m
+}
+
+// maxDiff is the largest relative difference between the elements of a and
+// b, +Inf when their shapes differ.
+func maxDiff(a, b mat64.Matrix) float64 {
+	ar, ac := a.Dims()
+	br, bc := b.Dims()
+	if ar != br || ac != bc {
+		return math.Inf(1)
+	}
+	d := 0.0
+	for i := 0; i < ar; i++ {
+		for j := 0; j < ac; j++ {
+			d = math.Max(d, math.Abs(a.At(i, j)-b.At(i, j))/math.Max(1, math.Abs(b.At(i, j))))
+		}
+	}
+	return d
+}
+
+func TestPolyBasis(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		r, c, deg int
+	}{
+		{1, 1, 1},
+		{1, 1, 2},
+		{3, 2, 1},
+		{3, 2, 2},
+		{5, 4, 3},
+		{7, 3, 4},
+		{2, 6, 5},
+	}
+	for _, tt := range tests {
+		x := randDense(rnd, tt.r, tt.c)
+		got := PolyBasis(x, tt.deg)
+		want := recursiveBasis(x, x, 0, tt.deg)
+		if r, c := got.Dims(); r != tt.r || c != BasisWidth(tt.c, tt.deg) {
+			t.Errorf("%dx%d degree %d: basis is %dx%d, want %dx%d", tt.r, tt.c, tt.deg, r, c, tt.r, BasisWidth(tt.c, tt.deg))
+		}
+		if d := maxDiff(got, want); d > 1e-12 {
+			t.Errorf("%dx%d degree %d: basis differs from the recursive one by %v", tt.r, tt.c, tt.deg, d)
+		}
+	}
+}
+
+func TestRegLSBasisC(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	tests := []struct {
+		r, c, deg int
+	}{
+		{10, 2, 1},
+		{10, 2, 2},
+		{BasisBlockRows, 2, 2},
+		// a short final block
+		{2*BasisBlockRows + 5, 2, 2},
+		{2*BasisBlockRows + 5, 3, 1},
+	}
+	for _, tt := range tests {
+		x := randDense(rnd, tt.r, tt.c)
+		y := randDense(rnd, tt.r, 1)
+		basis := recursiveBasis(x, x, 0, tt.deg)
+		p := BasisWidth(tt.c, tt.deg)
+		xtx := mat64.NewDense(p, p, nil)
+		xtx.Mul(basis.T(), basis)
+		eye := Eye(p)
+		eye.Scale(0.1, eye)
+		xtx.Add(xtx, eye)
+		xty := mat64.NewDense(p, 1, nil)
+		xty.Mul(basis.T(), y)
+		w := mat64.NewDense(p, 1, nil)
+		w.Solve(xtx, xty)
+
+		got := RegLSBasisC(x, y, 0.1, tt.deg)
+		if d := maxDiff(&got.W, w); d > 1e-9 || got.Deg != tt.deg || got.Lambda != 0.1 {
+			t.Errorf("%d rows of degree %d: weights differ from the fit on the whole basis by %v", tt.r, tt.deg, d)
+		}
+	}
+}
+
+func TestNormalEq(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	tests := []struct {
+		r, c, deg int
+		// split is where the rows are cut into two calls to Add
+		split int
+	}{
+		{10, 2, 1, 10},
+		{10, 2, 2, 4},
+		{BasisBlockRows, 2, 2, BasisBlockRows},
+		{2*BasisBlockRows + 5, 2, 2, 2*BasisBlockRows + 5},
+		{2*BasisBlockRows + 5, 3, 1, BasisBlockRows + 1},
+	}
+	for _, tt := range tests {
+		x := randDense(rnd, tt.r, tt.c)
+		y := randDense(rnd, tt.r, 1)
+		basis := recursiveBasis(x, x, 0, tt.deg)
+		p := BasisWidth(tt.c, tt.deg)
+		xtx := mat64.NewDense(p, p, nil)
+		xtx.Mul(basis.T(), basis)
+		xty := mat64.NewDense(p, 1, nil)
+		xty.Mul(basis.T(), y)
+
+		ne := NewNormalEq(tt.c, tt.deg)
+		ne.Add(rows(x, 0, tt.split), rows(y, 0, tt.split))
+		if tt.split < tt.r {
+			ne.Add(rows(x, tt.split, tt.r), rows(y, tt.split, tt.r))
+		}
+		if n := len(ne.ybuf); n > tt.r || n > BasisBlockRows {
+			t.Errorf("%d rows of degree %d: a block of %d rows", tt.r, tt.deg, n)
+		}
+		if d := math.Max(maxDiff(ne.xtx, xtx), maxDiff(ne.xty, xty)); d > 1e-9 {
+			t.Errorf("%d rows of degree %d: normal equations differ from the whole basis by %v", tt.r, tt.deg, d)
+		}
+		whole := RegLSBasisC(x, y, 0.1, tt.deg)
+		split := ne.Model(0.1)
+		if d := maxDiff(&split.W, &whole.W); d > 1e-9 || split.Deg != tt.deg || split.Lambda != 0.1 {
+			t.Errorf("%d rows of degree %d: model fitted in two parts differs by %v", tt.r, tt.deg, d)
+		}
+	}
+}
+
+// sparseOf returns the non-zeros of x in CSR form.
+func sparseOf(x *mat64.Dense) *CSR {
+	r, c := x.Dims()
+	s := &CSR{R: r, C: c, Indptr: []int{0}}
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			if v := x.At(i, j); v != 0 {
+				s.Indices = append(s.Indices, j)
+				s.Values = append(s.Values, v)
+			}
+		}
+		s.Indptr = append(s.Indptr, len(s.Indices))
+	}
+	return s
+}
+
+func TestGlobalPredict(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	tests := []struct {
+		models, rows, c, deg int
+	}{
+		{1, 10, 2, 1},
+		{3, 50, 2, 2},
+		{16, 200, 3, 2},
+		// members whose votes nearly cancel out
+		{64, 500, 2, 1},
+	}
+	for _, tt := range tests {
+		g := GlobalModel{ModelList: make(map[int]Model), TestSize: make(map[int]int)}
+		for k := 1; k <= tt.models; k++ {
+			w := randDense(rnd, BasisWidth(tt.c, tt.deg), 1)
+			g.ModelList[k] = Model{W: *w, Deg: tt.deg}
+			g.TestSize[k] = 1 + rnd.Intn(100)
+			g.D += g.TestSize[k]
+		}
+		xt := randDense(rnd, tt.rows, tt.c)
+
+		// the members one by one, in model id order
+		want := mat64.NewDense(tt.rows, 1, nil)
+		for _, k := range g.Keys() {
+			temp := g.ModelList[k].Predict(xt)
+			temp.Scale(float64(g.TestSize[k])/float64(g.D), temp)
+			want.Add(want, temp)
+		}
+		tresh(want)
+
+		for run := 0; run < 5; run++ {
+			if d := maxDiff(g.Predict(xt), want); d != 0 {
+				t.Errorf("%d models: run %d: Predict differs from the sequential vote by %v", tt.models, run, d)
+			}
+			if d := maxDiff(g.PredictSparse(sparseOf(xt)), want); d != 0 {
+				t.Errorf("%d models: run %d: PredictSparse differs from the sequential vote by %v", tt.models, run, d)
+			}
+			if d := maxDiff(g.PredictChunked(xt, 7), want); d != 0 {
+				t.Errorf("%d models: run %d: PredictChunked differs from the sequential vote by %v", tt.models, run, d)
+			}
+		}
+	}
+}
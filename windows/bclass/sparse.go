@@ -0,0 +1,255 @@
+package bclass
+
+import (
+	"github.com/gonum/matrix/mat64"
+	"math"
+)
+
+const (
+	sparseMaxIter = 500
+	sparseTol     = 1e-8
+)
+
+// CSR is a sparse matrix in compressed sparse row form. Row i holds the
+// entries Indices[Indptr[i]:Indptr[i+1]] with the matching Values.
+type CSR struct {
+	R, C    int
+	Indptr  []int
+	Indices []int
+	Values  []float64
+}
+
+func NewCSR(r, c int, indptr, indices []int, values []float64) *CSR {
+	return &CSR{r, c, indptr, indices, values}
+}
+
+func (x *CSR) Dims() (r, c int) {
+	return x.R, x.C
+}
+
+// Row returns the column indices and values of the non-zeros in row i.
+func (x *CSR) Row(i int) ([]int, []float64) {
+	return x.Indices[x.Indptr[i]:x.Indptr[i+1]], x.Values[x.Indptr[i]:x.Indptr[i+1]]
+}
+
+func (x *CSR) ToDense() *mat64.Dense {
+	d := mat64.NewDense(x.R, x.C, nil)
+	for i := 0; i < x.R; i++ {
+		idx, val := x.Row(i)
+		for k, j := range idx {
+			d.Set(i, j, val[k])
+		}
+	}
+	return d
+}
+
+func (model Model) PredictSparse(xt *CSR) *mat64.Dense {
+	yt := mat64.NewDense(xt.R, 1, nil)
+	w := denseCol(&model.W)
+	for i := 0; i < xt.R; i++ {
+		idx, val := xt.Row(i)
+		yt.Set(i, 0, basisDot(idx, val, w, basisCols(w, model.Deg), model.Deg))
+	}
+	tresh(yt)
+
+	return yt
+}
+
+// Members are evaluated concurrently like in Predict.
+func (model GlobalModel) PredictSparse(xt *CSR) *mat64.Dense {
+	return model.vote(xt.R, func(m Model) *mat64.Dense { return m.PredictSparse(xt) })
+}
+
+// Labeled returns the rows of x and y whose label is not missing, y is nil
+// when no row has a label.
+func (x *CSR) Labeled(y *mat64.Dense) (*CSR, *mat64.Dense) {
+	keep := &CSR{C: x.C, Indptr: []int{0}}
+	var yk []float64
+	for i := 0; i < x.R; i++ {
+		if v := y.At(i, 0); !math.IsNaN(v) {
+			idx, val := x.Row(i)
+			keep.Indices = append(keep.Indices, idx...)
+			keep.Values = append(keep.Values, val...)
+			keep.Indptr = append(keep.Indptr, len(keep.Indices))
+			yk = append(yk, v)
+		}
+	}
+	if len(yk) == x.R {
+		return x, y
+	}
+	keep.R = len(yk)
+	if keep.R == 0 {
+		return keep, nil
+	}
+	return keep, mat64.NewDense(keep.R, 1, yk)
+}
+
+// RegLSSparse fits the same ridge model as RegLSBasisC on sparse input. The
+// normal equations are solved with conjugate gradients so XᵀX is never formed.
+func RegLSSparse(x *CSR, y *mat64.Dense, lambda float64, deg int) Model {
+	p := BasisWidth(x.C, deg)
+	yv := denseCol(y)
+
+	// b = Xᵀy
+	b := make([]float64, p)
+	for i := 0; i < x.R; i++ {
+		idx, val := x.Row(i)
+		basisAxpy(yv[i], idx, val, b, x.C, deg)
+	}
+
+	// A v = XᵀX v + lambda v
+	apply := func(v, out []float64) {
+		for j := range out {
+			out[j] = lambda * v[j]
+		}
+		for i := 0; i < x.R; i++ {
+			idx, val := x.Row(i)
+			basisAxpy(basisDot(idx, val, v, x.C, deg), idx, val, out, x.C, deg)
+		}
+	}
+
+	w := make([]float64, p)
+	r := make([]float64, p)
+	copy(r, b)
+	d := make([]float64, p)
+	copy(d, r)
+	ad := make([]float64, p)
+	rr := dot(r, r)
+	tol := sparseTol * math.Max(1, math.Sqrt(dot(b, b)))
+	for it := 0; it < sparseMaxIter && math.Sqrt(rr) > tol; it++ {
+		apply(d, ad)
+		alpha := rr / dot(d, ad)
+		for j := range w {
+			w[j] += alpha * d[j]
+			r[j] -= alpha * ad[j]
+		}
+		rrnew := dot(r, r)
+		for j := range d {
+			d[j] = r[j] + rrnew/rr*d[j]
+		}
+		rr = rrnew
+	}
+
+	return Model{W: *mat64.NewDense(p, 1, w), Deg: deg, Lambda: lambda}
+}
+
+// LogRegSparse fits an L2 regularized logistic regression on the polynomial
+// basis of sparse input with -1/+1 labels, using gradient descent with a
+// backtracking line search. The returned model predicts with the same sign
+// rule as the least squares models.
+func LogRegSparse(x *CSR, y *mat64.Dense, lambda float64, deg int) Model {
+	p := BasisWidth(x.C, deg)
+	yv := denseCol(y)
+
+	loss := func(w []float64) float64 {
+		f := 0.5 * lambda * dot(w, w)
+		for i := 0; i < x.R; i++ {
+			idx, val := x.Row(i)
+			f += softplus(-yv[i] * basisDot(idx, val, w, x.C, deg))
+		}
+		return f
+	}
+
+	w := make([]float64, p)
+	g := make([]float64, p)
+	next := make([]float64, p)
+	f := loss(w)
+	step := 1.0
+	for it := 0; it < sparseMaxIter; it++ {
+		for j := range g {
+			g[j] = lambda * w[j]
+		}
+		for i := 0; i < x.R; i++ {
+			idx, val := x.Row(i)
+			m := yv[i] * basisDot(idx, val, w, x.C, deg)
+			basisAxpy(-yv[i]/(1+math.Exp(m)), idx, val, g, x.C, deg)
+		}
+		gg := dot(g, g)
+		if math.Sqrt(gg) < sparseTol {
+			break
+		}
+		var fnext float64
+		for {
+			for j := range next {
+				next[j] = w[j] - step*g[j]
+			}
+			fnext = loss(next)
+			if fnext <= f-0.5*step*gg || step < 1e-12 {
+				break
+			}
+			step *= 0.5
+		}
+		copy(w, next)
+		if f-fnext < sparseTol*math.Max(1, math.Abs(f)) {
+			break
+		}
+		f = fnext
+		step *= 2
+	}
+
+	return Model{W: *mat64.NewDense(p, 1, w), Deg: deg, Lambda: lambda}
+}
+
+// basisDot returns phi·w where phi is the polynomial basis of the sparse row
+// (idx, val) over c features. Features beyond c are ignored.
+func basisDot(idx []int, val, w []float64, c, deg int) float64 {
+	s := w[0]
+	for k, j := range idx {
+		if j >= c {
+			continue
+		}
+		v := val[k]
+		for d := 1; d <= deg; d++ {
+			s += v * w[1+(d-1)*c+j]
+			v *= val[k]
+		}
+	}
+	return s
+}
+
+// basisAxpy adds a*phi to out, where phi is the basis of the sparse row.
+func basisAxpy(a float64, idx []int, val, out []float64, c, deg int) {
+	out[0] += a
+	for k, j := range idx {
+		if j >= c {
+			continue
+		}
+		v := val[k]
+		for d := 1; d <= deg; d++ {
+			out[1+(d-1)*c+j] += a * v
+			v *= val[k]
+		}
+	}
+}
+
+// basisCols recovers the feature count of a model from its weight length.
+func basisCols(w []float64, deg int) int {
+	if deg < 1 {
+		return 0
+	}
+	return (len(w) - 1) / deg
+}
+
+func denseCol(m *mat64.Dense) []float64 {
+	r, _ := m.Dims()
+	v := make([]float64, r)
+	for i := range v {
+		v[i] = m.At(i, 0)
+	}
+	return v
+}
+
+func dot(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func softplus(z float64) float64 {
+	if z > 0 {
+		return z + math.Log1p(math.Exp(-z))
+	}
+	return math.Log1p(math.Exp(z))
+}
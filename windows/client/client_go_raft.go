@@ -2,7 +2,12 @@ package main
 
 import (
 	"../bclass"
+	"../data"
+	"../liveness"
+	"../mtls"
+	"../protocol"
 	"bufio"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"github.com/arcaneiceman/GoVector/govec"
@@ -10,12 +15,10 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
-const BUFFSIZE = 1048576
-
 var (
 	cnum      int     = 0
 	modeldeg  int     = 2
@@ -30,38 +33,63 @@ var (
 	y         *mat64.Dense
 	xt        *mat64.Dense
 	yt        *mat64.Dense
-	l         *net.TCPListener
+	xs        *bclass.CSR
+	xts       *bclass.CSR
+	l         net.Listener
 	gmodel    bclass.GlobalModel
+	gversion  int
+	proto     protocol.Hello
 	gempty    bclass.GlobalModel
-	isjoining bool = true
+	sempty    bclass.ColumnStats
+	gstats    *bclass.ColumnStats
+	strategy  bclass.ImputeStrategy
+	labels    bclass.LabelMap
+	schema    data.Schema
+	key       ed25519.PrivateKey
+	pubkey    []byte
+	isjoining bool    = true
+	impute    *string = flag.String("impute", "none", "missing value treatment: none, mean, median, indicator or drop")
+	useglobal *bool   = flag.Bool("global-stats", false, "impute from federated column statistics once pulled with the stats command")
+	stream    *bool   = flag.Bool("stream", false, "train and test by streaming the dense feature files instead of loading them")
+	labelset  *string = flag.String("labels", "", "original class labels as negative,positive (learned from the label file when empty)")
+	lheader   *bool   = flag.Bool("label-header", false, "the label files start with a header line")
+	nfeatures *int    = flag.Int("features", 0, "number of features of LibSVM files, the same on every node (default: the highest index in the file)")
+	solver    *string = flag.String("solver", "ridge", "solver for LibSVM data: ridge or logistic")
+	tlscert   *string = flag.String("tls-cert", "", "certificate file for mutual TLS (CN is the node name)")
+	tlskey    *string = flag.String("tls-key", "", "private key file for mutual TLS")
+	tlsca     *string = flag.String("tls-ca", "", "CA certificate file that signs the federation's certificates")
+	pollmode  *bool   = flag.Bool("poll", false, "fetch test requests and models from the server instead of listening for them, for nodes behind NAT or firewalls")
+	keyfile   *string = flag.String("key", "", "file with the node's signing key, created on first use (default <name>.ed25519)")
+	gzipped   *bool   = flag.Bool("gzip", false, "have the server send models gzip compressed")
+	quantize  *string = flag.String("quantize", "float64", "precision the server sends model weights with: float64, float32 or int8")
 )
 
-type message struct {
-	Id       int
-	NodeIp   string
-	NodeName string
-	Type     string
-	C        int
-	D        int
-	Model    bclass.Model
-	GModel   bclass.GlobalModel
-}
+// myhello is the protocol and features this node offers when it joins
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.FeatureGovec, protocol.FeatureSigned, protocol.ModelBclass)
 
 func main() {
 	//Parsing inputargs
 	parseArgs()
 
 	//Initialize stuff
-	model = bclass.RegLSBasisC(x, y, modellam, modeldeg)
+	checkFatal(fitModel())
 
-	//Initialize TCP Connection and listener
-	l, _ = net.ListenTCP("tcp", myaddr)
+	//Initialize TCP Connection and listener, unless the server can't reach us
+	if !*pollmode {
+		var err error
+		l, err = mtls.Listen(myaddr)
+		checkFatal(err)
+		go listener()
+	}
 	fmt.Printf("Node initialized as %v.\n", name)
-	go listener()
 
 	for isjoining {
 		requestJoin()
 	}
+	go heartbeat()
+	if *pollmode {
+		go poller()
+	}
 
 	//Main function of this server
 	for {
@@ -71,7 +99,7 @@ func main() {
 
 func listener() {
 	for {
-		conn, err := l.AcceptTCP()
+		conn, err := l.Accept()
 		checkError(err)
 		if err == nil {
 			go connHandler(conn)
@@ -79,26 +107,62 @@ func listener() {
 	}
 }
 
-func connHandler(conn *net.TCPConn) {
-	p := make([]byte, BUFFSIZE)
-	conn.Read(p)
-	var msg message
-	logger.UnpackReceive("Received message", p, &msg)
+func connHandler(conn net.Conn) {
+	msg, err := protocol.Receive(conn, logger)
+	if err == nil {
+		// only the servers send to nodes
+		err = mtls.CheckPeer(conn, mtls.ServerName)
+	}
+	if err != nil {
+		fmt.Printf("\n *** Could not read message from server: %v.\nEnter command: ", err)
+		conn.Close()
+		return
+	}
 	switch msg.Type {
-	case "test_request":
-		// server is asking me to test
-		conn.Write([]byte("OK"))
-		go testModel(msg.Id, msg.Model)
-	case "global_grant":
-		// server is sending global model
-		conn.Write([]byte("OK"))
-		gmodel = msg.GModel
-		fmt.Printf("\n <-- Pulled global model from server.\nEnter command: ")
+	case protocol.TestRequest, protocol.StatsGrant:
+		protocol.Reply(conn, protocol.OK, "")
+		conn.Close()
+		go handleMessage(msg)
 	default:
 		// respond to ping
-		conn.Write([]byte("Unknown command."))
+		protocol.Reply(conn, protocol.Unknown, string(msg.Type))
+		conn.Close()
+	}
+}
+
+// Function that acts on a message from the server, pushed or polled
+func handleMessage(msg protocol.Message) {
+	switch msg.Type {
+	case protocol.TestRequest:
+		// server is asking me to test
+		report, err := protocol.Unpack(&msg)
+		if err != nil {
+			fmt.Printf("\n *** Could not unpack test request: %v.\nEnter command: ", err)
+			return
+		}
+		testModel(msg.Id, msg.Model, due(msg)+lossReport(report, msg, x))
+	case protocol.StatsGrant:
+		// server is sending federated column statistics
+		stats := msg.Stats
+		gstats = &stats
+		fmt.Printf("\n <-- Pulled federated column statistics from server.\nEnter command: ")
+	}
+}
+
+// Function that keeps asking the server for queued messages when it can't
+// dial this node, every poll waits at the server until there is something
+func poller() {
+	for {
+		msgs, err := poll()
+		if err != nil {
+			fmt.Printf("\n *** Could not poll server: %v.\nEnter command: ", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, m := range msgs {
+			handleMessage(m)
+		}
 	}
-	conn.Close()
 }
 
 func parseUserInput() {
@@ -114,32 +178,70 @@ func parseUserInput() {
 	}
 	switch ident {
 	case "read":
-		x = readData(inputargs[3])
-		y = readData(inputargs[4])
+		nx, nxs, niy, nschema, err := readFeatures(inputargs[3])
+		var ny *mat64.Dense
+		if err == nil {
+			err = nschema.Check(schema)
+		}
+		if err == nil {
+			ny, _, err = readLabels(niy, inputargs[3], inputargs[4])
+		}
+		if err == nil {
+			err = checkRows(inputargs[3], nx, nxs, ny)
+		}
+		if err != nil {
+			fmt.Printf(" *** Could not read local data: %v.\n", err)
+			break
+		}
+		x, xs, y = nx, nxs, ny
 		fmt.Printf(" --- Local data updated.\n")
 	case "train":
-		model = bclass.RegLSBasisC(x, y, modellam, modeldeg)
-		yh := model.Predict(x)
-		c, d := bclass.TestResults(yh, y)
+		if err := fitModel(); err != nil {
+			fmt.Printf(" *** Could not train local model: %v.\n", err)
+			break
+		}
+		c, d, err := score(model, false)
+		if err != nil {
+			fmt.Printf(" *** Could not score local model: %v.\n", err)
+			break
+		}
 		fmt.Printf(" --- Local model accuracy on local data is: %v.\n", float64(c)/float64(d))
 	case "push":
-		yh := model.Predict(x)
-		c, d := bclass.TestResults(yh, y)
+		c, d, err := score(model, false)
+		if err != nil {
+			fmt.Printf(" *** Could not score local model: %v.\n", err)
+			break
+		}
 		requestCommit(c, d)
 	case "pull":
 		requestGlobal()
+	case "stats":
+		requestStats()
 	case "valid":
-		yh := gmodel.Predict(x)
-		c, d := bclass.TestResults(yh, y)
+		c, d, err := score(gmodel, false)
+		if err != nil {
+			fmt.Printf(" *** Could not score global model: %v.\n", err)
+			break
+		}
 		fmt.Printf(" --- Global model accuracy on local data is: %v.\n", float64(c)/float64(d))
 	case "test":
-		yh := model.Predict(xt)
-		c, d := bclass.TestResults(yh, yt)
-		fmt.Printf(" --- Local model accuracy on test data is: %v.\n", float64(c)/float64(d))
+		yh, ytrue, err := predictLocal(model, true)
+		if err != nil {
+			fmt.Printf(" *** Could not test local model: %v.\n", err)
+			break
+		}
+		c, d := bclass.TestResults(yh, ytrue)
+		fmt.Printf(" --- Local model accuracy on test data is: %v%v.\n", float64(c)/float64(d), classReport(yh, ytrue))
 	case "testg":
-		yh := gmodel.Predict(xt)
-		c, d := bclass.TestResults(yh, yt)
-		fmt.Printf(" --- Global model accuracy on test data is: %v.\n", float64(c)/float64(d))
+		yh, ytrue, err := predictLocal(gmodel, true)
+		if err != nil {
+			fmt.Printf(" *** Could not test global model: %v.\n", err)
+			break
+		}
+		c, d := bclass.TestResults(yh, ytrue)
+		fmt.Printf(" --- Global model accuracy on test data is: %v%v.\n", float64(c)/float64(d), classReport(yh, ytrue))
+	case "pred":
+		writePredictions()
 	case "who":
 		fmt.Printf("%v\n", name)
 	default:
@@ -148,103 +250,464 @@ func parseUserInput() {
 		fmt.Printf("  read  -- Read data from disk\n")
 		fmt.Printf("  push  -- Push trained model to server\n")
 		fmt.Printf("  pull  -- Obtain global model from server\n")
+		fmt.Printf("  stats -- Exchange column statistics for imputation\n")
 		fmt.Printf("  train -- Train model from data (reports error)\n")
 		fmt.Printf("  valid -- Validate global model with local data\n")
 		fmt.Printf("  test  -- Test local model with test data\n")
 		fmt.Printf("  testg -- Test global model with test data\n")
+		fmt.Printf("  pred  -- Write global model predictions on test data\n")
 		fmt.Printf("  who   -- Print node name\n\n")
 	}
 }
 
 func requestJoin() {
-	//msg := message{cnum, myaddr.String(), name, "join_request", 0, 0, model, gempty}
-	msg := message{cnum, myaddr.String(), name, "join_request", 0, 0, model, gempty}
+	ip := myaddr.String()
+	if *pollmode {
+		// no address tells the server to queue our messages
+		ip = ""
+	}
+	msg := protocol.Message{Id: cnum, NodeIp: ip, NodeName: name, Type: protocol.JoinRequest, Model: model, Schema: schema, PubKey: pubkey}
 	fmt.Printf(" --> Asking server to join.")
 	tcpSend(msg)
 }
 
 func requestCommit(c, d int) {
 	cnum++
-	msg := message{cnum, myaddr.String(), name, "commit_request", c, d, model, gempty}
+	msg := protocol.Message{Id: cnum, NodeIp: myaddr.String(), NodeName: name, Type: protocol.CommitRequest, C: c, D: d, Model: model, Key: protocol.NewKey()}
 	fmt.Printf(" --> Pushing local model to server.")
 	tcpSend(msg)
 }
 
+// Function that pulls the global model, the server only sends it back when
+// it is newer than ours
 func requestGlobal() {
-	msg := message{cnum, myaddr.String(), name, "global_request", 0, 0, model, gempty}
+	msg := protocol.Message{Id: cnum, NodeIp: myaddr.String(), NodeName: name, Type: protocol.GlobalRequest, Model: model, Version: gversion}
 	fmt.Printf(" --> Requesting global model from server.")
+	conn, r, err := request(msg)
+	if err != nil {
+		fmt.Printf(" [NO!]\n *** No reply from server: %v.\n *** Global model is still version %v.\n", err, gversion)
+		return
+	}
+	defer conn.Close()
+	switch {
+	case r.Code == protocol.NotModified:
+		fmt.Printf(" [OK]\n --- Global model version %v is up to date.\n", gversion)
+	case r.Accepted():
+		grant, err := protocol.Receive(conn, logger)
+		if err != nil {
+			fmt.Printf(" [NO!]\n *** Could not read global model: %v.\n *** Global model is still version %v.\n", err, gversion)
+			return
+		}
+		report, err := protocol.Unpack(&grant)
+		if err != nil {
+			fmt.Printf(" [NO!]\n *** Could not unpack global model: %v.\n *** Global model is still version %v.\n", err, gversion)
+			return
+		}
+		gmodel, gversion = grant.GModel, grant.Version
+		fmt.Printf(" [OK]\n <-- Pulled global model version %v from server.\n%v", gversion, lossReport(report, grant, xt))
+	default:
+		fmt.Printf(" [NO!]\n *** Request was denied by server: %v.\n *** Global model is still version %v.\n", r, gversion)
+	}
+}
+
+func requestStats() {
+	if x == nil {
+		fmt.Printf(" *** Column statistics are only shared for dense data held in memory.\n")
+		return
+	}
+	msg := protocol.Message{Id: cnum, NodeIp: myaddr.String(), NodeName: name, Type: protocol.StatsRequest, Model: model, Stats: bclass.Stats(x)}
+	fmt.Printf(" --> Sharing column statistics with server.")
 	tcpSend(msg)
 }
 
-func testModel(id int, testmodel bclass.Model) {
-	fmt.Printf("\n <-- Received test requset.\nEnter command: ")
-	yh := testmodel.Predict(x)
-	c, d := bclass.TestResults(yh, y)
-	msg := message{id, myaddr.String(), name, "test_complete", c, d, testmodel, gempty}
+func testModel(id int, testmodel bclass.Model, loss string) {
+	fmt.Printf("\n <-- Received test requset.\n%vEnter command: ", loss)
+	c, d, err := score(testmodel, false)
+	if err != nil {
+		// the server sends the test again once its deadline passed
+		fmt.Printf("\n *** Could not test model, not answering: %v.\nEnter command: ", err)
+		return
+	}
+	msg := protocol.Message{Id: id, NodeIp: myaddr.String(), NodeName: name, Type: protocol.TestComplete, C: c, D: d, Model: testmodel, Key: protocol.NewKey()}
 	fmt.Printf("\n --> Sending completed test requset.")
 	tcpSend(msg)
 	fmt.Printf("Enter command: ")
 }
 
-func tcpSend(msg message) {
-	p := make([]byte, BUFFSIZE)
+// Function that tells when a test request has to be answered by, empty for
+// servers that set no deadline
+func due(m protocol.Message) string {
+	if m.Deadline.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" --- Due by %v.\n", m.Deadline.Format("15:04:05"))
+}
+
+// Function that describes what packing cost a model that arrived packed and
+// how many predictions on the local data xl it can change, empty for models
+// that arrived whole
+func lossReport(r *protocol.Report, m protocol.Message, xl *mat64.Dense) string {
+	if r == nil {
+		return ""
+	}
+	s := fmt.Sprintf(" --- Model arrived as %v.\n", r)
+	if r.MaxErr() == 0 {
+		return s
+	}
+	if xl == nil {
+		return s + " --- Its effect on accuracy is only estimated for dense data held in memory.\n"
+	}
+	n, _ := xl.Dims()
+	return s + fmt.Sprintf(" --- At most %v of %v local predictions can differ from the full-precision model.\n", r.Unsure(m, xl), n)
+}
+
+// Function that connects to the first server replica that answers
+func dial() (net.Conn, error) {
 	var err error
-	var conn *net.TCPConn
+	var conn net.Conn
 	for _, v := range svaddr {
-		conn, err = net.DialTCP("tcp", nil, v)
+		conn, err = mtls.Dial(v.String(), mtls.ServerName)
 		if err == nil {
 			break
 		}
 	}
-	checkError(err)
-	outbuf := logger.PrepareSend(msg.Type, msg)
-	_, err = conn.Write(outbuf)
-	checkError(err)
-	n, _ := conn.Read(p)
-	if string(p[:n]) == "OK" {
-		fmt.Printf(" [OK]\n")
-	} else if string(p[:n]) == "Joined" {
-		fmt.Printf(" [OK]\n")
+	return conn, err
+}
+
+// Function that signs and sends a message to the server and reads the
+// response, resending it with backoff while the server can't be reached or
+// asks for a retry. The connection stays open for what the server sends
+// after the response
+func request(msg protocol.Message) (net.Conn, protocol.Response, error) {
+	var conn net.Conn
+	r, err := protocol.Resend(func() (protocol.Response, error) {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		// every attempt is signed anew, servers accept a signature once
+		protocol.Sign(&msg, key)
+		c, err := dial()
+		if err != nil {
+			return protocol.Response{}, err
+		}
+		var r protocol.Response
+		if msg.Type == protocol.JoinRequest {
+			// a join opens with the protocol we speak
+			err = protocol.WriteHello(c, myhello)
+		}
+		if err == nil {
+			err = protocol.Send(c, logger, msg)
+		}
+		if err == nil {
+			r, err = protocol.ReadResponse(c)
+		}
+		if err != nil {
+			c.Close()
+			return r, err
+		}
+		conn = c
+		return r, nil
+	})
+	if err != nil {
+		return nil, r, err
+	}
+	return conn, r, nil
+}
+
+func tcpSend(msg protocol.Message) {
+	conn, r, err := request(msg)
+	if err != nil {
+		fmt.Printf(" [NO!]\n *** No reply from server: %v.\nEnter command: ", err)
+		return
+	}
+	if r.Code == protocol.Joined {
+		// the server answers with the protocol version and features we agreed on
+		if proto, err = protocol.ReadHello(conn); err != nil {
+			fmt.Printf(" [NO!]\n *** Could not read the server's protocol: %v.\n", err)
+			conn.Close()
+			return
+		}
+	}
+	conn.Close()
+	switch {
+	case r.Code == protocol.Joined:
+		fmt.Printf(" [OK]\n --- Speaking %v.\n", proto)
 		isjoining = false
-	} else {
-		fmt.Printf(" [NO!]\n *** Request was denied by server: %v.\nEnter command: ", string(p[:n]))
+	case r.Accepted():
+		fmt.Printf(" [OK]\n")
+	case r.Code == protocol.SchemaMismatch, r.Code == protocol.Incompatible:
+		// retrying can't help, the local data or the node itself has to change
+		fmt.Printf(" [NO!]\n *** Request was denied by server: %v.\n", r)
+		os.Exit(1)
+	case r.Code == protocol.Restart:
+		// the server declared us dead
+		fmt.Printf(" [NO!]\n *** Server asked us to join again: %v.\n", r)
+		requestJoin()
+	default:
+		fmt.Printf(" [NO!]\n *** Request was denied by server: %v.\nEnter command: ", r)
 	}
 }
 
-func readData(filename string) *mat64.Dense {
-	dat, err := ioutil.ReadFile(filename)
-	checkError(err)
-	array := strings.Split(string(dat), "\n")
-	r := len(array) - 1
-	temp := strings.Split(array[0], ",")
-	c := len(temp)
-	vdat := make([]float64, c*r)
-	for i := 0; i < r; i++ {
-		temp = strings.Split(array[i], ",")
-		for j := 0; j < c; j++ {
-			vdat[i*c+j], _ = strconv.ParseFloat(temp[j], 64)
-		}
-	}
-	return mat64.NewDense(r, c, vdat)
+// Function that fetches the test requests and grants the server queued for us
+func poll() ([]protocol.Message, error) {
+	msg := protocol.Message{Id: cnum, NodeName: name, Type: protocol.PollRequest}
+	conn, r, err := request(msg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if r.Code == protocol.Restart {
+		requestJoin()
+	}
+	if !r.Accepted() {
+		return nil, fmt.Errorf("%v", r)
+	}
+	return protocol.ReceiveBatch(conn, logger)
+}
+
+// Function that tells the server we are alive every liveness.Interval, a
+// server that declared us dead has us join again
+func heartbeat() {
+	for {
+		time.Sleep(liveness.Interval)
+		msg := protocol.Message{Id: cnum, NodeIp: myaddr.String(), NodeName: name, Type: protocol.Heartbeat}
+		conn, r, err := request(msg)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		if r.Code == protocol.Restart {
+			fmt.Printf("\n *** Server declared us dead, joining again.")
+			requestJoin()
+			fmt.Printf("Enter command: ")
+		}
+	}
+}
+
+// Function that trains the local model on dense or sparse local data
+func fitModel() error {
+	if *stream {
+		var stats *bclass.ColumnStats
+		if *useglobal {
+			stats = gstats
+		}
+		m, err := data.FitStream(inputargs[3], y, modellam, modeldeg, strategy, stats)
+		if err != nil {
+			return err
+		}
+		model = m
+		model.Labels = labels
+		return nil
+	}
+	if xs != nil {
+		xl, yl := xs.Labeled(y)
+		if yl == nil {
+			return fmt.Errorf("local data has no labeled rows")
+		}
+		if *solver == "logistic" {
+			model = bclass.LogRegSparse(xl, yl, modellam, modeldeg)
+		} else {
+			model = bclass.RegLSSparse(xl, yl, modellam, modeldeg)
+		}
+		model.Labels = labels
+		return nil
+	}
+	if *solver == "logistic" {
+		return fmt.Errorf("the logistic solver needs LibSVM data")
+	}
+	var stats *bclass.ColumnStats
+	if *useglobal {
+		stats = gstats
+	}
+	m, err := bclass.RegLSImputed(x, y, modellam, modeldeg, bclass.NewImputer(x, strategy, stats))
+	if err != nil {
+		return fmt.Errorf("%v, choose a strategy with -impute", err)
+	}
+	model = m
+	model.Labels = labels
+	return nil
+}
+
+type predictor interface {
+	Predict(xt *mat64.Dense) *mat64.Dense
+	PredictChunked(xt *mat64.Dense, rows int) *mat64.Dense
+	PredictSparse(xt *bclass.CSR) *mat64.Dense
+}
+
+// Function that predicts the local training data or the test data, returns
+// the predictions and the true labels, or why the streamed data couldn't be
+// predicted
+func predictLocal(p predictor, test bool) (yh, ytrue *mat64.Dense, err error) {
+	if *stream {
+		xfile, ytrue := inputargs[3], y
+		if test {
+			xfile, ytrue = inputargs[5], yt
+		}
+		yh, err := data.PredictFile(xfile, p.Predict, bclass.BasisBlockRows)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not stream %v: %v", xfile, err)
+		}
+		if err := checkRows(xfile, yh, nil, ytrue); err != nil {
+			return nil, nil, err
+		}
+		return yh, ytrue, nil
+	}
+	if test {
+		if xts != nil {
+			return p.PredictSparse(xts), yt, nil
+		}
+		return p.PredictChunked(xt, bclass.BasisBlockRows), yt, nil
+	}
+	if xs != nil {
+		return p.PredictSparse(xs), y, nil
+	}
+	return p.PredictChunked(x, bclass.BasisBlockRows), y, nil
+}
+
+// Function that scores a model on the local training data or the test data
+func score(p predictor, test bool) (c, d int, err error) {
+	yh, ytrue, err := predictLocal(p, test)
+	if err != nil {
+		return 0, 0, err
+	}
+	c, d = bclass.TestResults(yh, ytrue)
+	return c, d, nil
+}
+
+// Function that reports the accuracy for each original class label
+func classReport(yh, ytrue *mat64.Dense) string {
+	c, d := bclass.ClassResults(yh, ytrue)
+	l := labels.OrDefault()
+	return fmt.Sprintf(" (%v: %v/%v, %v: %v/%v)", l.Neg, c[0], d[0], l.Pos, c[1], d[1])
+}
+
+// Function that writes the global model predictions on the test data, decoded
+// to the original labels, one per line
+func writePredictions() {
+	yh, _, err := predictLocal(gmodel, true)
+	if err != nil {
+		fmt.Printf(" *** Could not predict test data: %v.\n", err)
+		return
+	}
+	filename := name + "_predictions.txt"
+	out := strings.Join(gmodel.Labels().Decode(yh), "\n") + "\n"
+	if err := ioutil.WriteFile(filename, []byte(out), 0644); err != nil {
+		fmt.Printf(" *** Could not write predictions: %v.\n", err)
+		return
+	}
+	fmt.Printf(" --- Global model predictions written to %v.\n", filename)
+}
+
+// Function that checks the features x or xs read from filename have a label
+// each in y. Streamed features are checked while they are read
+func checkRows(filename string, x *mat64.Dense, xs *bclass.CSR, y *mat64.Dense) error {
+	var n int
+	switch {
+	case xs != nil:
+		n = xs.R
+	case x != nil:
+		n, _ = x.Dims()
+	default:
+		return nil
+	}
+	if r, _ := y.Dims(); r != n {
+		return fmt.Errorf("%s has %d rows but there are %d labels", filename, n, r)
+	}
+	return nil
+}
+
+// LibSVM feature files are kept sparse, everything else is read dense. In
+// stream mode only the header is checked and nothing is kept in memory. The
+// returned schema carries the current label set.
+func readFeatures(filename string) (*mat64.Dense, *bclass.CSR, *mat64.Dense, data.Schema, error) {
+	if *stream {
+		rd, err := data.OpenReader(filename)
+		if err != nil {
+			return nil, nil, nil, data.Schema{}, err
+		}
+		rd.Close()
+		s := rd.Schema()
+		s.Labels = labels
+		return nil, nil, nil, s, nil
+	}
+	ds, err := data.LoadWidth(filename, *nfeatures)
+	if err != nil {
+		return nil, nil, nil, data.Schema{}, err
+	}
+	ds.Schema.Labels = labels
+	return ds.X, ds.Sparse, ds.Y, ds.Schema, nil
+}
+
+// Function that encodes the labels of the rows of xfile: iy, the labels a
+// LibSVM file carries, when it has them, or else those read from yfile
+func readLabels(iy *mat64.Dense, xfile, yfile string) (*mat64.Dense, bclass.LabelMap, error) {
+	if iy != nil {
+		return data.EncodeLabels(xfile, iy, labels)
+	}
+	return data.ReadLabels(yfile, labels, *lheader)
 }
 
 func parseArgs() {
 	flag.Parse()
 	inputargs = flag.Args()
 	var err error
+	strategy, err = bclass.ParseImputeStrategy(*impute)
+	checkFatal(err)
+	if *solver != "ridge" && *solver != "logistic" {
+		checkFatal(fmt.Errorf("unknown solver %q, choose ridge or logistic", *solver))
+	}
+	prec, err := bclass.ParsePrecision(*quantize)
+	checkFatal(err)
+	// offer the server to pack the models it sends us
+	switch prec {
+	case bclass.Float32:
+		myhello.Features = append(myhello.Features, protocol.FeatureFloat32)
+	case bclass.Int8:
+		myhello.Features = append(myhello.Features, protocol.FeatureInt8)
+	}
+	if *gzipped {
+		myhello.Features = append(myhello.Features, protocol.FeatureGzip)
+	}
+	checkFatal(mtls.Setup(*tlscert, *tlskey, *tlsca))
 	svaddr = make(map[int]*net.TCPAddr)
 	if len(inputargs) < 2 {
 		fmt.Printf("Not enough inputs.\n")
 		return
 	}
 	name = inputargs[0]
+	if *keyfile == "" {
+		*keyfile = name + ".ed25519"
+	}
+	key, err = protocol.LoadKey(*keyfile)
+	checkFatal(err)
+	pubkey = key.Public().(ed25519.PublicKey)
 	myaddr, err = net.ResolveTCPAddr("tcp", inputargs[1])
 	checkError(err)
 	getNodeAddr(inputargs[2])
-	x = readData(inputargs[3])
-	y = readData(inputargs[4])
-	xt = readData(inputargs[5])
-	yt = readData(inputargs[6])
+	var iy, iyt *mat64.Dense
+	x, xs, iy, schema, err = readFeatures(inputargs[3])
+	checkFatal(err)
+	if *labelset != "" {
+		l := strings.Split(*labelset, ",")
+		if len(l) != 2 {
+			checkFatal(fmt.Errorf("-labels needs two labels, got %q", *labelset))
+		}
+		labels = bclass.LabelMap{Neg: l[0], Pos: l[1]}
+	}
+	y, labels, err = readLabels(iy, inputargs[3], inputargs[4])
+	checkFatal(err)
+	checkFatal(checkRows(inputargs[3], x, xs, y))
+	schema.Labels = labels
+	var tschema data.Schema
+	xt, xts, iyt, tschema, err = readFeatures(inputargs[5])
+	checkFatal(err)
+	if err = tschema.Check(schema); err != nil {
+		checkFatal(fmt.Errorf("test data does not match training data: %v", err))
+	}
+	yt, _, err = readLabels(iyt, inputargs[5], inputargs[6])
+	checkFatal(err)
+	checkFatal(checkRows(inputargs[5], xt, xts, yt))
 	logger = govec.Initialize(inputargs[0], inputargs[7])
 }
 
@@ -263,3 +726,10 @@ func checkError(err error) {
 		//os.Exit(1)
 	}
 }
+
+func checkFatal(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"github.com/4180122/distbayes/distmlMatlab"
+	"github.com/4180122/distbayes/frame"
+	"github.com/4180122/distbayes/protocol"
 	"github.com/arcaneiceman/GoVector/govec"
 	"io/ioutil"
 	"math/rand"
@@ -37,20 +38,18 @@ var (
 	connected int  = 0
 )
 
+// myhello is the protocol and features this node offers when it joins
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.ModelMatlab)
+
 type message struct {
 	Id       int
 	NodeIp   string
 	NodeName string
-	Type     string
+	Type     protocol.Kind
 	Model    distmlMatlab.MatModel
 	GModel   distmlMatlab.MatGlobalModel
 }
 
-type response struct {
-	Resp  string
-	Error string
-}
-
 func main() {
 	//Parsing inputargs
 	parseArgs()
@@ -118,24 +117,24 @@ func listener() {
 
 func connHandler(conn *net.TCPConn) {
 	var msg message
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+	enc := frame.NewEncoder(conn)
+	dec := frame.NewDecoder(conn)
 	err := dec.Decode(&msg)
 	checkError(err)
 	switch msg.Type {
-	case "test_request":
+	case protocol.TestRequest:
 		// server is asking me to test
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		go testModel(msg.Id, msg.Model)
-	case "global_grant":
+	case protocol.GlobalGrant:
 		// server is sending global model
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		gmodel = msg.GModel
 		fmt.Printf("\n <-- Pulled global model from server.\nEnter command: ")
 		//go testGlobal(msg.GModel)
 	default:
 		// respond to ping
-		enc.Encode(response{"NO", "Unknown Command"})
+		enc.Encode(protocol.Response{Code: protocol.Unknown, Error: string(msg.Type)})
 	}
 	conn.Close()
 	connected--
@@ -190,19 +189,19 @@ func parseuserinput() {
 }
 
 func requestJoin() {
-	msg := message{cnum, myaddr.String(), name, "join_request", model, gempty}
+	msg := message{cnum, myaddr.String(), name, protocol.JoinRequest, model, gempty}
 	fmt.Printf(" --> Asking server to join.")
 	tcpSend(msg)
 }
 
 func requestCommit() {
-	msg := message{cnum, myaddr.String(), name, "commit_request", model, gempty}
+	msg := message{cnum, myaddr.String(), name, protocol.CommitRequest, model, gempty}
 	fmt.Printf(" --> Pushing local model to server.")
 	tcpSend(msg)
 }
 
 func requestGlobal() {
-	msg := message{cnum, myaddr.String(), name, "global_request", model, gempty}
+	msg := message{cnum, myaddr.String(), name, protocol.GlobalRequest, model, gempty}
 	fmt.Printf(" --> Requesting global model from server.")
 	tcpSend(msg)
 }
@@ -211,7 +210,7 @@ func testModel(id int, testmodel distmlMatlab.MatModel) {
 	fmt.Printf("\n <-- Received test requset.\nEnter command: ")
 	istesting++
 	distmlMatlab.TestModel(X, Y, &testmodel)
-	msg := message{id, myaddr.String(), name, "test_complete", testmodel, gempty}
+	msg := message{id, myaddr.String(), name, protocol.TestComplete, testmodel, gempty}
 	fmt.Printf("\n --> Sending completed test requset.")
 	tcpSend(msg)
 	istesting--
@@ -228,28 +227,38 @@ func tcpSend(msg message) {
 				break
 			}
 		}
-		enc := gob.NewEncoder(conn)
-		dec := gob.NewDecoder(conn)
+		enc := frame.NewEncoder(conn)
+		dec := frame.NewDecoder(conn)
+		if msg.Type == protocol.JoinRequest {
+			// a join opens with the protocol we speak
+			err = protocol.WriteHello(conn, myhello)
+			checkError(err)
+		}
 		err = enc.Encode(&msg)
 		checkError(err)
-		var r response
+		var r protocol.Response
 		err = dec.Decode(&r)
 		checkError(err)
-		if r.Resp == "OK" {
+		if r.Accepted() {
 			fmt.Printf(" [OK]\n")
-			if r.Error == "Committed" {
+			if r.Code == protocol.Committed {
 				committed = true
-			} else if r.Error == "Joined" {
+			} else if r.Code == protocol.Joined {
 				isjoining = false
+				if h, err := protocol.ReadHello(conn); err == nil {
+					fmt.Printf(" --- Speaking %v.\n", h)
+				}
 			}
-		} else if r.Resp == "NO" {
-			fmt.Printf(" [%s]\n *** Request was denied by server: %v.\nEnter command: ", r.Resp, r.Error)
-			if r.Error == "Restart" {
+		} else {
+			fmt.Printf(" [NO]\n *** Request was denied by server: %v.\nEnter command: ", r)
+			if r.Code == protocol.Incompatible {
+				// retrying can't help, this node has to be upgraded
+				os.Exit(1)
+			}
+			if r.Code == protocol.Restart {
 				time.Sleep(time.Duration(5 * time.Second))
 				requestJoin()
 			}
-		} else {
-			fmt.Printf(" [%s]\n *** Something strange Happened: %v.\nEnter command: ", r.Resp, r.Error)
 		}
 		connected--
 	}
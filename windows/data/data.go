@@ -0,0 +1,427 @@
+package data
+
+import (
+	"../bclass"
+	"bufio"
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Format int
+
+const (
+	CSV Format = iota
+	TSV
+	LibSVM
+)
+
+type ColumnType int
+
+const (
+	Numeric ColumnType = iota
+)
+
+func (t ColumnType) String() string {
+	switch t {
+	case Numeric:
+		return "numeric"
+	}
+	return fmt.Sprintf("ColumnType(%d)", int(t))
+}
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Schema describes the feature columns of a dataset and its label set.
+// Named is set when the column names come from a header rather than being
+// generated.
+type Schema struct {
+	Columns []Column
+	Named   bool
+	Labels  bclass.LabelMap
+}
+
+// Dataset holds the features of a file, either dense or sparse, and the
+// labels when the format carries them (LibSVM). Missing values are stored
+// as NaN and counted in Missing.
+type Dataset struct {
+	Schema  Schema
+	X       *mat64.Dense
+	Sparse  *bclass.CSR
+	Y       *mat64.Dense
+	Missing int
+}
+
+// ParseError reports the 1-based line and column of a malformed field.
+type ParseError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// IsMissing reports whether a field marks a missing value: an empty field,
+// NA, N/A, NaN, NULL or ?.
+func IsMissing(field string) bool {
+	switch strings.ToUpper(strings.TrimSpace(field)) {
+	case "", "NA", "N/A", "NAN", "NULL", "?":
+		return true
+	}
+	return false
+}
+
+func (s Schema) Width() int {
+	return len(s.Columns)
+}
+
+func (s Schema) Empty() bool {
+	return s.Columns == nil
+}
+
+// Check returns an error describing the first difference between s and the
+// federation schema f, nil when a node with schema s can take part. Column
+// names are only compared when both schemas have them from a header.
+func (s Schema) Check(f Schema) error {
+	if s.Width() != f.Width() {
+		return fmt.Errorf("%d features, the federation has %d", s.Width(), f.Width())
+	}
+	for j := range s.Columns {
+		if s.Named && f.Named && s.Columns[j].Name != f.Columns[j].Name {
+			return fmt.Errorf("feature %d is named %q, the federation's is %q", j+1, s.Columns[j].Name, f.Columns[j].Name)
+		}
+		if s.Columns[j].Type != f.Columns[j].Type {
+			return fmt.Errorf("feature %d is %v, the federation's is %v", j+1, s.Columns[j].Type, f.Columns[j].Type)
+		}
+	}
+	if !s.Labels.Equal(f.Labels) {
+		return fmt.Errorf("label set %v, the federation's is %v", s.Labels, f.Labels)
+	}
+	return nil
+}
+
+// CheckModel returns an error when the weights of m don't fit the polynomial
+// basis of the schema's features, nil otherwise.
+func (s Schema) CheckModel(m bclass.Model) error {
+	r, _ := m.W.Dims()
+	want := bclass.BasisWidth(s.Width()+len(m.Impute.Flags), m.Deg)
+	if r != want {
+		return fmt.Errorf("model has %d weights, degree %d over %d features needs %d", r, m.Deg, s.Width(), want)
+	}
+	if !m.Labels.Equal(s.Labels) {
+		return fmt.Errorf("model label set %v, the federation's is %v", m.Labels, s.Labels)
+	}
+	return nil
+}
+
+// FormatOf picks the format from the file extension: .tsv is tab separated,
+// .svm and .libsvm are LibSVM, everything else is comma separated.
+func FormatOf(filename string) Format {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".tsv":
+		return TSV
+	case ".svm", ".libsvm":
+		return LibSVM
+	default:
+		return CSV
+	}
+}
+
+// Load reads filename in the format given by its extension.
+func Load(filename string) (*Dataset, error) {
+	return LoadFormat(filename, FormatOf(filename))
+}
+
+func LoadFormat(filename string, format Format) (*Dataset, error) {
+	return loadFormat(filename, format, 0)
+}
+
+// LoadWidth is Load with the feature count of LibSVM files fixed to width,
+// instead of taken from the highest index the file happens to use, so the
+// files of all nodes have the federation's width. Other formats keep theirs.
+func LoadWidth(filename string, width int) (*Dataset, error) {
+	return loadFormat(filename, FormatOf(filename), width)
+}
+
+func loadFormat(filename string, format Format, width int) (*Dataset, error) {
+	if format != LibSVM {
+		return loadDelimited(filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return readLibSVM(filename, scanner, width)
+}
+
+// ReadDense loads a dense feature or label file.
+func ReadDense(filename string) (*mat64.Dense, error) {
+	ds, err := Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ds.X == nil {
+		return nil, fmt.Errorf("%s: expected dense data", filename)
+	}
+	return ds.X, nil
+}
+
+func isHeader(fields []string) bool {
+	for _, field := range fields {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(field), 64); err == nil || IsMissing(field) {
+			return false
+		}
+	}
+	return true
+}
+
+// readLibSVM reads rows of 1-based index:value pairs, optionally preceded by
+// a label. Either every row has a label or none does. Blank lines are
+// skipped. The data has width features, or as many as the highest index when
+// width is 0.
+func readLibSVM(filename string, scanner *bufio.Scanner, width int) (*Dataset, error) {
+	x := &bclass.CSR{C: width, Indptr: []int{0}}
+	var labels []float64
+	line := 0
+	for scanner.Scan() {
+		line++
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+		if !strings.Contains(tokens[0], ":") {
+			if x.R > 0 && labels == nil {
+				return nil, &ParseError{filename, line, 1, "label on a file without labels"}
+			}
+			v, err := strconv.ParseFloat(tokens[0], 64)
+			if err != nil {
+				return nil, &ParseError{filename, line, 1, fmt.Sprintf("cannot parse label %q", tokens[0])}
+			}
+			labels = append(labels, v)
+		} else if labels != nil {
+			return nil, &ParseError{filename, line, 1, "missing label"}
+		}
+		first := 0
+		if labels != nil {
+			first = 1
+		}
+		for k := first; k < len(tokens); k++ {
+			tok, col := tokens[k], k+1
+			kv := strings.SplitN(tok, ":", 2)
+			if len(kv) != 2 {
+				return nil, &ParseError{filename, line, col, fmt.Sprintf("expected index:value, got %q", tok)}
+			}
+			j, err := strconv.Atoi(kv[0])
+			if err != nil || j < 1 {
+				return nil, &ParseError{filename, line, col, fmt.Sprintf("bad feature index %q", kv[0])}
+			}
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return nil, &ParseError{filename, line, col, fmt.Sprintf("cannot parse %q as a number", kv[1])}
+			}
+			if j > x.C {
+				if width > 0 {
+					return nil, &ParseError{filename, line, col, fmt.Sprintf("feature index %d beyond the %d features", j, width)}
+				}
+				x.C = j
+			}
+			x.Indices = append(x.Indices, j-1)
+			x.Values = append(x.Values, v)
+		}
+		x.Indptr = append(x.Indptr, len(x.Indices))
+		x.R++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	ds := &Dataset{Sparse: x}
+	ds.Schema.Columns = make([]Column, x.C)
+	for j := range ds.Schema.Columns {
+		ds.Schema.Columns[j] = Column{fmt.Sprintf("x%d", j+1), Numeric}
+	}
+	if labels != nil {
+		ds.Y = mat64.NewDense(len(labels), 1, labels)
+	}
+	return ds, nil
+}
+
+// ReadRecords reads the raw fields of a CSV or TSV file without converting
+// them, returning the header (nil when the file has none) and the rows.
+func ReadRecords(filename string) ([]string, [][]string, error) {
+	sep := ","
+	if FormatOf(filename) == TSV {
+		sep = "\t"
+	} else if FormatOf(filename) != CSV {
+		return nil, nil, fmt.Errorf("%s: expected a CSV or TSV file", filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var header []string
+	var rows [][]string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		fields := strings.Split(text, sep)
+		if header == nil && rows == nil && isHeader(fields) {
+			header = fields
+			continue
+		}
+		width := len(header)
+		if rows != nil {
+			width = len(rows[0])
+		}
+		if width > 0 && len(fields) != width {
+			return nil, nil, &ParseError{filename, line, 0, fmt.Sprintf("expected %d fields, got %d", width, len(fields))}
+		}
+		rows = append(rows, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return header, rows, nil
+}
+
+// ReadLabels reads a single column label file and encodes it as -1/+1. If
+// labels is the zero LabelMap the mapping is learned from the file: the two
+// distinct labels are sorted (numerically when both are numbers) and the
+// first becomes -1. A file with a single distinct label can only be encoded
+// with an explicit map. With header the first line is skipped, labels can't
+// be told from a header. Missing labels are stored as NaN.
+func ReadLabels(filename string, labels bclass.LabelMap, header bool) (*mat64.Dense, bclass.LabelMap, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, labels, err
+	}
+	defer f.Close()
+
+	var raw []string
+	var lines []int
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if header {
+			header = false
+			continue
+		}
+		if strings.ContainsAny(text, ",\t") {
+			return nil, labels, &ParseError{filename, line, 0, "expected a single label column"}
+		}
+		if v, err := strconv.ParseFloat(text, 64); err == nil && !IsMissing(text) {
+			// 1, 1.0 and 1e0 are the same label
+			text = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		raw = append(raw, text)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, labels, err
+	}
+
+	if len(raw) == 0 {
+		return nil, labels, &ParseError{filename, line, 0, "no data rows"}
+	}
+	return encodeLabels(filename, raw, lines, labels)
+}
+
+// EncodeLabels encodes the labels a LibSVM file carries in its rows like
+// ReadLabels encodes a label file, y holds them as read and NaN where a row
+// has none.
+func EncodeLabels(filename string, y *mat64.Dense, labels bclass.LabelMap) (*mat64.Dense, bclass.LabelMap, error) {
+	r, _ := y.Dims()
+	raw := make([]string, r)
+	for i := range raw {
+		raw[i] = strconv.FormatFloat(y.At(i, 0), 'g', -1, 64)
+	}
+	return encodeLabels(filename, raw, nil, labels)
+}
+
+// encodeLabels maps the raw labels found on lines of filename to -1/+1,
+// learning the map when labels is the zero LabelMap. Without lines a label
+// is reported by its row.
+func encodeLabels(filename string, raw []string, lines []int, labels bclass.LabelMap) (*mat64.Dense, bclass.LabelMap, error) {
+	counts := make(map[string]int)
+	for _, v := range raw {
+		if !IsMissing(v) {
+			counts[v]++
+		}
+	}
+	var err error
+	if labels == (bclass.LabelMap{}) {
+		labels, err = learnLabels(counts)
+		if err != nil {
+			return nil, labels, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+
+	vdat := make([]float64, len(raw))
+	for i, v := range raw {
+		if IsMissing(v) {
+			vdat[i] = math.NaN()
+			continue
+		}
+		vdat[i], err = labels.Encode(v)
+		if err != nil && lines == nil {
+			return nil, labels, fmt.Errorf("%s: row %d: %v", filename, i+1, err)
+		}
+		if err != nil {
+			return nil, labels, &ParseError{filename, lines[i], 1, err.Error()}
+		}
+	}
+	return mat64.NewDense(len(vdat), 1, vdat), labels, nil
+}
+
+func learnLabels(counts map[string]int) (bclass.LabelMap, error) {
+	var seen []string
+	for v := range counts {
+		seen = append(seen, v)
+	}
+	if len(seen) == 1 {
+		// a lone -1 or 1 is the legacy encoding
+		if _, err := bclass.DefaultLabels.Encode(seen[0]); err == nil {
+			return bclass.DefaultLabels, nil
+		}
+		return bclass.LabelMap{}, fmt.Errorf("only label %q present, give the label set explicitly", seen[0])
+	}
+	if len(seen) != 2 {
+		return bclass.LabelMap{}, fmt.Errorf("found %d distinct labels, expected 2", len(seen))
+	}
+	a, erra := strconv.ParseFloat(seen[0], 64)
+	b, errb := strconv.ParseFloat(seen[1], 64)
+	if (erra == nil && errb == nil && a > b) || ((erra != nil || errb != nil) && seen[0] > seen[1]) {
+		seen[0], seen[1] = seen[1], seen[0]
+	}
+	return bclass.LabelMap{Neg: seen[0], Pos: seen[1]}, nil
+}
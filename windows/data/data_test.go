@@ -0,0 +1,255 @@
+package data
+
+import (
+	"../bclass"
+	"github.com/gonum/matrix/mat64"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes content to name in a new temporary directory and returns
+// the file's path.
+func writeFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// same compares floats, with NaN equal to NaN.
+func same(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// values returns the elements of m row by row.
+func values(m *mat64.Dense) []float64 {
+	r, c := m.Dims()
+	v := make([]float64, 0, r*c)
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			v = append(v, m.At(i, j))
+		}
+	}
+	return v
+}
+
+func TestLoadDelimited(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name, content string
+		rows, cols    int
+		x             []float64
+		named         bool
+		missing       int
+	}{
+		{"plain.csv", "1,2\n3,4\n", 2, 2, []float64{1, 2, 3, 4}, false, 0},
+		{"header.csv", "a,b\n1,2\n3,4\n", 2, 2, []float64{1, 2, 3, 4}, true, 0},
+		{"blank.csv", "\n1,2\n\n3,4", 2, 2, []float64{1, 2, 3, 4}, false, 0},
+		{"crlf.csv", "a,b\r\n1,2\r\n", 1, 2, []float64{1, 2}, true, 0},
+		{"missing.csv", "1,NA\n?,4\n,6\n", 3, 2, []float64{1, nan, nan, 4, nan, 6}, false, 3},
+		{"tabs.tsv", "x\ty\tz\n1\t2\t3\n", 1, 3, []float64{1, 2, 3}, true, 0},
+		{"spaces.csv", " 1 , 2 \n", 1, 2, []float64{1, 2}, false, 0},
+	}
+	for _, tt := range tests {
+		filename := writeFile(t, tt.name, tt.content)
+		defer os.RemoveAll(filepath.Dir(filename))
+		ds, err := Load(filename)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		r, c := ds.X.Dims()
+		if r != tt.rows || c != tt.cols || ds.Schema.Width() != tt.cols || !same(values(ds.X), tt.x) {
+			t.Errorf("%s: loaded %dx%d %v, want %dx%d %v", tt.name, r, c, values(ds.X), tt.rows, tt.cols, tt.x)
+		}
+		if ds.Schema.Named != tt.named || ds.Missing != tt.missing {
+			t.Errorf("%s: schema %+v with %v missing, want named %v and %v missing", tt.name, ds.Schema, ds.Missing, tt.named, tt.missing)
+		}
+	}
+}
+
+func TestLoadLibSVM(t *testing.T) {
+	tests := []struct {
+		name, content string
+		width         int
+		rows, cols    int
+		x             []float64
+		y             []float64
+	}{
+		{"unlabeled.svm", "1:1 3:2\n2:5\n", 0, 2, 3, []float64{1, 0, 2, 0, 5, 0}, nil},
+		{"labeled.svm", "1 1:1\n-1 2:2\n", 0, 2, 2, []float64{1, 0, 0, 2}, []float64{1, -1}},
+		{"blank.svm", "\n1:1\n\n2:1\n \n", 0, 2, 2, []float64{1, 0, 0, 1}, nil},
+		{"blank labeled.svm", "\n1 1:1\n\n-1 2:1\n", 0, 2, 2, []float64{1, 0, 0, 1}, []float64{1, -1}},
+		{"wide.libsvm", "1:1\n", 4, 1, 4, []float64{1, 0, 0, 0}, nil},
+		{"exact.svm", "1 4:1\n", 4, 1, 4, []float64{0, 0, 0, 1}, []float64{1}},
+	}
+	for _, tt := range tests {
+		filename := writeFile(t, tt.name, tt.content)
+		defer os.RemoveAll(filepath.Dir(filename))
+		ds, err := LoadWidth(filename, tt.width)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		x := ds.Sparse.ToDense()
+		r, c := x.Dims()
+		if r != tt.rows || c != tt.cols || ds.Schema.Width() != tt.cols || !same(values(x), tt.x) {
+			t.Errorf("%s: loaded %dx%d %v, want %dx%d %v", tt.name, r, c, values(x), tt.rows, tt.cols, tt.x)
+		}
+		if (ds.Y == nil) != (tt.y == nil) || (ds.Y != nil && !same(values(ds.Y), tt.y)) {
+			t.Errorf("%s: labels %v, want %v", tt.name, ds.Y, tt.y)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, content string
+		width         int
+		line, column  int
+	}{
+		{"short.csv", "1,2\n3\n", 0, 2, 0},
+		{"long.tsv", "a\tb\n1\t2\t3\n", 0, 2, 0},
+		{"word.csv", "1,2\n3,x\n", 0, 2, 2},
+		{"empty.csv", "\n\n", 0, 2, 0},
+		{"header only.csv", "a,b\n", 0, 1, 0},
+		{"pair.svm", "1:1 2\n", 0, 1, 2},
+		{"index.svm", "0:1\n", 0, 1, 1},
+		{"value.svm", "1:one\n", 0, 1, 1},
+		{"label.svm", "1:1\n1 1:1\n", 0, 2, 1},
+		{"no label.svm", "1 1:1\n1:1\n", 0, 2, 1},
+		{"bad label.svm", "yes 1:1\n", 0, 1, 1},
+		{"beyond.svm", "1:1 5:1\n", 4, 1, 2},
+	}
+	for _, tt := range tests {
+		filename := writeFile(t, tt.name, tt.content)
+		defer os.RemoveAll(filepath.Dir(filename))
+		_, err := LoadWidth(filename, tt.width)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: error %v, want a ParseError", tt.name, err)
+			continue
+		}
+		if pe.File != filename || pe.Line != tt.line || pe.Column != tt.column {
+			t.Errorf("%s: error at %d:%d, want %d:%d (%v)", tt.name, pe.Line, pe.Column, tt.line, tt.column, pe)
+		}
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	tests := []struct {
+		name string
+		want Format
+	}{
+		{"x.csv", CSV},
+		{"x.txt", CSV},
+		{"x", CSV},
+		{"x.TSV", TSV},
+		{"dir.svm/x.csv", CSV},
+		{"x.svm", LibSVM},
+		{"x.libsvm", LibSVM},
+	}
+	for _, tt := range tests {
+		if got := FormatOf(tt.name); got != tt.want {
+			t.Errorf("FormatOf(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadLabels(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name, content string
+		labels        bclass.LabelMap
+		header        bool
+		y             []float64
+		learned       bclass.LabelMap
+		ok            bool
+	}{
+		{"legacy", "-1\n1\n1\n", bclass.LabelMap{}, false, []float64{-1, 1, 1}, bclass.DefaultLabels, true},
+		{"lone", "1\n1\n", bclass.LabelMap{}, false, []float64{1, 1}, bclass.DefaultLabels, true},
+		{"numbers", "10\n2\n1e1\n", bclass.LabelMap{}, false, []float64{1, -1, 1}, bclass.LabelMap{Neg: "2", Pos: "10"}, true},
+		{"words", "yes\nno\nno\n", bclass.LabelMap{}, false, []float64{1, -1, -1}, bclass.LabelMap{Neg: "no", Pos: "yes"}, true},
+		// without the flag a word on the first line is a label
+		{"word first", "spam\nham\n", bclass.LabelMap{}, false, []float64{1, -1}, bclass.LabelMap{Neg: "ham", Pos: "spam"}, true},
+		{"header", "label\nyes\nno\nno\n", bclass.LabelMap{}, true, []float64{1, -1, -1}, bclass.LabelMap{Neg: "no", Pos: "yes"}, true},
+		{"blank header", "\nlabel\n\n1\n-1\n", bclass.LabelMap{}, true, []float64{1, -1}, bclass.DefaultLabels, true},
+		{"missing", "1\nNA\n-1\n", bclass.LabelMap{}, false, []float64{1, nan, -1}, bclass.DefaultLabels, true},
+		{"given", "b\nb\n", bclass.LabelMap{Neg: "a", Pos: "b"}, false, []float64{1, 1}, bclass.LabelMap{Neg: "a", Pos: "b"}, true},
+		{"not given", "b\nb\n", bclass.LabelMap{}, false, nil, bclass.LabelMap{}, false},
+		{"unknown", "a\nc\n", bclass.LabelMap{Neg: "a", Pos: "b"}, false, nil, bclass.LabelMap{}, false},
+		{"three", "a\nb\nc\n", bclass.LabelMap{}, false, nil, bclass.LabelMap{}, false},
+		{"columns", "1,2\n", bclass.LabelMap{}, false, nil, bclass.LabelMap{}, false},
+		{"empty", "\n", bclass.LabelMap{}, false, nil, bclass.LabelMap{}, false},
+		{"header only", "label\n", bclass.LabelMap{}, true, nil, bclass.LabelMap{}, false},
+	}
+	for _, tt := range tests {
+		filename := writeFile(t, "y.csv", tt.content)
+		defer os.RemoveAll(filepath.Dir(filename))
+		y, labels, err := ReadLabels(filename, tt.labels, tt.header)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: read %v with %v, want an error", tt.name, values(y), labels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !same(values(y), tt.y) || labels != tt.learned {
+			t.Errorf("%s: read %v with %v, want %v with %v", tt.name, values(y), labels, tt.y, tt.learned)
+		}
+	}
+}
+
+func TestEncodeLabels(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name    string
+		raw     []float64
+		labels  bclass.LabelMap
+		y       []float64
+		learned bclass.LabelMap
+		ok      bool
+	}{
+		{"legacy", []float64{1, -1, 1}, bclass.LabelMap{}, []float64{1, -1, 1}, bclass.DefaultLabels, true},
+		{"binary", []float64{0, 1, 1}, bclass.LabelMap{}, []float64{-1, 1, 1}, bclass.LabelMap{Neg: "0", Pos: "1"}, true},
+		{"missing", []float64{nan, 2, 1}, bclass.LabelMap{}, []float64{nan, 1, -1}, bclass.LabelMap{Neg: "1", Pos: "2"}, true},
+		{"given", []float64{1, 1}, bclass.LabelMap{Neg: "0", Pos: "1"}, []float64{1, 1}, bclass.LabelMap{Neg: "0", Pos: "1"}, true},
+		{"unknown", []float64{0, 2}, bclass.LabelMap{Neg: "0", Pos: "1"}, nil, bclass.LabelMap{}, false},
+		{"three", []float64{0, 1, 2}, bclass.LabelMap{}, nil, bclass.LabelMap{}, false},
+	}
+	for _, tt := range tests {
+		y, labels, err := EncodeLabels("x.svm", mat64.NewDense(len(tt.raw), 1, tt.raw), tt.labels)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: encoded %v with %v, want an error", tt.name, values(y), labels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !same(values(y), tt.y) || labels != tt.learned {
+			t.Errorf("%s: encoded %v with %v, want %v with %v", tt.name, values(y), labels, tt.y, tt.learned)
+		}
+	}
+}
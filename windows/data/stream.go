@@ -0,0 +1,340 @@
+package data
+
+import (
+	"../bclass"
+	"bufio"
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reader streams the rows of a dense CSV or TSV file. The header, when
+// present, is consumed by OpenReader; blank lines are skipped.
+type Reader struct {
+	filename string
+	f        *os.File
+	scanner  *bufio.Scanner
+	sep      string
+	schema   Schema
+	line     int
+	first    []string
+	Missing  int
+}
+
+func OpenReader(filename string) (*Reader, error) {
+	sep := ","
+	switch FormatOf(filename) {
+	case TSV:
+		sep = "\t"
+	case LibSVM:
+		return nil, fmt.Errorf("%s: LibSVM files can't be streamed", filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	rd := &Reader{filename: filename, f: f, sep: sep}
+	rd.scanner = bufio.NewScanner(f)
+	rd.scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	fields, err := rd.fields()
+	if err == io.EOF {
+		f.Close()
+		return nil, &ParseError{filename, rd.line, 0, "no data rows"}
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rd.schema.Columns = make([]Column, len(fields))
+	if isHeader(fields) {
+		for j, name := range fields {
+			rd.schema.Columns[j] = Column{strings.TrimSpace(name), Numeric}
+		}
+		rd.schema.Named = true
+	} else {
+		for j := range fields {
+			rd.schema.Columns[j] = Column{fmt.Sprintf("x%d", j+1), Numeric}
+		}
+		rd.first = fields
+	}
+	return rd, nil
+}
+
+func (rd *Reader) Schema() Schema {
+	return rd.schema
+}
+
+func (rd *Reader) Close() error {
+	return rd.f.Close()
+}
+
+// fields returns the fields of the next non-blank line.
+func (rd *Reader) fields() ([]string, error) {
+	for rd.scanner.Scan() {
+		rd.line++
+		text := strings.TrimRight(rd.scanner.Text(), "\r")
+		if strings.TrimSpace(text) != "" {
+			return strings.Split(text, rd.sep), nil
+		}
+	}
+	if err := rd.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Next parses the next row into row, which must hold Schema().Width()
+// values. It returns io.EOF after the last row.
+func (rd *Reader) Next(row []float64) error {
+	fields := rd.first
+	rd.first = nil
+	if fields == nil {
+		var err error
+		if fields, err = rd.fields(); err != nil {
+			return err
+		}
+	}
+	if len(fields) != rd.schema.Width() {
+		return &ParseError{rd.filename, rd.line, 0, fmt.Sprintf("expected %d fields, got %d", rd.schema.Width(), len(fields))}
+	}
+	for j, field := range fields {
+		if IsMissing(field) {
+			row[j] = math.NaN()
+			rd.Missing++
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return &ParseError{rd.filename, rd.line, j + 1, fmt.Sprintf("cannot parse %q as a number", field)}
+		}
+		row[j] = v
+	}
+	return nil
+}
+
+// ReadBlock fills the rows of block and returns how many were read. At the
+// end of the file it returns the rows read so far and io.EOF.
+func (rd *Reader) ReadBlock(block *mat64.Dense) (int, error) {
+	r, _ := block.Dims()
+	for i := 0; i < r; i++ {
+		if err := rd.Next(block.RawRowView(i)); err != nil {
+			return i, err
+		}
+	}
+	return r, nil
+}
+
+// CountRows counts the non-blank lines of a file, so storage can be
+// allocated before parsing.
+func CountRows(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	buf := make([]byte, 1024*1024)
+	blank := true
+	for {
+		k, err := f.Read(buf)
+		for _, b := range buf[:k] {
+			switch b {
+			case '\n':
+				if !blank {
+					n++
+				}
+				blank = true
+			case ' ', '\t', '\r':
+			default:
+				blank = false
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if !blank {
+		n++
+	}
+	return n, nil
+}
+
+// loadDelimited counts the rows of a CSV or TSV file, allocates the matrix
+// once and parses the rows straight into it.
+func loadDelimited(filename string) (*Dataset, error) {
+	n, err := CountRows(filename)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	if rd.first == nil {
+		n--
+	}
+	if n < 1 {
+		return nil, &ParseError{filename, rd.line, 0, "no data rows"}
+	}
+
+	x := mat64.NewDense(n, rd.Schema().Width(), nil)
+	k, err := rd.ReadBlock(x)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if k != n {
+		return nil, fmt.Errorf("%s: file changed while reading", filename)
+	}
+	return &Dataset{Schema: rd.Schema(), X: x, Missing: rd.Missing}, nil
+}
+
+// FitStream trains the same model as bclass.RegLSImputed on a feature file
+// that is never loaded whole: rows are parsed into a block of
+// bclass.BasisBlockRows rows and accumulated into the normal equations.
+// Mean imputation takes a first pass over the file for the column means
+// unless global statistics are given; the median and indicator strategies
+// need the whole data and are not supported.
+func FitStream(filename string, y *mat64.Dense, lambda float64, deg int, strategy bclass.ImputeStrategy, global *bclass.ColumnStats) (bclass.Model, error) {
+	im := bclass.Imputer{Strategy: strategy}
+	switch strategy {
+	case bclass.ImputeMedian, bclass.ImputeIndicator:
+		return bclass.Model{}, fmt.Errorf("%v imputation is not supported on streamed data", strategy)
+	case bclass.ImputeMean, bclass.ImputeDrop:
+		if global != nil {
+			im.Fill, im.Global = global.Mean(), true
+			break
+		}
+		stats, err := streamStats(filename)
+		if err != nil {
+			return bclass.Model{}, err
+		}
+		im.Fill = stats.Mean()
+	}
+
+	rd, err := OpenReader(filename)
+	if err != nil {
+		return bclass.Model{}, err
+	}
+	defer rd.Close()
+	c := rd.Schema().Width()
+	ne := bclass.NewNormalEq(c, deg)
+	block := mat64.NewDense(bclass.BasisBlockRows, c, nil)
+	yr, _ := y.Dims()
+	row := 0
+	for {
+		k, err := rd.ReadBlock(block)
+		if err != nil && err != io.EOF {
+			return bclass.Model{}, err
+		}
+		if rd.Missing > 0 && strategy == bclass.ImputeNone {
+			return bclass.Model{}, fmt.Errorf("%s has missing values, choose an imputation strategy", filename)
+		}
+		if row+k > yr {
+			return bclass.Model{}, fmt.Errorf("%s has more rows than the %d labels", filename, yr)
+		}
+		if k > 0 {
+			xb := head(block, k)
+			yb := mat64.NewDense(k, 1, nil)
+			for i := 0; i < k; i++ {
+				yb.Set(i, 0, y.At(row+i, 0))
+			}
+			if strategy != bclass.ImputeDrop {
+				xb = im.Transform(xb)
+			}
+			xb, yb = bclass.DropMissing(xb, yb)
+			if r, _ := xb.Dims(); r > 0 {
+				ne.Add(xb, yb)
+			}
+			row += k
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if row != yr {
+		return bclass.Model{}, fmt.Errorf("%s has %d rows but there are %d labels", filename, row, yr)
+	}
+	model := ne.Model(lambda)
+	model.Impute = im
+	return model, nil
+}
+
+// PredictFile streams a feature file through predict in blocks of rows and
+// returns the predictions for all rows.
+func PredictFile(filename string, predict func(*mat64.Dense) *mat64.Dense, rows int) (*mat64.Dense, error) {
+	rd, err := OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	c := rd.Schema().Width()
+	block := mat64.NewDense(rows, c, nil)
+	var out []float64
+	for {
+		k, err := rd.ReadBlock(block)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if k > 0 {
+			yh := predict(head(block, k))
+			for i := 0; i < k; i++ {
+				out = append(out, yh.At(i, 0))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil, &ParseError{filename, rd.line, 0, "no data rows"}
+	}
+	return mat64.NewDense(len(out), 1, out), nil
+}
+
+// head returns the first k rows of block, block itself when k is all of it.
+func head(block *mat64.Dense, k int) *mat64.Dense {
+	r, c := block.Dims()
+	if k == r {
+		return block
+	}
+	h := mat64.NewDense(k, c, nil)
+	for i := 0; i < k; i++ {
+		copy(h.RawRowView(i), block.RawRowView(i))
+	}
+	return h
+}
+
+// streamStats gathers the column counts and sums of a feature file in one
+// pass. Medians need all values and are left at zero.
+func streamStats(filename string) (bclass.ColumnStats, error) {
+	rd, err := OpenReader(filename)
+	if err != nil {
+		return bclass.ColumnStats{}, err
+	}
+	defer rd.Close()
+	c := rd.Schema().Width()
+	s := bclass.ColumnStats{N: make([]int, c), Sum: make([]float64, c), Median: make([]float64, c)}
+	row := make([]float64, c)
+	for {
+		if err := rd.Next(row); err == io.EOF {
+			break
+		} else if err != nil {
+			return s, err
+		}
+		for j, v := range row {
+			if !math.IsNaN(v) {
+				s.N[j]++
+				s.Sum[j] += v
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,27 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCountRows(t *testing.T) {
+	tests := []struct {
+		content string
+		want    int
+	}{
+		{"", 0},
+		{"\n\n", 0},
+		{"a", 1},
+		{"a\nb\n", 2},
+		{"a\n \t\r\nb", 2},
+	}
+	for _, tt := range tests {
+		filename := writeFile(t, "rows.csv", tt.content)
+		defer os.RemoveAll(filepath.Dir(filename))
+		if got, err := CountRows(filename); err != nil || got != tt.want {
+			t.Errorf("CountRows(%q) = %v, %v, want %v", tt.content, got, err, tt.want)
+		}
+	}
+}
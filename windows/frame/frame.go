@@ -0,0 +1,126 @@
+// Package frame carries the messages exchanged between clients, servers and
+// Raft peers. Every message is sent as a frame: a 4 byte big-endian length
+// followed by that many bytes of payload, so a message arrives whole however
+// TCP splits it, and a message larger than MaxSize is refused instead of being
+// cut short.
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	// MaxSize is the largest payload Read accepts and Write sends.
+	MaxSize = 256 << 20
+	// Timeout bounds every Read and Write, zero disables the deadlines.
+	Timeout = 30 * time.Second
+)
+
+// readChunk is how much of a frame's payload Read allocates before any of it
+// arrived.
+const readChunk = 64 << 10
+
+// TooLargeError is returned for a frame longer than MaxSize.
+type TooLargeError struct {
+	Size int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("frame of %d bytes exceeds the %d byte limit", e.Size, MaxSize)
+}
+
+// Write sends p as one frame.
+func Write(conn net.Conn, p []byte) error {
+	if len(p) > MaxSize {
+		return &TooLargeError{len(p)}
+	}
+	if Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(Timeout))
+	}
+	buf := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	copy(buf[4:], p)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func WriteString(conn net.Conn, s string) error {
+	return Write(conn, []byte(s))
+}
+
+// Read receives one frame and returns its payload.
+func Read(conn net.Conn) ([]byte, error) {
+	if Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(Timeout))
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if uint64(n) > uint64(MaxSize) {
+		return nil, &TooLargeError{int(n)}
+	}
+	// the buffer grows with what arrives, a peer that only claims a large
+	// frame doesn't get it allocated
+	var buf bytes.Buffer
+	if n < readChunk {
+		buf.Grow(int(n))
+	} else {
+		buf.Grow(readChunk)
+	}
+	m, err := buf.ReadFrom(io.LimitReader(conn, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if m < int64(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+func ReadString(conn net.Conn) (string, error) {
+	p, err := Read(conn)
+	return string(p), err
+}
+
+// Encoder and Decoder gob encode one value per frame. They stand in for
+// gob.NewEncoder(conn) and gob.NewDecoder(conn), whose streams have no size
+// limit or deadline.
+type Encoder struct {
+	conn net.Conn
+}
+
+func NewEncoder(conn net.Conn) *Encoder {
+	return &Encoder{conn}
+}
+
+func (e *Encoder) Encode(v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return Write(e.conn, buf.Bytes())
+}
+
+type Decoder struct {
+	conn net.Conn
+}
+
+func NewDecoder(conn net.Conn) *Decoder {
+	return &Decoder{conn}
+}
+
+func (d *Decoder) Decode(v interface{}) error {
+	p, err := Read(d.conn)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(p)).Decode(v)
+}
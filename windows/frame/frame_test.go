@@ -0,0 +1,167 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// send writes raw bytes to one end of a pipe in the given chunks and closes
+// it, the way TCP may split a frame.
+func send(conn net.Conn, chunks ...[]byte) {
+	for _, c := range chunks {
+		conn.Write(c)
+	}
+	conn.Close()
+}
+
+func header(n uint32) []byte {
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint32(h, n)
+	return h
+}
+
+func TestRead(t *testing.T) {
+	defer func(m int) { MaxSize = m }(MaxSize)
+	MaxSize = 16
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   []byte
+		err    interface{}
+	}{
+		{"empty", [][]byte{header(0)}, []byte{}, nil},
+		{"whole", [][]byte{append(header(3), "abc"...)}, []byte("abc"), nil},
+		{"split", [][]byte{header(5)[:2], header(5)[2:], []byte("ab"), []byte("cde")}, []byte("abcde"), nil},
+		{"limit", [][]byte{append(header(16), bytes.Repeat([]byte("x"), 16)...)}, bytes.Repeat([]byte("x"), 16), nil},
+		{"too large", [][]byte{header(17)}, nil, &TooLargeError{}},
+		{"huge", [][]byte{header(0xffffffff)}, nil, &TooLargeError{}},
+		{"short payload", [][]byte{append(header(4), "ab"...)}, nil, io.ErrUnexpectedEOF},
+		{"short header", [][]byte{header(4)[:3]}, nil, io.ErrUnexpectedEOF},
+		{"closed", nil, nil, io.EOF},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		go send(a, tt.chunks...)
+		got, err := Read(b)
+		b.Close()
+		switch want := tt.err.(type) {
+		case nil:
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("%s: Read = %q, %v, want %q", tt.name, got, err, tt.want)
+			}
+		case *TooLargeError:
+			if _, ok := err.(*TooLargeError); !ok {
+				t.Errorf("%s: Read error = %v, want a TooLargeError", tt.name, err)
+			}
+		case error:
+			if err != want {
+				t.Errorf("%s: Read error = %v, want %v", tt.name, err, want)
+			}
+		}
+	}
+}
+
+// A frame that claims the largest size but never arrives costs what was
+// sent, not MaxSize
+func TestReadGrows(t *testing.T) {
+	a, b := net.Pipe()
+	go send(a, append(header(uint32(MaxSize)), "ab"...))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Read(b)
+	runtime.ReadMemStats(&after)
+	b.Close()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Read error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("Read allocated %d bytes for a 2 byte payload", n)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	defer func(m int) { MaxSize = m }(MaxSize)
+	MaxSize = 16
+	tests := []struct {
+		name string
+		p    []byte
+		ok   bool
+	}{
+		{"empty", []byte{}, true},
+		{"small", []byte("hello"), true},
+		{"limit", bytes.Repeat([]byte("x"), 16), true},
+		{"too large", bytes.Repeat([]byte("x"), 17), false},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		done := make(chan []byte)
+		go func() {
+			p, _ := Read(b)
+			done <- p
+		}()
+		err := Write(a, tt.p)
+		a.Close()
+		got := <-done
+		b.Close()
+		if !tt.ok {
+			if _, ok := err.(*TooLargeError); !ok {
+				t.Errorf("%s: Write error = %v, want a TooLargeError", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.p) {
+			t.Errorf("%s: read back %q, %v, want %q", tt.name, got, err, tt.p)
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	defer func(d time.Duration) { Timeout = d }(Timeout)
+	Timeout = 20 * time.Millisecond
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	_, err := Read(b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read from a silent peer = %v, want a timeout", err)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	type msg struct {
+		Id   int
+		Name string
+		W    []float64
+	}
+	tests := []msg{
+		{},
+		{1, "node1", nil},
+		{2, "node2", []float64{0.5, -1, 3}},
+	}
+	a, b := net.Pipe()
+	go func() {
+		enc := NewEncoder(a)
+		for _, m := range tests {
+			enc.Encode(m)
+		}
+		a.Close()
+	}()
+	dec := NewDecoder(b)
+	for _, want := range tests {
+		var got msg
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if got.Id != want.Id || got.Name != want.Name || len(got.W) != len(want.W) {
+			t.Errorf("Decode = %+v, want %+v", got, want)
+		}
+	}
+	if err := dec.Decode(new(msg)); err != io.EOF {
+		t.Errorf("Decode after the last frame = %v, want EOF", err)
+	}
+}
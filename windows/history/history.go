@@ -0,0 +1,149 @@
+// Package history keeps every commit merged into the global model as a
+// version, and every version of the global model with the model versions it
+// is made of, so a bad model can be found and rolled back.
+// Model versions are numbered from 1 in the order they were merged, global
+// model versions carry the server's global model version.
+package history
+
+import (
+	"../bclass"
+	"../policy"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is a model of node Node, committed with commit number Cnum, as it
+// was first merged into the global model at At. C is the test size the global
+// model weighs it with and Progress how far its validation got, both kept up
+// to date as more test results come in. Hash is the SHA-256 of the model's
+// JSON form.
+type Version struct {
+	Seq      int
+	Node     int
+	Cnum     int
+	At       time.Time
+	C        int
+	Progress policy.Progress
+	Hash     string
+	Model    bclass.Model
+}
+
+// Global is a version of the global model, Nodes maps each node to the
+// version of its model the global model holds, Reason tells how it came to
+// be.
+type Global struct {
+	Version int
+	At      time.Time
+	Nodes   map[int]int
+	Reason  string
+}
+
+// Delta is how the validation of one version differs from another's.
+type Delta struct {
+	Coverage  float64
+	Accuracy  float64
+	Nodes     int
+	Tested    int
+	SameModel bool
+}
+
+// History is every model version and global model version, oldest first.
+type History struct {
+	Models  []Version
+	Globals []Global
+}
+
+// Hash returns the hex SHA-256 of the JSON form of m.
+func Hash(m bclass.Model) string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Merge records v merged into the global model and returns it numbered and
+// hashed, with whether it made global model version g. A commit the global
+// model already holds, merged again as more test results came in, keeps its
+// version with C and Progress brought up to date and makes no new global
+// model version.
+func (h *History) Merge(v Version, g int) (Version, bool) {
+	nodes := h.current()
+	if seq, ok := nodes[v.Node]; ok && h.Models[seq-1].Cnum == v.Cnum {
+		cur := &h.Models[seq-1]
+		cur.C, cur.Progress = v.C, v.Progress
+		return *cur, false
+	}
+	v.Hash = Hash(v.Model)
+	v.Seq = len(h.Models) + 1
+	h.Models = append(h.Models, v)
+	nodes[v.Node] = v.Seq
+	h.Globals = append(h.Globals, Global{g, v.At, nodes, fmt.Sprintf("merged model version %v of node%v", v.Seq, v.Node)})
+	return v, true
+}
+
+// RollbackModel records global model version g, the current one with the
+// model of v.Node rolled back to v.
+func (h *History) RollbackModel(v Version, g int, at time.Time) Global {
+	nodes := h.current()
+	nodes[v.Node] = v.Seq
+	r := Global{g, at, nodes, fmt.Sprintf("rolled back node%v to model version %v", v.Node, v.Seq)}
+	h.Globals = append(h.Globals, r)
+	return r
+}
+
+// RollbackGlobal records global model version g, made of the same model
+// versions as to.
+func (h *History) RollbackGlobal(to Global, g int, at time.Time) Global {
+	nodes := make(map[int]int, len(to.Nodes))
+	for id, seq := range to.Nodes {
+		nodes[id] = seq
+	}
+	r := Global{g, at, nodes, fmt.Sprintf("rolled back to global model version %v", to.Version)}
+	h.Globals = append(h.Globals, r)
+	return r
+}
+
+// Model returns model version seq.
+func (h *History) Model(seq int) (Version, bool) {
+	if seq < 1 || seq > len(h.Models) {
+		return Version{}, false
+	}
+	return h.Models[seq-1], true
+}
+
+// Global returns global model version g.
+func (h *History) Global(g int) (Global, bool) {
+	for i := len(h.Globals) - 1; i >= 0; i-- {
+		if h.Globals[i].Version == g {
+			return h.Globals[i], true
+		}
+	}
+	return Global{}, false
+}
+
+// current returns a copy of the model versions of the latest global model.
+func (h *History) current() map[int]int {
+	nodes := make(map[int]int)
+	if len(h.Globals) > 0 {
+		for id, seq := range h.Globals[len(h.Globals)-1].Nodes {
+			nodes[id] = seq
+		}
+	}
+	return nodes
+}
+
+// Diff compares the validation of versions a and b, as b's minus a's.
+func Diff(a, b Version) Delta {
+	return Delta{
+		b.Progress.Coverage() - a.Progress.Coverage(),
+		b.Progress.Accuracy() - a.Progress.Accuracy(),
+		b.Progress.Nodes - a.Progress.Nodes,
+		b.Progress.Tested - a.Progress.Tested,
+		a.Hash == b.Hash,
+	}
+}
@@ -0,0 +1,130 @@
+package history
+
+import (
+	"../bclass"
+	"../policy"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	at := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		node, cnum, deg, c int
+		seq                int
+		made               bool
+		nodes              map[int]int
+		reason             string
+	}{
+		{1, 1, 1, 10, 1, true, map[int]int{1: 1}, "merged model version 1 of node1"},
+		{2, 1, 2, 20, 2, true, map[int]int{1: 1, 2: 2}, "merged model version 2 of node2"},
+		// more test results for the same commit update its version
+		{1, 1, 1, 30, 1, false, map[int]int{1: 1, 2: 2}, "merged model version 2 of node2"},
+		{1, 2, 3, 40, 3, true, map[int]int{1: 3, 2: 2}, "merged model version 3 of node1"},
+		{2, 2, 2, 50, 4, true, map[int]int{1: 3, 2: 4}, "merged model version 4 of node2"},
+	}
+	var h History
+	g := 0
+	for i, tt := range tests {
+		p := policy.Progress{Covered: tt.c, Total: 100}
+		v, made := h.Merge(Version{Node: tt.node, Cnum: tt.cnum, C: tt.c, Progress: p, At: at, Model: bclass.Model{Deg: tt.deg}}, g+1)
+		if made {
+			g++
+		}
+		if v.Seq != tt.seq || made != tt.made || v.Hash == "" {
+			t.Errorf("merge %d: version %v made %v with hash %q, want version %v made %v", i, v.Seq, made, v.Hash, tt.seq, tt.made)
+		}
+		if v.C != tt.c || v.Progress != p {
+			t.Errorf("merge %d: version weighs %v with %v, want %v with %v", i, v.C, v.Progress, tt.c, p)
+		}
+		last := h.Globals[len(h.Globals)-1]
+		if last.Version != g || !reflect.DeepEqual(last.Nodes, tt.nodes) || last.Reason != tt.reason {
+			t.Errorf("merge %d: global %+v, want version %v of %v, %q", i, last, g, tt.nodes, tt.reason)
+		}
+	}
+	// one version per commit
+	if len(h.Models) != 4 || len(h.Globals) != 4 {
+		t.Errorf("%v model and %v global versions of 4 commits", len(h.Models), len(h.Globals))
+	}
+	if v, _ := h.Model(1); v.C != 30 || v.Cnum != 1 || v.Node != 1 {
+		t.Errorf("version 1 is %+v, want node1 commit 1 weighing 30", v)
+	}
+	if v1, v3 := h.Models[0], h.Models[2]; v1.Hash == v3.Hash {
+		t.Errorf("different models share the hash %v", v1.Hash)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	at := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	var h History
+	for g, n := range []int{1, 2, 1} {
+		h.Merge(Version{Node: n, Cnum: g + 1, At: at, Model: bclass.Model{Deg: g + 1}}, g+1)
+	}
+	m, _ := h.Model(1)
+	r := h.RollbackModel(m, 4, at)
+	if want := map[int]int{1: 1, 2: 2}; !reflect.DeepEqual(r.Nodes, want) || r.Reason != "rolled back node1 to model version 1" {
+		t.Errorf("RollbackModel = %+v, want %v", r, want)
+	}
+	g2, _ := h.Global(2)
+	r = h.RollbackGlobal(g2, 5, at)
+	if want := map[int]int{1: 1, 2: 2}; !reflect.DeepEqual(r.Nodes, want) || r.Reason != "rolled back to global model version 2" {
+		t.Errorf("RollbackGlobal = %+v, want %v", r, want)
+	}
+	// the copy does not share its map with the version it rolls back to
+	r.Nodes[3] = 9
+	if g2, _ := h.Global(2); len(g2.Nodes) != 2 {
+		t.Errorf("rolling back changed global model version 2 to %v", g2.Nodes)
+	}
+	h.Merge(Version{Node: 2, Cnum: 4, At: at, Model: bclass.Model{Deg: 4}}, 6)
+	if g, _ := h.Global(6); !reflect.DeepEqual(g.Nodes, map[int]int{1: 1, 2: 4, 3: 9}) {
+		t.Errorf("merge after a rollback holds %v", g.Nodes)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var h History
+	h.Merge(Version{Node: 1, Cnum: 1}, 7)
+	h.RollbackGlobal(Global{Version: 3}, 7, time.Time{})
+	tests := []struct {
+		seq, g       int
+		model, found bool
+	}{
+		{0, 0, false, false},
+		{1, 7, true, true},
+		{2, 8, false, false},
+		{-1, -1, false, false},
+	}
+	for _, tt := range tests {
+		if _, ok := h.Model(tt.seq); ok != tt.model {
+			t.Errorf("Model(%v) found %v", tt.seq, ok)
+		}
+		if _, ok := h.Global(tt.g); ok != tt.found {
+			t.Errorf("Global(%v) found %v", tt.g, ok)
+		}
+	}
+	// a global model version recorded twice is its latest record
+	if g, _ := h.Global(7); g.Reason != "rolled back to global model version 3" {
+		t.Errorf("Global(7) = %+v, want the rollback", g)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := Version{Hash: "a", Progress: policy.Progress{Covered: 1, Total: 4, Nodes: 1, Correct: 1, Tested: 2}}
+	b := Version{Hash: "a", Progress: policy.Progress{Covered: 3, Total: 4, Nodes: 3, Correct: 3, Tested: 4}}
+	c := Version{Hash: "c"}
+	tests := []struct {
+		a, b Version
+		want Delta
+	}{
+		{a, a, Delta{0, 0, 0, 0, true}},
+		{a, b, Delta{0.5, 0.25, 2, 2, true}},
+		{b, a, Delta{-0.5, -0.25, -2, -2, true}},
+		{a, c, Delta{-0.25, -0.5, -1, -2, false}},
+	}
+	for _, tt := range tests {
+		if got := Diff(tt.a, tt.b); got != tt.want {
+			t.Errorf("Diff(%v, %v) = %+v, want %+v", tt.a.Hash, tt.b.Hash, got, tt.want)
+		}
+	}
+}
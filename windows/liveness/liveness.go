@@ -0,0 +1,109 @@
+// Package liveness tracks whether nodes are still alive. Nodes send a
+// heartbeat every Interval, and every other message from them counts as one
+// too. A node that stays silent for SuspectAfter is suspect, after DeadAfter
+// it is dead: servers stop sending it test requests and leave it out of the
+// commit quorum until it rejoins.
+package liveness
+
+import (
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Active State = iota
+	Suspect
+	Dead
+)
+
+var stateNames = []string{"active", "suspect", "dead"}
+
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "unknown"
+}
+
+var (
+	Interval     = 5 * time.Second
+	SuspectAfter = 3 * Interval
+	DeadAfter    = 12 * Interval
+)
+
+// Tracker holds when each node was last heard from and its state. Nodes it
+// has never heard from are active.
+type Tracker struct {
+	mu    sync.Mutex
+	seen  map[int]time.Time
+	state map[int]State
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{seen: make(map[int]time.Time), state: make(map[int]State)}
+}
+
+// Beat records that node id was heard from now, making it active again, and
+// returns the state it had before.
+func (t *Tracker) Beat(id int) State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.state[id]
+	t.seen[id] = time.Now()
+	t.state[id] = Active
+	return old
+}
+
+// Set puts node id in state s, for changes decided elsewhere, like a node
+// that could not be reached or a state replicated from another server.
+func (t *Tracker) Set(id int, s State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.seen[id]; !ok {
+		t.seen[id] = time.Now()
+	}
+	t.state[id] = s
+}
+
+func (t *Tracker) State(id int) State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state[id]
+}
+
+// Alive reports whether node id is not dead.
+func (t *Tracker) Alive(id int) bool {
+	return t.State(id) != Dead
+}
+
+// Due returns the nodes whose silence puts them in a new state, with that
+// state, without changing anything.
+func (t *Tracker) Due() map[int]State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	due := make(map[int]State)
+	for id, seen := range t.seen {
+		s := Active
+		switch quiet := time.Since(seen); {
+		case quiet > DeadAfter:
+			s = Dead
+		case quiet > SuspectAfter:
+			s = Suspect
+		}
+		if s > t.state[id] {
+			due[id] = s
+		}
+	}
+	return due
+}
+
+// Sweep moves the nodes returned by Due into their new state and returns them.
+func (t *Tracker) Sweep() map[int]State {
+	due := t.Due()
+	for id, s := range due {
+		t.Set(id, s)
+	}
+	return due
+}
@@ -0,0 +1,111 @@
+package liveness
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateString(t *testing.T) {
+	tests := []struct {
+		s    State
+		want string
+	}{
+		{Active, "active"},
+		{Suspect, "suspect"},
+		{Dead, "dead"},
+		{State(-1), "unknown"},
+		{State(3), "unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("State(%d).String() = %q, want %q", int(tt.s), got, tt.want)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	defer func(s, d time.Duration) { SuspectAfter, DeadAfter = s, d }(SuspectAfter, DeadAfter)
+	SuspectAfter, DeadAfter = 40*time.Millisecond, 120*time.Millisecond
+	tests := []struct {
+		name  string
+		sleep time.Duration
+		beat  bool
+		set   State
+		want  State
+		swept bool
+	}{
+		{"fresh", 0, true, -1, Active, false},
+		{"quiet", 70 * time.Millisecond, false, -1, Suspect, true},
+		{"still quiet", 0, false, -1, Suspect, false},
+		{"silent", 80 * time.Millisecond, false, -1, Dead, true},
+		{"rejoined", 0, true, -1, Active, false},
+		{"unreachable", 0, false, Dead, Dead, false},
+		{"back", 0, true, -1, Active, false},
+	}
+	tr := NewTracker()
+	for _, tt := range tests {
+		time.Sleep(tt.sleep)
+		if tt.beat {
+			tr.Beat(1)
+		}
+		if tt.set >= 0 {
+			tr.Set(1, tt.set)
+		}
+		due := tr.Due()
+		swept := tr.Sweep()
+		if s, ok := swept[1]; ok != tt.swept || (ok && (s != tt.want || due[1] != s)) {
+			t.Errorf("%s: Due %v, Sweep %v", tt.name, due, swept)
+		}
+		if got := tr.State(1); got != tt.want || tr.Alive(1) != (tt.want != Dead) {
+			t.Errorf("%s: node1 is %v, alive %v, want %v", tt.name, got, tr.Alive(1), tt.want)
+		}
+	}
+}
+
+func TestBeat(t *testing.T) {
+	tr := NewTracker()
+	tests := []struct {
+		set  State
+		want State
+	}{
+		{-1, Active},
+		{Suspect, Suspect},
+		{Dead, Dead},
+		{-1, Active},
+	}
+	for i, tt := range tests {
+		if tt.set >= 0 {
+			tr.Set(2, tt.set)
+		}
+		if got := tr.Beat(2); got != tt.want {
+			t.Errorf("%d: Beat returned %v, want %v", i, got, tt.want)
+		}
+	}
+	if got := tr.State(3); got != Active || len(tr.Due()) != 0 {
+		t.Errorf("an unknown node is %v with %v due, want active and none", got, tr.Due())
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	tr := NewTracker()
+	var wg sync.WaitGroup
+	for id := 0; id < 8; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tr.Beat(id)
+				tr.Set(id, Suspect)
+				tr.Alive(id)
+				tr.Sweep()
+			}
+		}(id)
+	}
+	wg.Wait()
+	for id := 0; id < 8; id++ {
+		if got := tr.State(id); got != Suspect {
+			t.Errorf("node%v is %v, want suspect", id, got)
+		}
+	}
+}
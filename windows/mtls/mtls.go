@@ -0,0 +1,160 @@
+// Package mtls optionally runs the node, server and Raft connections over
+// mutual TLS. Until Setup is called with a certificate, Listen and Dial are
+// plain TCP.
+//
+// Both ends of every connection present a certificate signed by the
+// federation CA. Peers are dialed by IP address, so host names are not
+// checked: a peer is identified by the common name (CN) of its certificate,
+// which for nodes has to be the node name and for the server and every Raft
+// replica ServerName. Dial only accepts a peer with the expected name.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerName is the common name of the certificates of the servers.
+const ServerName = "server"
+
+// Conf is the TLS configuration in use, nil for plain TCP.
+var Conf *tls.Config
+
+// roots is the pool of the federation CA.
+var roots *x509.CertPool
+
+// DialTimeout bounds connecting to a peer, TLS handshake included.
+var DialTimeout = 5 * time.Second
+
+// Setup loads the certificate and key of this process and the CA that signs
+// the certificates of its peers. All three files are needed to enable TLS;
+// with none of them it is left disabled.
+func Setup(certFile, keyFile, caFile string) error {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return errors.New("mutual TLS needs a certificate, a key and a CA file")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no CA certificates found", caFile)
+	}
+	roots = pool
+	Conf = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		// the chain is verified against the CA below, without a host name
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verify(cs.PeerCertificates, pool)
+		},
+	}
+	return nil
+}
+
+func verify(chain []*x509.Certificate, pool *x509.CertPool) error {
+	if len(chain) == 0 {
+		return errors.New("peer sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(opts)
+	return err
+}
+
+func Enabled() bool {
+	return Conf != nil
+}
+
+func Listen(addr *net.TCPAddr) (net.Listener, error) {
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil || Conf == nil {
+		return l, err
+	}
+	return tls.NewListener(l, Conf), nil
+}
+
+// Dial connects to addr, whose certificate has to be issued to name.
+func Dial(addr, name string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: DialTimeout}
+	if Conf == nil {
+		return d.Dial("tcp", addr)
+	}
+	c := Conf.Clone()
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := verify(cs.PeerCertificates, roots); err != nil {
+			return err
+		}
+		return checkName(cs.PeerCertificates[0].Subject.CommonName, name)
+	}
+	return tls.DialWithDialer(d, "tcp", addr, c)
+}
+
+// PeerName returns the common name of the peer's certificate. ok is false
+// for a plain TCP connection.
+func PeerName(conn net.Conn) (name string, ok bool, err error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false, nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", true, err
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", true, errors.New("peer sent no certificate")
+	}
+	return certs[0].Subject.CommonName, true, nil
+}
+
+// CheckPeer returns an error unless the peer's certificate was issued to
+// name. It always passes on plain TCP.
+func CheckPeer(conn net.Conn, name string) error {
+	cn, ok, err := PeerName(conn)
+	if !ok || err != nil {
+		return err
+	}
+	return checkName(cn, name)
+}
+
+// CheckRequest is CheckPeer for a request to an HTTP server on a Listen
+// listener.
+func CheckRequest(r *http.Request, name string) error {
+	if r.TLS == nil {
+		return nil
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("peer sent no certificate")
+	}
+	return checkName(r.TLS.PeerCertificates[0].Subject.CommonName, name)
+}
+
+func checkName(cn, name string) error {
+	if cn != name {
+		return fmt.Errorf("certificate is issued to %q, not %q", cn, name)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issuer is a CA that signs test certificates
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newIssuer(t *testing.T, name string) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issuer{cert, key}
+}
+
+// issue returns a certificate for the common name cn signed by the CA
+func (ca *issuer) issue(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// setup writes the certificate of cn and the CA to dir and calls Setup with
+// them, the returned function disables TLS again
+func setup(t *testing.T, dir string, ca *issuer, cn string) func() {
+	cert := ca.issue(t, cn)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: ca.cert.Raw},
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Setup(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")); err != nil {
+		t.Fatal(err)
+	}
+	return func() { Conf, roots = nil, nil }
+}
+
+// A server set up with Setup accepts nodes whose certificate the federation
+// CA signed for the expected name, and nothing else
+func TestHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, rogue := newIssuer(t, "federation"), newIssuer(t, "rogue")
+	defer setup(t, dir, ca, ServerName)()
+
+	l, err := Listen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"accepted", []tls.Certificate{ca.issue(t, "node1")}, true},
+		{"other name", []tls.Certificate{ca.issue(t, "node2")}, false},
+		{"other CA", []tls.Certificate{rogue.issue(t, "node1")}, false},
+		{"no certificate", nil, false},
+	}
+	for _, tt := range tests {
+		done := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			done <- CheckPeer(conn, "node1")
+		}()
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{Certificates: tt.certs, InsecureSkipVerify: true})
+		if err == nil {
+			// with TLS 1.3 the server checks the client's certificate
+			// after the client finished its handshake
+			conn.Write([]byte{0})
+			defer conn.Close()
+		}
+		if err := <-done; (err == nil) != tt.ok {
+			t.Errorf("%s: server side %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// Dial pins the name of the peer's certificate
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{ServerName, true},
+		{"node1", false},
+	} {
+		conn, err := Dial(l.Addr().String(), tt.name)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("Dial to a %q certificate as %q: %v, want ok %v", ServerName, tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		cert, key, ca string
+		ok            bool
+	}{
+		{"", "", "", true},
+		{"cert.pem", "", "", false},
+		{"", "key.pem", "ca.pem", false},
+		{"missing.pem", "missing.pem", "missing.pem", false},
+	}
+	for _, tt := range tests {
+		if err := Setup(tt.cert, tt.key, tt.ca); (err == nil) != tt.ok {
+			t.Errorf("Setup(%q, %q, %q) = %v, want ok %v", tt.cert, tt.key, tt.ca, err, tt.ok)
+		}
+		if Enabled() {
+			t.Errorf("Setup(%q, %q, %q) enabled TLS", tt.cert, tt.key, tt.ca)
+		}
+	}
+}
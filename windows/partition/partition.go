@@ -0,0 +1,296 @@
+package main
+
+import (
+	"../data"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	nodes   *int     = flag.Int("n", 5, "number of node shards")
+	mode    *string  = flag.String("mode", "iid", "split: iid, label, quantity or feature")
+	alpha   *float64 = flag.Float64("alpha", 0.5, "Dirichlet concentration for label and quantity skew (smaller is more skewed)")
+	feature *int     = flag.Int("feature", 0, "feature column sorted on for feature skew")
+	label   *int     = flag.Int("label", -1, "label column, negative values count from the end")
+	test    *float64 = flag.Float64("test", 0.2, "fraction of each shard held out for testing")
+	outdir  *string  = flag.String("out", ".", "output directory")
+	seed    *int64   = flag.Int64("seed", 1, "random seed")
+)
+
+// Splits a labelled CSV/TSV dataset into node shards written as
+// x<i>.txt/y<i>.txt (training) and xv<i>.txt/yv<i>.txt (testing) for
+// i = 1..n, plus xv.txt/yv.txt holding the union of the test sets.
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 || *nodes < 1 {
+		fmt.Printf("Usage: partition [flags] dataset.csv\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	rng := rand.New(rand.NewSource(*seed))
+
+	header, rows, err := data.ReadRecords(args[0])
+	checkError(err)
+	if len(rows) == 0 {
+		checkError(fmt.Errorf("%s: no data rows", args[0]))
+	}
+	checkError(checkArgs(len(rows), *nodes, *alpha, *test))
+	lc := *label
+	if lc < 0 {
+		lc += len(rows[0])
+	}
+	if lc < 0 || lc >= len(rows[0]) {
+		checkError(fmt.Errorf("label column %d out of range", *label))
+	}
+
+	var shards [][]int
+	switch *mode {
+	case "iid":
+		shards = splitIID(rng, len(rows), *nodes)
+	case "label":
+		shards = splitLabel(rng, rows, lc, *nodes, *alpha)
+	case "quantity":
+		shards = splitQuantity(rng, len(rows), *nodes, *alpha)
+	case "feature":
+		fc := *feature
+		if fc >= lc {
+			fc++
+		}
+		shards, err = splitFeature(rows, fc, *nodes)
+		checkError(err)
+	default:
+		checkError(fmt.Errorf("unknown mode %q", *mode))
+	}
+	checkError(checkShards(shards))
+
+	checkError(os.MkdirAll(*outdir, 0755))
+	var xv, yv []string
+	for i, shard := range shards {
+		rng.Shuffle(len(shard), func(a, b int) { shard[a], shard[b] = shard[b], shard[a] })
+		ntest := testRows(len(shard), *test)
+		x, y := format(header, rows, shard[ntest:], lc)
+		xt, yt := format(header, rows, shard[:ntest], lc)
+		checkError(write(fmt.Sprintf("x%d.txt", i+1), x))
+		checkError(write(fmt.Sprintf("y%d.txt", i+1), y))
+		checkError(write(fmt.Sprintf("xv%d.txt", i+1), xt))
+		checkError(write(fmt.Sprintf("yv%d.txt", i+1), yt))
+		if xv == nil {
+			xv, yv = xt, yt
+		} else {
+			xv, yv = append(xv, xt[len(xt)-ntest:]...), append(yv, yt[len(yt)-ntest:]...)
+		}
+		fmt.Printf("--- node%d: %d training rows, %d test rows, labels %v.\n", i+1, len(shard)-ntest, ntest, labelCounts(rows, shard, lc))
+	}
+	checkError(write("xv.txt", xv))
+	checkError(write("yv.txt", yv))
+}
+
+// Function that checks the flags against the r rows of the dataset: every
+// node needs a row, the Dirichlet concentration must be positive and the
+// test fraction leave training rows
+func checkArgs(r, n int, alpha, test float64) error {
+	if n > r {
+		return fmt.Errorf("%d nodes but only %d rows, every node needs a row", n, r)
+	}
+	if !(alpha > 0) {
+		return fmt.Errorf("-alpha must be positive, got %v", alpha)
+	}
+	if !(test >= 0 && test < 1) {
+		return fmt.Errorf("-test must be at least 0 and below 1, got %v", test)
+	}
+	return nil
+}
+
+// Function that checks that no node is left without rows
+func checkShards(shards [][]int) error {
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			return fmt.Errorf("node%d gets no rows, use a larger -alpha or fewer nodes", i+1)
+		}
+	}
+	return nil
+}
+
+// Function that returns how many of a shard's r rows are held out for
+// testing, always leaving one for training
+func testRows(r int, test float64) int {
+	ntest := int(math.Round(test * float64(r)))
+	if ntest >= r {
+		ntest = r - 1
+	}
+	return ntest
+}
+
+// Rows are dealt out uniformly at random
+func splitIID(rng *rand.Rand, r, n int) [][]int {
+	return cut(rng.Perm(r), equal(n))
+}
+
+// Every node gets a Dirichlet(alpha) share of each label's rows
+func splitLabel(rng *rand.Rand, rows [][]string, lc, n int, alpha float64) [][]int {
+	byLabel := make(map[string][]int)
+	var keys []string
+	for i, row := range rows {
+		if _, ok := byLabel[row[lc]]; !ok {
+			keys = append(keys, row[lc])
+		}
+		byLabel[row[lc]] = append(byLabel[row[lc]], i)
+	}
+	sort.Strings(keys)
+	shards := make([][]int, n)
+	for _, k := range keys {
+		idx := byLabel[k]
+		rng.Shuffle(len(idx), func(a, b int) { idx[a], idx[b] = idx[b], idx[a] })
+		for i, part := range cut(idx, dirichlet(rng, n, alpha)) {
+			shards[i] = append(shards[i], part...)
+		}
+	}
+	return shards
+}
+
+// Rows are shuffled but shard sizes follow Dirichlet(alpha) proportions,
+// every node gets one row first so none is left empty when r >= n
+func splitQuantity(rng *rand.Rand, r, n int, alpha float64) [][]int {
+	perm := rng.Perm(r)
+	if r < n {
+		return cut(perm, dirichlet(rng, n, alpha))
+	}
+	shards := cut(perm[n:], dirichlet(rng, n, alpha))
+	for i := range shards {
+		shards[i] = append(shards[i], perm[i])
+	}
+	return shards
+}
+
+// Rows are sorted on one feature and cut into contiguous ranges, so every
+// node sees a different region of that feature
+func splitFeature(rows [][]string, fc, n int) ([][]int, error) {
+	if fc < 0 || fc >= len(rows[0]) {
+		return nil, fmt.Errorf("feature column %d out of range", fc)
+	}
+	vals := make([]float64, len(rows))
+	for i, row := range rows {
+		v, err := strconv.ParseFloat(strings.TrimSpace(row[fc]), 64)
+		if err != nil {
+			v = math.Inf(1)
+		}
+		vals[i] = v
+	}
+	idx := make([]int, len(rows))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return vals[idx[a]] < vals[idx[b]] })
+	return cut(idx, equal(n)), nil
+}
+
+// Function that cuts idx into consecutive parts with the given proportions
+func cut(idx []int, p []float64) [][]int {
+	parts := make([][]int, len(p))
+	start, acc := 0, 0.0
+	for i := range p {
+		acc += p[i]
+		end := int(math.Round(acc * float64(len(idx))))
+		if i == len(p)-1 || end > len(idx) {
+			end = len(idx)
+		}
+		parts[i] = append([]int(nil), idx[start:end]...)
+		start = end
+	}
+	return parts
+}
+
+func equal(n int) []float64 {
+	p := make([]float64, n)
+	for i := range p {
+		p[i] = 1 / float64(n)
+	}
+	return p
+}
+
+func dirichlet(rng *rand.Rand, n int, alpha float64) []float64 {
+	p := make([]float64, n)
+	sum := 0.0
+	for i := range p {
+		p[i] = gamma(rng, alpha)
+		sum += p[i]
+	}
+	for i := range p {
+		p[i] /= sum
+	}
+	return p
+}
+
+// Marsaglia and Tsang's gamma(a, 1) sampler
+func gamma(rng *rand.Rand, a float64) float64 {
+	if a < 1 {
+		return gamma(rng, a+1) * math.Pow(rng.Float64(), 1/a)
+	}
+	d := a - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// Function that splits the selected rows into feature lines and label lines
+func format(header []string, rows [][]string, idx []int, lc int) (x, y []string) {
+	if header != nil {
+		x = append(x, strings.Join(without(header, lc), ","))
+		y = append(y, header[lc])
+	}
+	for _, i := range idx {
+		x = append(x, strings.Join(without(rows[i], lc), ","))
+		y = append(y, rows[i][lc])
+	}
+	return x, y
+}
+
+func without(fields []string, k int) []string {
+	out := make([]string, 0, len(fields)-1)
+	out = append(out, fields[:k]...)
+	return append(out, fields[k+1:]...)
+}
+
+func labelCounts(rows [][]string, idx []int, lc int) map[string]int {
+	counts := make(map[string]int)
+	for _, i := range idx {
+		counts[rows[i][lc]]++
+	}
+	return counts
+}
+
+func write(name string, lines []string) error {
+	f, err := os.Create(filepath.Join(*outdir, name))
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		fmt.Fprintln(f, l)
+	}
+	return f.Close()
+}
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// dataset returns r rows of a feature column counting down from r and a
+// label column that is "a" for every third row and "b" otherwise.
+func dataset(r int) [][]string {
+	rows := make([][]string, r)
+	for i := range rows {
+		l := "b"
+		if i%3 == 0 {
+			l = "a"
+		}
+		rows[i] = []string{strconv.Itoa(r - i), l}
+	}
+	return rows
+}
+
+// checkPartition reports whether shards holds every one of r rows exactly
+// once.
+func checkPartition(t *testing.T, name string, shards [][]int, r, n int) {
+	if len(shards) != n {
+		t.Errorf("%s: %d shards, want %d", name, len(shards), n)
+	}
+	var all []int
+	for _, s := range shards {
+		all = append(all, s...)
+	}
+	sort.Ints(all)
+	for i := range all {
+		if all[i] != i {
+			t.Errorf("%s: shards hold rows %v, want each of the %d rows once", name, all, r)
+			return
+		}
+	}
+	if len(all) != r {
+		t.Errorf("%s: shards hold %d rows, want %d", name, len(all), r)
+	}
+}
+
+func TestSplits(t *testing.T) {
+	rows := dataset(30)
+	tests := []struct {
+		name  string
+		n     int
+		split func(rng *rand.Rand, n int) [][]int
+		sizes []int
+	}{
+		{"iid", 3, func(rng *rand.Rand, n int) [][]int { return splitIID(rng, len(rows), n) }, []int{10, 10, 10}},
+		{"iid uneven", 4, func(rng *rand.Rand, n int) [][]int { return splitIID(rng, len(rows), n) }, []int{8, 7, 8, 7}},
+		{"iid single", 1, func(rng *rand.Rand, n int) [][]int { return splitIID(rng, len(rows), n) }, []int{30}},
+		{"label", 3, func(rng *rand.Rand, n int) [][]int { return splitLabel(rng, rows, 1, n, 0.5) }, nil},
+		{"label skewed", 5, func(rng *rand.Rand, n int) [][]int { return splitLabel(rng, rows, 1, n, 0.01) }, nil},
+		{"quantity", 4, func(rng *rand.Rand, n int) [][]int { return splitQuantity(rng, len(rows), n, 0.5) }, nil},
+		{"feature", 3, func(rng *rand.Rand, n int) [][]int { s, _ := splitFeature(rows, 0, n); return s }, []int{10, 10, 10}},
+		{"more nodes than rows", 40, func(rng *rand.Rand, n int) [][]int { return splitIID(rng, len(rows), n) }, nil},
+	}
+	for _, tt := range tests {
+		shards := tt.split(rand.New(rand.NewSource(1)), tt.n)
+		checkPartition(t, tt.name, shards, len(rows), tt.n)
+		if tt.sizes == nil {
+			continue
+		}
+		sizes := make([]int, len(shards))
+		for i, s := range shards {
+			sizes[i] = len(s)
+		}
+		if !reflect.DeepEqual(sizes, tt.sizes) {
+			t.Errorf("%s: shard sizes %v, want %v", tt.name, sizes, tt.sizes)
+		}
+		// the same seed gives the same split
+		if again := tt.split(rand.New(rand.NewSource(1)), tt.n); !reflect.DeepEqual(again, shards) {
+			t.Errorf("%s: split differs with the same seed", tt.name)
+		}
+	}
+}
+
+// Even a strongly skewed quantity split leaves no node without rows
+func TestSplitQuantity(t *testing.T) {
+	tests := []struct {
+		r, n  int
+		alpha float64
+	}{
+		{10, 10, 0.01},
+		{30, 5, 0.01},
+		{100, 20, 0.1},
+		{30, 4, 100},
+	}
+	for _, tt := range tests {
+		for seed := int64(1); seed <= 20; seed++ {
+			shards := splitQuantity(rand.New(rand.NewSource(seed)), tt.r, tt.n, tt.alpha)
+			checkPartition(t, "quantity", shards, tt.r, tt.n)
+			if err := checkShards(shards); err != nil {
+				t.Errorf("%d rows in %d with alpha %v, seed %d: %v", tt.r, tt.n, tt.alpha, seed, err)
+			}
+		}
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	tests := []struct {
+		r, n        int
+		alpha, test float64
+		ok          bool
+	}{
+		{30, 5, 0.5, 0.2, true},
+		{5, 5, 0.5, 0, true},
+		{4, 5, 0.5, 0.2, false},
+		{30, 5, 0, 0.2, false},
+		{30, 5, -1, 0.2, false},
+		{30, 5, math.NaN(), 0.2, false},
+		{30, 5, 0.5, 1, false},
+		{30, 5, 0.5, -0.1, false},
+		{30, 5, 0.5, math.NaN(), false},
+	}
+	for _, tt := range tests {
+		if err := checkArgs(tt.r, tt.n, tt.alpha, tt.test); (err == nil) != tt.ok {
+			t.Errorf("checkArgs(%v, %v, %v, %v) = %v, want ok %v", tt.r, tt.n, tt.alpha, tt.test, err, tt.ok)
+		}
+	}
+}
+
+func TestTestRows(t *testing.T) {
+	tests := []struct {
+		r    int
+		test float64
+		want int
+	}{
+		{10, 0.2, 2},
+		{10, 0, 0},
+		{1, 0.9, 0},
+		{2, 0.9, 1},
+		{10, 0.99, 9},
+	}
+	for _, tt := range tests {
+		if got := testRows(tt.r, tt.test); got != tt.want {
+			t.Errorf("testRows(%v, %v) = %v, want %v", tt.r, tt.test, got, tt.want)
+		}
+	}
+}
+
+func TestSplitFeature(t *testing.T) {
+	rows := [][]string{{"3", "a"}, {"x", "a"}, {"1", "b"}, {" 2 ", "b"}, {"0", "a"}, {"NA", "b"}}
+	tests := []struct {
+		fc   int
+		n    int
+		want [][]int
+		ok   bool
+	}{
+		// unparsable values sort last, in their original order
+		{0, 2, [][]int{{4, 2, 3}, {0, 1, 5}}, true},
+		{0, 3, [][]int{{4, 2}, {3, 0}, {1, 5}}, true},
+		{2, 2, nil, false},
+		{-1, 2, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := splitFeature(rows, tt.fc, tt.n)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitFeature on column %d in %d = %v, %v, want %v", tt.fc, tt.n, got, err, tt.want)
+		}
+	}
+}
+
+func TestCut(t *testing.T) {
+	idx := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	tests := []struct {
+		p    []float64
+		want [][]int
+	}{
+		{[]float64{1}, [][]int{idx}},
+		{[]float64{0.5, 0.5}, [][]int{{0, 1, 2, 3, 4}, {5, 6, 7, 8, 9}}},
+		{[]float64{0.25, 0.75}, [][]int{{0, 1, 2}, {3, 4, 5, 6, 7, 8, 9}}},
+		{[]float64{0, 1, 0}, [][]int{nil, idx, nil}},
+		// rounding never loses the last rows
+		{[]float64{0.33, 0.33, 0.33}, [][]int{{0, 1, 2}, {3, 4, 5, 6}, {7, 8, 9}}},
+	}
+	for _, tt := range tests {
+		if got := cut(idx, tt.p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cut(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestDirichlet(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tests := []struct {
+		n     int
+		alpha float64
+	}{
+		{1, 0.5},
+		{5, 0.01},
+		{5, 0.5},
+		{10, 100},
+	}
+	for _, tt := range tests {
+		p := dirichlet(rng, tt.n, tt.alpha)
+		sum := 0.0
+		for _, v := range p {
+			if v < 0 || math.IsNaN(v) {
+				t.Errorf("dirichlet(%v, %v) = %v, want proportions", tt.n, tt.alpha, p)
+			}
+			sum += v
+		}
+		if len(p) != tt.n || math.Abs(sum-1) > 1e-9 {
+			t.Errorf("dirichlet(%v, %v) = %v, want %v proportions summing to 1", tt.n, tt.alpha, p, tt.n)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	rows := [][]string{{"1", "a", "2"}, {"3", "b", "4"}, {"5", "a", "6"}}
+	tests := []struct {
+		header []string
+		idx    []int
+		lc     int
+		x, y   []string
+	}{
+		{nil, []int{2, 0}, 1, []string{"5,6", "1,2"}, []string{"a", "a"}},
+		{[]string{"f", "label", "g"}, []int{1}, 1, []string{"f,g", "3,4"}, []string{"label", "b"}},
+		{nil, []int{0}, 2, []string{"1,a"}, []string{"2"}},
+		{[]string{"f", "label", "g"}, nil, 0, []string{"label,g"}, []string{"f"}},
+	}
+	for _, tt := range tests {
+		x, y := format(tt.header, rows, tt.idx, tt.lc)
+		if !reflect.DeepEqual(x, tt.x) || !reflect.DeepEqual(y, tt.y) {
+			t.Errorf("format(%v, %v, %v) = %q, %q, want %q, %q", tt.header, tt.idx, tt.lc, x, y, tt.x, tt.y)
+		}
+	}
+}
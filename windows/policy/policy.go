@@ -0,0 +1,199 @@
+// Package policy decides when a pending model was validated enough to be
+// merged into the global model. A policy is written as conditions joined by
+// "," that all have to hold, and alternatives of those joined by "|", e.g.
+// "coverage=0.6,accuracy=0.7|wait=10m,nodes=1". The conditions are
+//
+//	coverage=f  more than f of the live federation's data tested the model
+//	nodes=n     at least n distinct nodes tested it
+//	accuracy=f  at least f of the test data was classified correctly
+//	wait=d      at least d passed since the model was committed
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default is the rule servers always used.
+const Default = "coverage=0.6"
+
+// Progress is how far the validation of a pending model got. Covered counts
+// the committer's own data, Correct and Tested only the other nodes' tests.
+type Progress struct {
+	Covered int
+	Total   int
+	Nodes   int
+	Correct int
+	Tested  int
+	Waited  time.Duration
+}
+
+// Coverage is the share of the federation's data that tested the model.
+func (p Progress) Coverage() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Covered) / float64(p.Total)
+}
+
+// Accuracy is the share of the test data classified correctly, 0 before
+// any test.
+func (p Progress) Accuracy() float64 {
+	if p.Tested == 0 {
+		return 0
+	}
+	return float64(p.Correct) / float64(p.Tested)
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("coverage %.0f%%, %v nodes, accuracy %.0f%% after %v", 100*p.Coverage(), p.Nodes, 100*p.Accuracy(), p.Waited.Round(time.Second))
+}
+
+// Policy reports whether a model with the given progress is merged, String
+// writes it the way Parse reads it.
+type Policy interface {
+	Ready(p Progress) bool
+	String() string
+}
+
+// Coverage holds once more than the fraction f of the data tested the model.
+// Covered counts the committer's own data, so it also needs one other node
+// to have tested it: a model whose testers all died or missed their deadline
+// is not merged on its own data.
+type Coverage float64
+
+func (f Coverage) Ready(p Progress) bool {
+	return p.Nodes > 0 && p.Total > 0 && float64(p.Covered) > float64(p.Total)*float64(f)
+}
+
+func (f Coverage) String() string {
+	return "coverage=" + strconv.FormatFloat(float64(f), 'g', -1, 64)
+}
+
+type Nodes int
+
+func (n Nodes) Ready(p Progress) bool {
+	return p.Nodes >= int(n)
+}
+
+func (n Nodes) String() string {
+	return fmt.Sprintf("nodes=%d", int(n))
+}
+
+type Accuracy float64
+
+func (f Accuracy) Ready(p Progress) bool {
+	return p.Tested > 0 && float64(p.Correct) >= float64(p.Tested)*float64(f)
+}
+
+func (f Accuracy) String() string {
+	return "accuracy=" + strconv.FormatFloat(float64(f), 'g', -1, 64)
+}
+
+type Wait time.Duration
+
+func (d Wait) Ready(p Progress) bool {
+	return p.Waited >= time.Duration(d)
+}
+
+func (d Wait) String() string {
+	return "wait=" + time.Duration(d).String()
+}
+
+// All holds when every one of its policies does.
+type All []Policy
+
+func (a All) Ready(p Progress) bool {
+	for _, q := range a {
+		if !q.Ready(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a All) String() string {
+	s := make([]string, len(a))
+	for i, q := range a {
+		s[i] = q.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Any holds when one of its policies does.
+type Any []Policy
+
+func (a Any) Ready(p Progress) bool {
+	for _, q := range a {
+		if q.Ready(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Any) String() string {
+	s := make([]string, len(a))
+	for i, q := range a {
+		s[i] = q.String()
+	}
+	return strings.Join(s, "|")
+}
+
+// Parse reads a policy written as described above.
+func Parse(s string) (Policy, error) {
+	var alts Any
+	for _, alt := range strings.Split(s, "|") {
+		var all All
+		for _, cond := range strings.Split(alt, ",") {
+			q, err := parseCondition(strings.TrimSpace(cond))
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, q)
+		}
+		if len(all) == 1 {
+			alts = append(alts, all[0])
+		} else {
+			alts = append(alts, all)
+		}
+	}
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return alts, nil
+}
+
+func parseCondition(cond string) (Policy, error) {
+	kv := strings.SplitN(cond, "=", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("commit condition %q is not name=value", cond)
+	}
+	name, value := kv[0], kv[1]
+	switch name {
+	case "coverage", "accuracy":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("%v of %q is not a fraction between 0 and 1", name, value)
+		}
+		if name == "coverage" {
+			return Coverage(f), nil
+		}
+		return Accuracy(f), nil
+	case "nodes":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("nodes of %q is not a number of nodes", value)
+		}
+		return Nodes(n), nil
+	case "wait":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("wait of %q is not a duration like 90s or 10m", value)
+		}
+		return Wait(d), nil
+	}
+	return nil, fmt.Errorf("unknown commit condition %q, use coverage, nodes, accuracy or wait", name)
+}
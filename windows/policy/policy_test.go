@@ -0,0 +1,106 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{Default, "coverage=0.6", true},
+		{"nodes=2", "nodes=2", true},
+		{"accuracy=0.75", "accuracy=0.75", true},
+		{"wait=90s", "wait=1m30s", true},
+		{"coverage=0.6, nodes=1", "coverage=0.6,nodes=1", true},
+		{"coverage=0.6,accuracy=0.7|wait=10m,nodes=1", "coverage=0.6,accuracy=0.7|wait=10m0s,nodes=1", true},
+		{"coverage=1|nodes=3", "coverage=1|nodes=3", true},
+		{"", "", false},
+		{"coverage", "", false},
+		{"coverage=1.5", "", false},
+		{"coverage=-0.1", "", false},
+		{"accuracy=high", "", false},
+		{"nodes=-1", "", false},
+		{"nodes=two", "", false},
+		{"wait=-1s", "", false},
+		{"wait=10", "", false},
+		{"speed=1", "", false},
+		{"coverage=0.6,", "", false},
+		{"coverage=0.6|", "", false},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.in)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v, want an error", tt.in, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got := p.String(); got != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.in, got, tt.want)
+		}
+		if q, err := Parse(p.String()); err != nil || q.String() != p.String() {
+			t.Errorf("Parse(%q) does not read back as %q: %v, %v", p.String(), p.String(), q, err)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		policy string
+		p      Progress
+		want   bool
+	}{
+		{"coverage=0.6", Progress{Covered: 7, Total: 10, Nodes: 1}, true},
+		{"coverage=0.6", Progress{Covered: 6, Total: 10, Nodes: 1}, false},
+		// the committer's own data alone never merges a model
+		{"coverage=0.6", Progress{Covered: 10, Total: 10}, false},
+		{"coverage=0", Progress{Covered: 1, Total: 0, Nodes: 1}, false},
+		{"nodes=0", Progress{}, true},
+		{"nodes=2", Progress{Nodes: 1}, false},
+		{"nodes=2", Progress{Nodes: 2}, true},
+		{"accuracy=0.5", Progress{}, false},
+		{"accuracy=0.5", Progress{Correct: 1, Tested: 2}, true},
+		{"accuracy=0.5", Progress{Correct: 1, Tested: 3}, false},
+		{"wait=1m", Progress{Waited: 59 * time.Second}, false},
+		{"wait=1m", Progress{Waited: time.Minute}, true},
+		{"coverage=0.5,nodes=2", Progress{Covered: 8, Total: 10, Nodes: 1}, false},
+		{"coverage=0.5,nodes=2", Progress{Covered: 8, Total: 10, Nodes: 2}, true},
+		{"coverage=0.9|wait=1m", Progress{Covered: 5, Total: 10, Nodes: 1}, false},
+		{"coverage=0.9|wait=1m", Progress{Covered: 5, Total: 10, Nodes: 1, Waited: time.Hour}, true},
+		{"coverage=0.9|wait=1m", Progress{Covered: 10, Total: 10, Nodes: 1}, true},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.policy)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.policy, err)
+		}
+		if got := p.Ready(tt.p); got != tt.want {
+			t.Errorf("%q.Ready(%+v) = %v, want %v", tt.policy, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		p        Progress
+		coverage float64
+		accuracy float64
+		s        string
+	}{
+		{Progress{}, 0, 0, "coverage 0%, 0 nodes, accuracy 0% after 0s"},
+		{Progress{Covered: 3, Total: 4, Nodes: 2, Correct: 9, Tested: 10, Waited: 1500 * time.Millisecond}, 0.75, 0.9, "coverage 75%, 2 nodes, accuracy 90% after 2s"},
+	}
+	for _, tt := range tests {
+		if c, a, s := tt.p.Coverage(), tt.p.Accuracy(), tt.p.String(); c != tt.coverage || a != tt.accuracy || s != tt.s {
+			t.Errorf("%+v: coverage %v, accuracy %v, %q, want %v, %v, %q", tt.p, c, a, s, tt.coverage, tt.accuracy, tt.s)
+		}
+	}
+}
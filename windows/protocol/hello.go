@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"../frame"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/arcaneiceman/GoVector/govec"
+	"net"
+	"strings"
+)
+
+// The bclass, MATLAB, InsuLearn and Tor variants each send their own message
+// format, which the others would mis-decode. A node therefore opens every
+// join with a Hello: a plain gob frame of its own, ahead of the join message,
+// that every variant can read. The server picks a protocol version and the
+// features both sides offer, or refuses the join with Incompatible and an
+// explanation before it decodes anything in the node's format.
+
+// Protocol versions this tree speaks.
+const (
+	ProtoVersion    = 1
+	MinProtoVersion = 1
+)
+
+// Features a node or server can offer: how messages are framed, encoded and
+// packed and which models they carry.
+const (
+	FeatureFrame   = "frame"
+	FeatureGovec   = "govec"
+	FeatureSigned  = "ed25519"
+	FeatureGzip    = "gzip"
+	FeatureFloat32 = "quant:float32"
+	FeatureInt8    = "quant:int8"
+	ModelBclass    = "model:bclass"
+	ModelMatlab    = "model:matlab"
+	ModelInsuLearn = "model:insulearn"
+	ModelLogistic  = "model:logistic"
+)
+
+var featureNames = map[string]string{
+	FeatureFrame:   "length-prefixed frames",
+	FeatureGovec:   "GoVector-wrapped messages",
+	FeatureSigned:  "Ed25519 signed messages",
+	FeatureGzip:    "gzip compressed models",
+	FeatureFloat32: "float32 weights",
+	FeatureInt8:    "int8 weights",
+	ModelBclass:    "bclass models",
+	ModelMatlab:    "MATLAB models",
+	ModelInsuLearn: "InsuLearn Python models",
+	ModelLogistic:  "Tor logistic regression gradients",
+}
+
+// Hello is the range of protocol versions a node or server speaks and the
+// features it offers. In the answer to a join both versions are the one
+// agreed on.
+type Hello struct {
+	MinProto int
+	Proto    int
+	Features []string
+}
+
+// NewHello returns the Hello of this tree offering features.
+func NewHello(features ...string) Hello {
+	return Hello{MinProtoVersion, ProtoVersion, features}
+}
+
+// Has reports whether h offers feature f.
+func (h Hello) Has(f string) bool {
+	for _, g := range h.Features {
+		if g == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Hello) String() string {
+	return fmt.Sprintf("protocol %v with %v", versions(h.MinProto, h.Proto), describe(h.Features))
+}
+
+func versions(min, max int) string {
+	if min == max {
+		return fmt.Sprintf("v%v", max)
+	}
+	return fmt.Sprintf("v%v-v%v", min, max)
+}
+
+func describe(features []string) string {
+	if len(features) == 0 {
+		return "no features"
+	}
+	names := make([]string, len(features))
+	for i, f := range features {
+		if names[i] = featureNames[f]; names[i] == "" {
+			names[i] = f
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// ErrNoHello refuses a join that came without a Hello.
+var ErrNoHello = errors.New("join came without a protocol hello, the node predates version negotiation and has to be upgraded")
+
+// Negotiate agrees on the newest protocol version node and server both speak
+// and on the features they both offer. It fails, saying why, when they share
+// no version or the node lacks one of the required features.
+func Negotiate(node, server Hello, required ...string) (Hello, error) {
+	v := server.Proto
+	if node.Proto < v {
+		v = node.Proto
+	}
+	if v < node.MinProto || v < server.MinProto {
+		return Hello{}, fmt.Errorf("node speaks protocol %v, this server %v", versions(node.MinProto, node.Proto), versions(server.MinProto, server.Proto))
+	}
+	var missing []string
+	for _, f := range required {
+		if !node.Has(f) {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 {
+		return Hello{}, fmt.Errorf("node offers %v but this server needs %v", describe(node.Features), describe(missing))
+	}
+	agreed := Hello{v, v, nil}
+	for _, f := range server.Features {
+		if node.Has(f) {
+			agreed.Features = append(agreed.Features, f)
+		}
+	}
+	return agreed, nil
+}
+
+// WriteHello sends h in a frame of its own.
+func WriteHello(conn net.Conn, h Hello) error {
+	return frame.NewEncoder(conn).Encode(h)
+}
+
+// ReadHello reads the agreed Hello a server sends after accepting a join.
+func ReadHello(conn net.Conn) (Hello, error) {
+	var h Hello
+	err := frame.NewDecoder(conn).Decode(&h)
+	return h, err
+}
+
+// ReadFirst reads the first frame of a connection. When it is a Hello, the
+// hello is returned and the message follows in the next frame, otherwise p
+// is the message. gob refuses to decode a message into a Hello as they share
+// no fields, so the two can't be confused.
+func ReadFirst(conn net.Conn) (hello *Hello, p []byte, err error) {
+	p, err = frame.Read(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var h Hello
+	if gob.NewDecoder(bytes.NewReader(p)).Decode(&h) == nil && h.Proto > 0 {
+		return &h, nil, nil
+	}
+	return nil, p, nil
+}
+
+// ReceiveNext returns the bclass message that follows ReadFirst: decoded
+// from p, or read from the next frame when a Hello came first and p is nil.
+func ReceiveNext(conn net.Conn, logger *govec.GoLog, p []byte) (Message, error) {
+	if p == nil {
+		return Receive(conn, logger)
+	}
+	var m Message
+	unpackReceive(logger, "Received message", p, &m)
+	return m, nil
+}
+
+// DecodeNext is ReceiveNext for the variants that send plain gob messages,
+// the message is decoded into v.
+func DecodeNext(conn net.Conn, p []byte, v interface{}) error {
+	if p == nil {
+		return frame.NewDecoder(conn).Decode(v)
+	}
+	return gob.NewDecoder(bytes.NewReader(p)).Decode(v)
+}
+
+// Refused reports whether p, read in answer to a join, is a server refusing
+// the node's protocol rather than an answer in the node's own format. It
+// lets variants that don't answer with a Response learn why.
+func Refused(p []byte) (Response, bool) {
+	var r Response
+	if gob.NewDecoder(bytes.NewReader(p)).Decode(&r) != nil || r.Code != Incompatible {
+		return r, false
+	}
+	return r, true
+}
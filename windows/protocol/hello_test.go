@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"../frame"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	server := Hello{1, 3, []string{FeatureFrame, FeatureGovec, FeatureGzip, ModelBclass}}
+	tests := []struct {
+		name     string
+		node     Hello
+		required []string
+		want     Hello
+		err      string
+	}{
+		{"same", Hello{1, 3, []string{FeatureFrame, ModelBclass}}, nil, Hello{3, 3, []string{FeatureFrame, ModelBclass}}, ""},
+		{"older node", Hello{1, 2, []string{FeatureGovec}}, nil, Hello{2, 2, []string{FeatureGovec}}, ""},
+		{"newer node", Hello{2, 5, nil}, nil, Hello{3, 3, nil}, ""},
+		// the server's order of features wins
+		{"order", Hello{1, 1, []string{ModelBclass, FeatureGzip, FeatureFrame}}, nil, Hello{1, 1, []string{FeatureFrame, FeatureGzip, ModelBclass}}, ""},
+		{"unknown features", Hello{1, 1, []string{"model:other", FeatureGzip}}, nil, Hello{1, 1, []string{FeatureGzip}}, ""},
+		{"required", Hello{1, 3, []string{ModelBclass, FeatureFrame}}, []string{FeatureFrame, ModelBclass}, Hello{3, 3, []string{FeatureFrame, ModelBclass}}, ""},
+		{"too new", Hello{4, 5, nil}, nil, Hello{}, "node speaks protocol v4-v5, this server v1-v3"},
+		{"too old", Hello{0, 0, nil}, nil, Hello{}, "node speaks protocol v0, this server v1-v3"},
+		{"missing", Hello{1, 3, []string{FeatureFrame}}, []string{FeatureFrame, ModelBclass, ModelMatlab}, Hello{}, "node offers length-prefixed frames but this server needs bclass models, MATLAB models"},
+		{"nothing", Hello{1, 3, nil}, []string{"custom"}, Hello{}, "node offers no features but this server needs custom"},
+	}
+	for _, tt := range tests {
+		got, err := Negotiate(tt.node, server, tt.required...)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: Negotiate error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Negotiate = %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestHelloString(t *testing.T) {
+	tests := []struct {
+		h    Hello
+		want string
+	}{
+		{NewHello(), "protocol v1 with no features"},
+		{Hello{1, 2, []string{FeatureSigned, "x"}}, "protocol v1-v2 with Ed25519 signed messages, x"},
+	}
+	for _, tt := range tests {
+		if got := tt.h.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestReadFirst(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(conn net.Conn)
+		hello bool
+		id    int
+	}{
+		{"hello then message", func(conn net.Conn) {
+			WriteHello(conn, NewHello(FeatureFrame))
+			frame.NewEncoder(conn).Encode(Message{Id: 7, Type: JoinRequest})
+		}, true, 7},
+		{"message only", func(conn net.Conn) {
+			frame.NewEncoder(conn).Encode(Message{Id: 8, Type: JoinRequest})
+		}, false, 8},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		go func() {
+			tt.write(a)
+			a.Close()
+		}()
+		hello, p, err := ReadFirst(b)
+		if err != nil || (hello != nil) != tt.hello || (p == nil) != tt.hello {
+			t.Errorf("%s: ReadFirst = %v, %v bytes, %v", tt.name, hello, len(p), err)
+			b.Close()
+			continue
+		}
+		var m Message
+		if err := DecodeNext(b, p, &m); err != nil || m.Id != tt.id {
+			t.Errorf("%s: DecodeNext = %+v, %v, want node%v", tt.name, m, err, tt.id)
+		}
+		b.Close()
+	}
+}
+
+func TestRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want bool
+	}{
+		{"incompatible", Response{Incompatible, "no shared version"}, true},
+		{"other response", Response{Denied, "no"}, false},
+		{"message", Message{Id: 1, Type: JoinRequest}, false},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		go func() {
+			frame.NewEncoder(a).Encode(tt.v)
+			a.Close()
+		}()
+		p, err := frame.Read(b)
+		b.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := Refused(p); ok != tt.want || (ok && !strings.Contains(r.Error, "version")) {
+			t.Errorf("%s: Refused = %v, %v, want %v", tt.name, r, ok, tt.want)
+		}
+	}
+}
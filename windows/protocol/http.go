@@ -0,0 +1,261 @@
+package protocol
+
+import (
+	"../bclass"
+	"../data"
+	"../frame"
+	"../history"
+	"../policy"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The HTTP/JSON API of the aggregation server, for scripts and tools that
+// don't speak the gob protocol. Every request is signed like a message, over
+// its method, path, the time it was signed at and its raw body, or for GET
+// its raw query, see Signed. The server refuses requests signed too long ago
+// and accepts each signature once, so requests can't be replayed.
+
+// SignatureHeader carries the base64 encoded Ed25519 signature of a request.
+const SignatureHeader = "X-Signature"
+
+// TimeHeader carries the time a request was signed at, in RFC 3339.
+const TimeHeader = "X-Signed-At"
+
+// SignWindow is how far the time a request was signed at may be off the
+// server's clock.
+var SignWindow = time.Minute
+
+// NewerHeader makes a global model download conditional, the model is only
+// sent when its version is newer than the header's.
+const NewerHeader = "If-Newer-Than"
+
+// JoinBody is the body of a join. Addr is optional: a node that gives one is
+// also sent test requests and models over TCP, the others poll for them.
+type JoinBody struct {
+	Name   string
+	Addr   string
+	Schema data.Schema
+	PubKey []byte
+	Hello  Hello
+}
+
+// JoinReply answers a join, with the protocol version and features agreed on
+// when the node joined.
+type JoinReply struct {
+	Code  Code
+	Error string
+	Hello Hello
+}
+
+// CommitBody is a commit, Key is optional and works as Message.Key.
+type CommitBody struct {
+	Name  string
+	C     int
+	D     int
+	Model bclass.Model
+	Key   string
+}
+
+// ResultBody reports the results of the test of commit Id.
+type ResultBody struct {
+	Name string
+	Id   int
+	C    int
+	D    int
+	Key  string
+}
+
+// GlobalBody is the global model with its version.
+type GlobalBody struct {
+	Version int
+	Model   bclass.GlobalModel
+}
+
+// TestItem is a test request waiting for a polling node, a test not answered
+// by Deadline is left out of the coverage and sent again.
+type TestItem struct {
+	Id       int
+	Model    bclass.Model
+	Deadline time.Time
+}
+
+// StatusBody is the state of the aggregation: the commit policy, the global
+// model version and how far the latest model of each node got.
+type StatusBody struct {
+	Policy  string
+	Version int
+	Pending []PendingItem
+}
+
+// PendingItem is the latest model committed by node Id, Merged once it met
+// the commit policy.
+type PendingItem struct {
+	Id       int
+	Cnum     int
+	Merged   bool
+	Progress policy.Progress
+}
+
+// HistoryBody is the version history: every model merged into the global
+// model and every global model version, with the model versions it holds.
+type HistoryBody struct {
+	Version int
+	Models  []VersionItem
+	Globals []history.Global
+}
+
+// VersionItem is model version Seq without its weights.
+type VersionItem struct {
+	Seq      int
+	Node     int
+	Cnum     int
+	At       time.Time
+	Progress policy.Progress
+	Hash     string
+}
+
+// DiffBody compares the validation of two model versions.
+type DiffBody struct {
+	From  VersionItem
+	To    VersionItem
+	Delta history.Delta
+}
+
+// RollbackBody rolls the global model back, either one node's model to
+// model version Seq or, when Global is set, the whole global model to that
+// global model version.
+type RollbackBody struct {
+	Name   string
+	Seq    int
+	Global int
+}
+
+// Item returns v without its weights.
+func Item(v history.Version) VersionItem {
+	return VersionItem{v.Seq, v.Node, v.Cnum, v.At, v.Progress, v.Hash}
+}
+
+// ReadBody decodes the JSON body of a POST request into v and returns what
+// its signature covers and the signature.
+func ReadBody(r *http.Request, v interface{}) (signed, sig []byte, err error) {
+	if r.Method != http.MethodPost {
+		return nil, nil, fmt.Errorf("%v needs a POST request", r.URL.Path)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(frame.MaxSize)+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) > frame.MaxSize {
+		return nil, nil, &frame.TooLargeError{Size: len(body)}
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return nil, nil, err
+	}
+	return signature(r, body)
+}
+
+// ReadQuery returns the node name of a GET request, what its signature
+// covers and the signature.
+func ReadQuery(r *http.Request) (name string, signed, sig []byte, err error) {
+	if r.Method != http.MethodGet {
+		return "", nil, nil, fmt.Errorf("%v needs a GET request", r.URL.Path)
+	}
+	name = r.URL.Query().Get("name")
+	if name == "" {
+		return "", nil, nil, errors.New("no node name given")
+	}
+	signed, sig, err = signature(r, []byte(r.URL.RawQuery))
+	return name, signed, sig, err
+}
+
+// Signed returns what the signature of an HTTP request covers: its method,
+// path, the time it was signed at as in TimeHeader and its raw body, or raw
+// query for GET, each but the last followed by a newline.
+func Signed(method, path, at string, payload []byte) []byte {
+	return append([]byte(method+"\n"+path+"\n"+at+"\n"), payload...)
+}
+
+func signature(r *http.Request, payload []byte) (signed, sig []byte, err error) {
+	sig, err = base64.StdEncoding.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v header: %v", SignatureHeader, err)
+	}
+	at := r.Header.Get(TimeHeader)
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v header: %v", TimeHeader, err)
+	}
+	if err := CheckTime(t, time.Now()); err != nil {
+		return nil, nil, fmt.Errorf("request was %v", err)
+	}
+	return Signed(r.Method, r.URL.Path, at, payload), sig, nil
+}
+
+// Replays remembers the signatures of the requests a server accepted, as
+// long as their signing time is within SignWindow, so a request is only
+// accepted once.
+type Replays struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewReplays() *Replays {
+	return &Replays{seen: make(map[string]time.Time)}
+}
+
+// Check records sig as accepted at now, or returns an error when it was
+// accepted before.
+func (p *Replays) Check(sig []byte, now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s, at := range p.seen {
+		// older signatures are refused for their signing time
+		if now.Sub(at) > 2*SignWindow {
+			delete(p.seen, s)
+		}
+	}
+	if _, ok := p.seen[string(sig)]; ok {
+		return errors.New("request was replayed")
+	}
+	p.seen[string(sig)] = now
+	return nil
+}
+
+// HTTPStatus is the status of an HTTP response carrying code.
+func (c Code) HTTPStatus() int {
+	switch c {
+	case OK, Joined, Committed:
+		return http.StatusOK
+	case NotModified:
+		return http.StatusNotModified
+	case Denied:
+		return http.StatusForbidden
+	case Pending, Duplicate, Restart:
+		return http.StatusConflict
+	case Retry:
+		return http.StatusServiceUnavailable
+	case SchemaMismatch, ModelMismatch, Incompatible:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// WriteJSON writes v as the body of a response with the given status.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteResponse answers an HTTP request with a Response.
+func WriteResponse(w http.ResponseWriter, code Code, detail string) {
+	WriteJSON(w, code.HTTPStatus(), Response{code, detail})
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"../bclass"
+	"../frame"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"github.com/gonum/matrix/mat64"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Test requests and global grants carry whole models, to every node and on
+// every pull. A node with little bandwidth can offer FeatureGzip and one of
+// FeatureFloat32 or FeatureInt8 in its hello, the server then packs the
+// models it sends the node: the weights quantized to the agreed precision,
+// everything gzip compressed when agreed. Quantizing changes the weights,
+// so the node is told how much, see Report.
+
+// PackFeatures are the features a server offers to pack models with.
+var PackFeatures = []string{FeatureGzip, FeatureFloat32, FeatureInt8}
+
+// Precision is the precision weights are sent with under h, the smallest
+// one agreed on.
+func (h Hello) Precision() bclass.Precision {
+	switch {
+	case h.Has(FeatureInt8):
+		return bclass.Int8
+	case h.Has(FeatureFloat32):
+		return bclass.Float32
+	}
+	return bclass.Float64
+}
+
+// Report tells the node what packing cost: the size of the models before and
+// after, and the largest weight error of the model and of each member of
+// the global model.
+type Report struct {
+	Prec      bclass.Precision
+	Gzip      bool
+	Raw       int
+	Sent      int
+	Err       float64
+	MemberErr map[int]float64
+}
+
+func (r Report) String() string {
+	s := r.Prec.String()
+	if r.Gzip {
+		s += ", gzip compressed"
+	}
+	return fmt.Sprintf("%v: %.1f KB instead of %.1f KB, largest weight error %.3g", s, float64(r.Sent)/1024, float64(r.Raw)/1024, r.MaxErr())
+}
+
+// MaxErr is the largest weight error of any model.
+func (r Report) MaxErr() float64 {
+	e := r.Err
+	for _, v := range r.MemberErr {
+		e = math.Max(e, v)
+	}
+	return e
+}
+
+// Unsure counts the rows of xt the model m carries, the global model of a
+// grant or the model of a test request, could classify differently than the
+// model it was packed from.
+func (r Report) Unsure(m Message, xt *mat64.Dense) int {
+	if m.Type == GlobalGrant {
+		return m.GModel.Unsure(xt, r.MemberErr)
+	}
+	return m.Model.Unsure(xt, r.Err)
+}
+
+// packed holds the models of a message without their weights, which follow
+// in the agreed precision: the model's first, then those of the members of
+// the global model in the order of their ids.
+type packed struct {
+	Model   bclass.Model
+	GModel  bclass.GlobalModel
+	Weights []bclass.Weights
+	Report  Report
+}
+
+// Pack moves the models of a test request or global grant into m.Packed as
+// h agreed on. Other messages, and messages to nodes that agreed on neither
+// compression nor quantization, are left as they are, and so is m when
+// packing fails.
+func Pack(m *Message, h Hello) error {
+	prec, gz := h.Precision(), h.Has(FeatureGzip)
+	if m.Type != TestRequest && m.Type != GlobalGrant || prec == bclass.Float64 && !gz {
+		return nil
+	}
+	var raw bytes.Buffer
+	if err := gob.NewEncoder(&raw).Encode(packed{m.Model, m.GModel, nil, Report{}}); err != nil {
+		return err
+	}
+	p := packed{m.Model, bclass.GlobalModel{ModelList: make(map[int]bclass.Model), TestSize: m.GModel.TestSize, D: m.GModel.D}, nil, Report{prec, gz, raw.Len(), 0, 0, make(map[int]float64)}}
+	var q bclass.Weights
+	q, p.Report.Err = bclass.Quantize(&m.Model.W, prec)
+	p.Weights = append(p.Weights, q)
+	p.Model.W = mat64.Dense{}
+	for _, k := range m.GModel.Keys() {
+		member := m.GModel.ModelList[k]
+		q, p.Report.MemberErr[k] = bclass.Quantize(&member.W, prec)
+		p.Weights = append(p.Weights, q)
+		member.W = mat64.Dense{}
+		p.GModel.ModelList[k] = member
+	}
+	var buf bytes.Buffer
+	if gz {
+		buf.WriteByte(1)
+		zw := gzip.NewWriter(&buf)
+		if err := gob.NewEncoder(zw).Encode(p); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else {
+		buf.WriteByte(0)
+		if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+			return err
+		}
+	}
+	m.Model, m.GModel, m.Packed = bclass.Model{}, bclass.GlobalModel{}, buf.Bytes()
+	return nil
+}
+
+// Unpack restores the models of a message packed by Pack and returns what
+// packing cost. A message that wasn't packed is left alone and has no report.
+func Unpack(m *Message) (*Report, error) {
+	if len(m.Packed) == 0 {
+		return nil, nil
+	}
+	sent, b := len(m.Packed), m.Packed[1:]
+	if m.Packed[0] == 1 {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		// a small frame can inflate to any size, so the models are held to
+		// the limit of a frame too
+		if b, err = ioutil.ReadAll(io.LimitReader(zr, int64(frame.MaxSize)+1)); err != nil {
+			return nil, err
+		}
+		if len(b) > frame.MaxSize {
+			return nil, fmt.Errorf("packed models inflate past the %d byte limit", frame.MaxSize)
+		}
+	}
+	var p packed
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&p); err != nil {
+		return nil, err
+	}
+	keys := p.GModel.Keys()
+	if len(p.Weights) != len(keys)+1 {
+		return nil, fmt.Errorf("packed %v models with %v weight matrices", len(keys)+1, len(p.Weights))
+	}
+	for _, q := range p.Weights {
+		if err := q.Check(); err != nil {
+			return nil, err
+		}
+	}
+	p.Model.W = *p.Weights[0].Dense()
+	for i, k := range keys {
+		member := p.GModel.ModelList[k]
+		member.W = *p.Weights[i+1].Dense()
+		p.GModel.ModelList[k] = member
+	}
+	if p.GModel.ModelList == nil {
+		p.GModel.ModelList = make(map[int]bclass.Model)
+	}
+	m.Model, m.GModel, m.Packed = p.Model, p.GModel, nil
+	p.Report.Sent = sent
+	return &p.Report, nil
+}
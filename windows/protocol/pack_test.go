@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"../bclass"
+	"../frame"
+	"bytes"
+	"compress/gzip"
+	"github.com/gonum/matrix/mat64"
+	"math"
+	"testing"
+)
+
+func testModel(w ...float64) bclass.Model {
+	return bclass.Model{W: *mat64.NewDense(len(w), 1, w), Deg: 1, Lambda: 0.5, Labels: bclass.DefaultLabels}
+}
+
+// maxDiff is the largest difference between the elements of a and b, +Inf
+// when their shapes differ.
+func maxDiff(a, b *mat64.Dense) float64 {
+	ar, ac := a.Dims()
+	br, bc := b.Dims()
+	if ar != br || ac != bc {
+		return math.Inf(1)
+	}
+	d := 0.0
+	for i := 0; i < ar; i++ {
+		for j := 0; j < ac; j++ {
+			d = math.Max(d, math.Abs(a.At(i, j)-b.At(i, j)))
+		}
+	}
+	return d
+}
+
+func TestPackUnpack(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     Kind
+		features []string
+		packed   bool
+		gzip     bool
+		prec     bclass.Precision
+		maxErr   float64
+	}{
+		{"plain", TestRequest, nil, false, false, bclass.Float64, 0},
+		{"other kind", CommitRequest, []string{FeatureGzip, FeatureInt8}, false, false, bclass.Float64, 0},
+		{"gzip", TestRequest, []string{FeatureGzip}, true, true, bclass.Float64, 0},
+		{"float32", GlobalGrant, []string{FeatureFloat32}, true, false, bclass.Float32, 1e-6},
+		{"int8", GlobalGrant, []string{FeatureInt8}, true, false, bclass.Int8, 0.01},
+		{"smallest", TestRequest, []string{FeatureFloat32, FeatureInt8, FeatureGzip}, true, true, bclass.Int8, 0.01},
+	}
+	for _, tt := range tests {
+		want := Message{Id: 3, Type: tt.kind, Model: testModel(0.25, -1.5, 2, 1e-3)}
+		want.GModel = bclass.GlobalModel{
+			ModelList: map[int]bclass.Model{1: testModel(1, 2), 2: testModel(-0.5, 0.75, 0)},
+			TestSize:  map[int]int{1: 10, 2: 20},
+			D:         30,
+		}
+		m := want
+		if err := Pack(&m, Hello{Proto: ProtoVersion, Features: tt.features}); err != nil {
+			t.Errorf("%s: Pack: %v", tt.name, err)
+			continue
+		}
+		if (len(m.Packed) > 0) != tt.packed {
+			t.Errorf("%s: packed %v bytes, want packed %v", tt.name, len(m.Packed), tt.packed)
+			continue
+		}
+		r, err := Unpack(&m)
+		if err != nil {
+			t.Errorf("%s: Unpack: %v", tt.name, err)
+			continue
+		}
+		if !tt.packed {
+			if r != nil {
+				t.Errorf("%s: report %v for a message that wasn't packed", tt.name, r)
+			}
+			continue
+		}
+		if r.Prec != tt.prec || r.Gzip != tt.gzip || r.Sent == 0 || r.Raw == 0 {
+			t.Errorf("%s: report %+v, want %v", tt.name, r, tt.prec)
+		}
+		if r.MaxErr() > tt.maxErr {
+			t.Errorf("%s: weight error %v, want at most %v", tt.name, r.MaxErr(), tt.maxErr)
+		}
+		if d := maxDiff(&m.Model.W, &want.Model.W); d > r.Err+1e-12 || m.Model.Deg != 1 || m.Model.Lambda != 0.5 || m.Model.Labels != bclass.DefaultLabels {
+			t.Errorf("%s: model %+v, differs by %v with a reported error of %v", tt.name, m.Model, d, r.Err)
+		}
+		for k, member := range want.GModel.ModelList {
+			got := m.GModel.ModelList[k]
+			if d := maxDiff(&got.W, &member.W); d > r.MemberErr[k]+1e-12 {
+				t.Errorf("%s: member %v differs by %v with a reported error of %v", tt.name, k, d, r.MemberErr[k])
+			}
+		}
+		if m.GModel.D != 30 || m.GModel.TestSize[2] != 20 || len(m.GModel.ModelList) != 2 {
+			t.Errorf("%s: global model %+v", tt.name, m.GModel)
+		}
+	}
+}
+
+func TestUnpackCorrupt(t *testing.T) {
+	m := Message{Type: TestRequest, Model: testModel(1, 2, 3)}
+	if err := Pack(&m, Hello{Proto: ProtoVersion, Features: []string{FeatureGzip}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		packed []byte
+	}{
+		{"truncated", m.Packed[:len(m.Packed)/2]},
+		{"not gzip", append([]byte{1}, "not gzip"...)},
+		{"not gob", []byte{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		c := Message{Type: TestRequest, Packed: tt.packed}
+		if r, err := Unpack(&c); err == nil {
+			t.Errorf("%s: Unpack = %v, want an error", tt.name, r)
+		}
+	}
+}
+
+func TestUnpackBomb(t *testing.T) {
+	defer func(n int) { frame.MaxSize = n }(frame.MaxSize)
+	frame.MaxSize = 1 << 20
+	// a megabyte of zeros compresses to about a kilobyte
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, frame.MaxSize+1))
+	zw.Close()
+	if buf.Len() > frame.MaxSize/100 {
+		t.Fatalf("%v compressed bytes", buf.Len())
+	}
+	m := Message{Type: TestRequest, Packed: buf.Bytes()}
+	if r, err := Unpack(&m); err == nil {
+		t.Errorf("Unpack of %v bytes inflating past the limit = %v, want an error", buf.Len(), r)
+	}
+
+	// models up to the limit still unpack
+	m = Message{Type: TestRequest, Model: testModel(1, 2, 3)}
+	if err := Pack(&m, Hello{Proto: ProtoVersion, Features: []string{FeatureGzip}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unpack(&m); err != nil {
+		t.Errorf("Unpack of a small model: %v", err)
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	tests := []struct {
+		features []string
+		want     bclass.Precision
+	}{
+		{nil, bclass.Float64},
+		{[]string{FeatureGzip}, bclass.Float64},
+		{[]string{FeatureFloat32}, bclass.Float32},
+		{[]string{FeatureInt8}, bclass.Int8},
+		{[]string{FeatureInt8, FeatureFloat32}, bclass.Int8},
+	}
+	for _, tt := range tests {
+		if got := (Hello{Features: tt.features}).Precision(); got != tt.want {
+			t.Errorf("Precision of %v = %v, want %v", tt.features, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package protocol defines the messages exchanged between nodes and servers:
+// the message kinds, the response codes and the helpers that put them on the
+// wire. Every client and server variant uses these, so a kind or code added
+// here is seen by all of them.
+package protocol
+
+import (
+	"../bclass"
+	"../data"
+	"../frame"
+	"../mtls"
+	"fmt"
+	"github.com/arcaneiceman/GoVector/govec"
+	"net"
+	"sync"
+	"time"
+)
+
+// Kind is the type of a message.
+type Kind string
+
+const (
+	// node to server
+	JoinRequest   Kind = "join_request"
+	CommitRequest Kind = "commit_request"
+	TestComplete  Kind = "test_complete"
+	GlobalRequest Kind = "global_request"
+	StatsRequest  Kind = "stats_request"
+	PollRequest   Kind = "poll_request"
+	Heartbeat     Kind = "heartbeat"
+	// server to node
+	TestRequest Kind = "test_request"
+	GlobalGrant Kind = "global_grant"
+	StatsGrant  Kind = "stats_grant"
+	// between Raft replicas, a join request from an already known node and
+	// the leader's verdict on a node's liveness (Id is the node, C its state)
+	RejoinRequest Kind = "rejoin_request"
+	NodeState     Kind = "node_state"
+	// in a server's log, the pending model of node Id merged into the
+	// global model (D is the data it was judged against), and an operator's
+	// rollback to model version Id or, when Version is set, to that global
+	// model version
+	ModelMerged Kind = "model_merged"
+	Rollback    Kind = "rollback"
+)
+
+// Code is the outcome of a request.
+type Code int
+
+const (
+	OK Code = iota
+	// the node joined or rejoined
+	Joined
+	// the node's model was committed to the global model
+	Committed
+	// the request was refused, Error says why
+	Denied
+	// a commit arrived while the node still had tests outstanding
+	Pending
+	// test results for a commit that was already tested
+	Duplicate
+	// the server could not process the request now, it can be resent
+	Retry
+	// the node has to start over from a join
+	Restart
+	// the node's data does not match the federation schema
+	SchemaMismatch
+	// the committed model does not match the federation schema
+	ModelMismatch
+	// the message kind is not handled by the receiver
+	Unknown
+	// the node already has the newest global model
+	NotModified
+	// the node speaks a protocol version or message format the server
+	// doesn't, Error explains the difference
+	Incompatible
+)
+
+var codeNames = []string{"OK", "Joined", "Committed", "Denied", "Pending tests are not complete",
+	"Duplicate test", "Try again", "Restart", "Schema mismatch", "Model mismatch", "Unknown request",
+	"Not modified", "Incompatible protocol"}
+
+func (c Code) String() string {
+	if c >= 0 && int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", int(c))
+}
+
+// Response is the reply to every message, Error carries the details of a
+// refusal.
+type Response struct {
+	Code  Code
+	Error string
+}
+
+// Accepted reports whether the request went through.
+func (r Response) Accepted() bool {
+	return r.Code == OK || r.Code == Joined || r.Code == Committed
+}
+
+func (r Response) String() string {
+	if r.Error == "" {
+		return r.Code.String()
+	}
+	return r.Code.String() + ": " + r.Error
+}
+
+// Message is the message of the bclass nodes and servers. Fields a kind
+// doesn't use are left at their zero value. Nodes sign the kinds that change
+// server state with the key whose public half they sent in their first join.
+//
+// Version numbers the global model. A global_request carries the version the
+// node has, the server answers with a global_grant of a newer one right on
+// the same connection, or with NotModified.
+//
+// Key is the idempotency key of a commit or of test results: a node sends the
+// same key every time it resends the request, and servers answer a key they
+// already processed with the response they gave the first time.
+//
+// Packed carries the models of a test request or global grant instead of
+// Model and GModel when the node agreed on compression or quantization,
+// see Pack.
+//
+// SignedAt is when a node signed the message, servers refuse messages signed
+// more than SignWindow off their clock and accept each signature once.
+//
+// Deadline is when the node has to answer a test request by, see the test
+// timeout of the servers.
+type Message struct {
+	Id       int
+	NodeIp   string
+	NodeName string
+	Type     Kind
+	C        int
+	D        int
+	Model    bclass.Model
+	GModel   bclass.GlobalModel
+	Stats    bclass.ColumnStats
+	Schema   data.Schema
+	Version  int
+	Key      string
+	Packed   []byte
+	PubKey   []byte
+	Sig      []byte
+	SignedAt time.Time
+	Deadline time.Time
+}
+
+// Send writes m to conn as one frame, instrumented by logger.
+func Send(conn net.Conn, logger *govec.GoLog, m Message) error {
+	return frame.Write(conn, prepareSend(logger, string(m.Type), m))
+}
+
+// Receive reads one message from conn, instrumented by logger.
+func Receive(conn net.Conn, logger *govec.GoLog) (Message, error) {
+	var m Message
+	p, err := frame.Read(conn)
+	if err != nil {
+		return m, err
+	}
+	unpackReceive(logger, "Received message", p, &m)
+	return m, nil
+}
+
+// govecMu serializes the use of GoVector logs, whose vector clock isn't safe
+// for the concurrent sends and receives of a server.
+var govecMu sync.Mutex
+
+func prepareSend(logger *govec.GoLog, event string, v interface{}) []byte {
+	govecMu.Lock()
+	defer govecMu.Unlock()
+	return logger.PrepareSend(event, v)
+}
+
+func unpackReceive(logger *govec.GoLog, event string, p []byte, v interface{}) {
+	govecMu.Lock()
+	defer govecMu.Unlock()
+	logger.UnpackReceive(event, p, v)
+}
+
+// LogEvent logs a local event, like a commit, to logger.
+func LogEvent(logger *govec.GoLog, event string) {
+	govecMu.Lock()
+	defer govecMu.Unlock()
+	logger.LogLocalEvent(event)
+}
+
+// PollWait is how long a server holds a poll_request that finds nothing
+// queued for the node. It stays below frame.Timeout so the node's read of
+// the answer doesn't time out first.
+var PollWait = 20 * time.Second
+
+// SendBatch answers a poll_request with the messages queued for the node.
+func SendBatch(conn net.Conn, logger *govec.GoLog, ms []Message) error {
+	return frame.Write(conn, prepareSend(logger, "poll_grant", ms))
+}
+
+// ReceiveBatch reads the messages sent by SendBatch.
+func ReceiveBatch(conn net.Conn, logger *govec.GoLog) ([]Message, error) {
+	var ms []Message
+	p, err := frame.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	unpackReceive(logger, "Received poll grant", p, &ms)
+	return ms, nil
+}
+
+// Reply writes the response to a message.
+func Reply(conn net.Conn, code Code, detail string) error {
+	return frame.NewEncoder(conn).Encode(Response{code, detail})
+}
+
+// ReadResponse reads the response to a message sent on conn.
+func ReadResponse(conn net.Conn) (Response, error) {
+	var r Response
+	err := frame.NewDecoder(conn).Decode(&r)
+	return r, err
+}
+
+// Request sends m on a new connection to addr, whose certificate has to be
+// issued to name, and returns the response, resending it as Resend allows.
+func Request(addr *net.TCPAddr, name string, logger *govec.GoLog, m Message) (Response, error) {
+	return Resend(func() (Response, error) {
+		conn, err := mtls.Dial(addr.String(), name)
+		if err != nil {
+			return Response{}, err
+		}
+		defer conn.Close()
+		if err = Send(conn, logger, m); err != nil {
+			return Response{}, err
+		}
+		return ReadResponse(conn)
+	})
+}
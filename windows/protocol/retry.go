@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"../frame"
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// Attempts is how often a request is sent before giving up.
+	Attempts = 4
+	// BaseDelay is the wait before the first resend, it doubles with every
+	// further one up to MaxDelay.
+	BaseDelay = 250 * time.Millisecond
+	MaxDelay  = 5 * time.Second
+)
+
+// Backoff is the wait before resend number n, counting from 1: exponential
+// in n, with full jitter so nodes that failed together don't resend together.
+func Backoff(n int) time.Duration {
+	d := BaseDelay << uint(n-1)
+	if d <= 0 || d > MaxDelay {
+		d = MaxDelay
+	}
+	return time.Duration(mrand.Int63n(int64(d)) + 1)
+}
+
+// Resend calls send until it gets a response that isn't Retry, Attempts are
+// used up, or it fails in a way resending can't fix. Requests that change
+// state must carry a Key, so a resend after a lost response is only
+// processed once.
+func Resend(send func() (Response, error)) (Response, error) {
+	var r Response
+	var err error
+	for n := 1; ; n++ {
+		r, err = send()
+		if err == nil && r.Code != Retry {
+			return r, nil
+		}
+		var large *frame.TooLargeError
+		if errors.As(err, &large) || n >= Attempts {
+			return r, err
+		}
+		time.Sleep(Backoff(n))
+	}
+}
+
+// NewKey returns a new random idempotency key.
+func NewKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// the key only has to differ from the node's other keys
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ReplyWindow is how many keys Replies keeps for each node, older ones are
+// forgotten and their requests processed again.
+var ReplyWindow = 128
+
+// Replies remembers the responses a server gave to requests with a Key.
+type Replies struct {
+	mu    sync.Mutex
+	reply map[string]map[string]Response
+	order map[string][]string
+}
+
+func NewReplies() *Replies {
+	return &Replies{reply: make(map[string]map[string]Response), order: make(map[string][]string)}
+}
+
+// Lookup returns the response node name was given for key. Retry stands for
+// a request that is still being processed.
+func (rs *Replies) Lookup(name, key string) (Response, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.reply[name][key]
+	return r, ok && key != ""
+}
+
+// Start claims key for a request of node name and returns true, or returns
+// false with the response to give when the key was seen before. Requests
+// without a key are always started.
+func (rs *Replies) Start(name, key string) (Response, bool) {
+	if key == "" {
+		return Response{}, true
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if r, ok := rs.reply[name][key]; ok {
+		return r, false
+	}
+	if rs.reply[name] == nil {
+		rs.reply[name] = make(map[string]Response)
+	}
+	rs.reply[name][key] = Response{Retry, "request is being processed"}
+	rs.order[name] = append(rs.order[name], key)
+	if len(rs.order[name]) > ReplyWindow {
+		delete(rs.reply[name], rs.order[name][0])
+		rs.order[name] = rs.order[name][1:]
+	}
+	return Response{}, true
+}
+
+// Finish records the response to a started request. A Retry response
+// releases the key, so the resend is processed.
+func (rs *Replies) Finish(name, key string, r Response) {
+	if key == "" {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, ok := rs.reply[name][key]; !ok {
+		return
+	}
+	if r.Code == Retry {
+		delete(rs.reply[name], key)
+		return
+	}
+	rs.reply[name][key] = r
+}
+
+// savedReplies is the form Replies are saved in.
+type savedReplies struct {
+	Reply map[string]map[string]Response
+	Order map[string][]string
+}
+
+// GobEncode saves the remembered responses, so a server that keeps its
+// state on disk still knows them after a restart. Keys still being processed
+// are left out, their requests are resent.
+func (rs *Replies) GobEncode() ([]byte, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s := savedReplies{make(map[string]map[string]Response), make(map[string][]string)}
+	for name, keys := range rs.order {
+		s.Reply[name] = make(map[string]Response)
+		for _, key := range keys {
+			if r, ok := rs.reply[name][key]; ok && r.Code != Retry {
+				s.Reply[name][key] = r
+				s.Order[name] = append(s.Order[name], key)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(s)
+	return buf.Bytes(), err
+}
+
+func (rs *Replies) GobDecode(b []byte) error {
+	var s savedReplies
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&s); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.reply, rs.order = s.Reply, s.Order
+	if rs.reply == nil {
+		rs.reply = make(map[string]map[string]Response)
+	}
+	if rs.order == nil {
+		rs.order = make(map[string][]string)
+	}
+	for name := range rs.order {
+		if rs.reply[name] == nil {
+			rs.reply[name] = make(map[string]Response)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"../frame"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplies(t *testing.T) {
+	committed := Response{Committed, ""}
+	retry := Response{Retry, "request is being processed"}
+	type step struct {
+		op        string // start, finish or lookup
+		name, key string
+		r         Response
+		started   bool
+		want      Response
+		found     bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"no key", []step{
+			{"start", "a", "", Response{}, true, Response{}, false},
+			{"finish", "a", "", committed, false, Response{}, false},
+			{"start", "a", "", Response{}, true, Response{}, false},
+			{"lookup", "a", "", Response{}, false, Response{}, false},
+		}},
+		{"resend after the response", []step{
+			{"start", "a", "k1", Response{}, true, Response{}, false},
+			{"finish", "a", "k1", committed, false, Response{}, false},
+			{"start", "a", "k1", Response{}, false, committed, false},
+			{"lookup", "a", "k1", Response{}, false, committed, true},
+		}},
+		{"resend while processing", []step{
+			{"start", "a", "k1", Response{}, true, Response{}, false},
+			{"start", "a", "k1", Response{}, false, retry, false},
+			{"lookup", "a", "k1", Response{}, false, retry, true},
+		}},
+		{"retry releases the key", []step{
+			{"start", "a", "k1", Response{}, true, Response{}, false},
+			{"finish", "a", "k1", Response{Retry, "busy"}, false, Response{}, false},
+			{"lookup", "a", "k1", Response{}, false, Response{}, false},
+			{"start", "a", "k1", Response{}, true, Response{}, false},
+		}},
+		{"keys are per node", []step{
+			{"start", "a", "k1", Response{}, true, Response{}, false},
+			{"finish", "a", "k1", committed, false, Response{}, false},
+			{"start", "b", "k1", Response{}, true, Response{}, false},
+			{"lookup", "b", "k1", Response{}, false, retry, true},
+		}},
+		{"finish without start", []step{
+			{"finish", "a", "k1", committed, false, Response{}, false},
+			{"lookup", "a", "k1", Response{}, false, Response{}, false},
+		}},
+	}
+	for _, tt := range tests {
+		rs := NewReplies()
+		for i, s := range tt.steps {
+			switch s.op {
+			case "start":
+				r, ok := rs.Start(s.name, s.key)
+				if ok != s.started || r != s.want {
+					t.Errorf("%s: step %d: Start = %v, %v, want %v, %v", tt.name, i, r, ok, s.want, s.started)
+				}
+			case "finish":
+				rs.Finish(s.name, s.key, s.r)
+			case "lookup":
+				r, ok := rs.Lookup(s.name, s.key)
+				if ok != s.found || (ok && r != s.want) {
+					t.Errorf("%s: step %d: Lookup = %v, %v, want %v, %v", tt.name, i, r, ok, s.want, s.found)
+				}
+			}
+		}
+	}
+}
+
+func TestReplyWindow(t *testing.T) {
+	defer func(n int) { ReplyWindow = n }(ReplyWindow)
+	ReplyWindow = 3
+	rs := NewReplies()
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprint(i)
+		rs.Start("a", key)
+		rs.Finish("a", key, Response{OK, key})
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := rs.Lookup("a", fmt.Sprint(i)); ok != (i >= 2) {
+			t.Errorf("key %v remembered %v with a window of 3", i, ok)
+		}
+	}
+}
+
+func TestRepliesGob(t *testing.T) {
+	rs := NewReplies()
+	rs.Start("a", "done")
+	rs.Finish("a", "done", Response{Committed, ""})
+	rs.Start("a", "busy")
+	rs.Start("b", "done")
+	rs.Finish("b", "done", Response{Denied, "no"})
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rs); err != nil {
+		t.Fatal(err)
+	}
+	saved := NewReplies()
+	if err := gob.NewDecoder(&buf).Decode(saved); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, key string
+		want      Response
+		found     bool
+	}{
+		{"a", "done", Response{Committed, ""}, true},
+		// requests still being processed are resent after a restart
+		{"a", "busy", Response{}, false},
+		{"b", "done", Response{Denied, "no"}, true},
+		{"c", "done", Response{}, false},
+	}
+	for _, tt := range tests {
+		if r, ok := saved.Lookup(tt.name, tt.key); ok != tt.found || r != tt.want {
+			t.Errorf("Lookup(%q, %q) after a restart = %v, %v, want %v, %v", tt.name, tt.key, r, ok, tt.want, tt.found)
+		}
+	}
+	if _, ok := saved.Start("a", "busy"); !ok {
+		t.Errorf("a request still being processed was not started again after a restart")
+	}
+}
+
+func TestResend(t *testing.T) {
+	defer func(n int, d time.Duration) { Attempts, BaseDelay = n, d }(Attempts, BaseDelay)
+	Attempts, BaseDelay = 4, time.Millisecond
+	lost := errors.New("connection reset")
+	tests := []struct {
+		name    string
+		replies []interface{}
+		want    Code
+		err     bool
+		sent    int
+	}{
+		{"first", []interface{}{Response{OK, ""}}, OK, false, 1},
+		{"denied", []interface{}{Response{Denied, "no"}}, Denied, false, 1},
+		{"lost", []interface{}{lost, lost, Response{Committed, ""}}, Committed, false, 3},
+		{"busy", []interface{}{Response{Retry, ""}, Response{OK, ""}}, OK, false, 2},
+		{"gives up", []interface{}{lost, lost, lost, lost, Response{OK, ""}}, OK, true, 4},
+		{"still busy", []interface{}{Response{Retry, ""}, Response{Retry, ""}, Response{Retry, ""}, Response{Retry, ""}}, Retry, false, 4},
+		{"too large", []interface{}{&frame.TooLargeError{}}, OK, true, 1},
+	}
+	for _, tt := range tests {
+		sent := 0
+		r, err := Resend(func() (Response, error) {
+			reply := tt.replies[sent]
+			sent++
+			if err, ok := reply.(error); ok {
+				return Response{}, err
+			}
+			return reply.(Response), nil
+		})
+		if sent != tt.sent || (err != nil) != tt.err || (err == nil && r.Code != tt.want) {
+			t.Errorf("%s: sent %v times, got %v, %v, want %v sends and %v", tt.name, sent, r, err, tt.sent, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer func(b, m time.Duration) { BaseDelay, MaxDelay = b, m }(BaseDelay, MaxDelay)
+	BaseDelay, MaxDelay = 100*time.Millisecond, time.Second
+	tests := []struct {
+		n   int
+		max time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if d := Backoff(tt.n); d <= 0 || d > tt.max {
+				t.Errorf("Backoff(%v) = %v, want in (0, %v]", tt.n, d, tt.max)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Signed reports whether messages of kind k change server state and so have
+// to carry the sender's signature.
+func (k Kind) Signed() bool {
+	switch k {
+	case JoinRequest, CommitRequest, TestComplete, StatsRequest, PollRequest, Heartbeat:
+		return true
+	}
+	return false
+}
+
+// Sign stamps m with the current time and sets m.Sig to key's signature of
+// m. A message resent is signed again, the server accepts each signature once.
+func Sign(m *Message, key ed25519.PrivateKey) {
+	m.SignedAt = time.Now()
+	m.Sig = ed25519.Sign(key, Digest(*m))
+}
+
+// Verify checks m.Sig against the public key pub.
+func Verify(m Message, pub []byte) error {
+	return VerifyBody(Digest(m), m.Sig, pub)
+}
+
+// CheckTime returns an error when the time a message or request was signed
+// at is more than SignWindow off now.
+func CheckTime(at, now time.Time) error {
+	if d := now.Sub(at); d > SignWindow || d < -SignWindow {
+		return fmt.Errorf("signed at %v, more than %v off the server's clock", at.Format(time.RFC3339), SignWindow)
+	}
+	return nil
+}
+
+// VerifyBody checks sig, the signature of the raw body of an HTTP request,
+// against pub.
+func VerifyBody(body, sig, pub []byte) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return errors.New("no valid public key registered")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), body, sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// Digest hashes the fields of m covered by its signature, everything but the
+// signature itself and the global and packed models and the deadline that
+// only servers send. The signing time is covered so a server can refuse old
+// messages.
+// gob output depends on the order types were first seen by a process, so the
+// fields are written out explicitly.
+func Digest(m Message) []byte {
+	d := digest{sha256.New()}
+	d.int(m.Id)
+	d.str(m.NodeIp)
+	d.str(m.NodeName)
+	d.str(string(m.Type))
+	d.int(m.C)
+	d.int(m.D)
+	r, c := m.Model.W.Dims()
+	d.int(r)
+	d.int(c)
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			d.float(m.Model.W.At(i, j))
+		}
+	}
+	d.int(m.Model.Deg)
+	d.float(m.Model.Lambda)
+	d.int(int(m.Model.Impute.Strategy))
+	d.floats(m.Model.Impute.Fill)
+	d.ints(m.Model.Impute.Flags)
+	d.bool(m.Model.Impute.Global)
+	d.str(m.Model.Labels.Neg)
+	d.str(m.Model.Labels.Pos)
+	d.ints(m.Stats.N)
+	d.floats(m.Stats.Sum)
+	d.floats(m.Stats.Median)
+	d.int(len(m.Schema.Columns))
+	for _, col := range m.Schema.Columns {
+		d.str(col.Name)
+		d.int(int(col.Type))
+	}
+	d.bool(m.Schema.Named)
+	d.str(m.Schema.Labels.Neg)
+	d.str(m.Schema.Labels.Pos)
+	d.int(m.Version)
+	d.str(m.Key)
+	d.str(string(m.PubKey))
+	d.int(int(m.SignedAt.Unix()))
+	d.int(m.SignedAt.Nanosecond())
+	return d.h.Sum(nil)
+}
+
+type digest struct {
+	h hash.Hash
+}
+
+func (d digest) int(v int) {
+	binary.Write(d.h, binary.BigEndian, int64(v))
+}
+
+func (d digest) float(v float64) {
+	binary.Write(d.h, binary.BigEndian, math.Float64bits(v))
+}
+
+func (d digest) bool(v bool) {
+	if v {
+		d.int(1)
+	} else {
+		d.int(0)
+	}
+}
+
+func (d digest) str(s string) {
+	d.int(len(s))
+	io.WriteString(d.h, s)
+}
+
+func (d digest) ints(v []int) {
+	d.int(len(v))
+	for _, x := range v {
+		d.int(x)
+	}
+}
+
+func (d digest) floats(v []float64) {
+	d.int(len(v))
+	for _, x := range v {
+		d.float(x)
+	}
+}
+
+// LoadKey reads a node's Ed25519 key from filename, a hex encoded seed. A
+// new key is created and saved there when the file doesn't exist yet.
+func LoadKey(filename string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(filename, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+		return key, err
+	} else if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", filename)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Message{Type: Heartbeat, NodeName: "node1"}
+	Sign(&m, key)
+	if err := Verify(m, pub); err != nil {
+		t.Fatalf("Verify of a signed message: %v", err)
+	}
+	if d := time.Since(m.SignedAt); d < 0 || d > time.Second {
+		t.Errorf("message signed at %v, not now", m.SignedAt)
+	}
+	// moving the signing time breaks the signature
+	moved := m
+	moved.SignedAt = moved.SignedAt.Add(time.Nanosecond)
+	if err := Verify(moved, pub); err == nil {
+		t.Errorf("Verify accepted a message whose signing time changed")
+	}
+	// each signature differs, so a resent message isn't taken for a replay
+	again := m
+	Sign(&again, key)
+	if string(again.Sig) == string(m.Sig) && again.SignedAt.Equal(m.SignedAt) {
+		t.Errorf("signing a message again gave the same signature")
+	}
+}
+
+func TestCheckTime(t *testing.T) {
+	defer func(d time.Duration) { SignWindow = d }(SignWindow)
+	SignWindow = time.Minute
+	now := time.Now()
+	tests := []struct {
+		at time.Time
+		ok bool
+	}{
+		{now, true},
+		{now.Add(-59 * time.Second), true},
+		{now.Add(59 * time.Second), true},
+		{now.Add(-61 * time.Second), false},
+		{now.Add(61 * time.Second), false},
+		{time.Time{}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckTime(tt.at, now); (err == nil) != tt.ok {
+			t.Errorf("CheckTime(%v) = %v, want ok %v", now.Sub(tt.at), err, tt.ok)
+		}
+	}
+}
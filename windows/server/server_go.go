@@ -2,273 +2,1513 @@ package main
 
 import (
 	"../bclass"
+	"../data"
+	"../history"
+	"../liveness"
+	"../mtls"
+	"../policy"
+	"../protocol"
+	"../wal"
 	"flag"
 	"fmt"
 	"github.com/arcaneiceman/GoVector/govec"
 	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
-const BUFFSIZE = 1048576
-
 var (
 	cnum      int = 0
 	maxnode   int = 0
 	myaddr    *net.TCPAddr
 	cnumhist  map[int]int
 	client    map[string]int
+	keys      map[int][]byte
+	hellos    map[int]protocol.Hello
+	live      *liveness.Tracker
+	replies   *protocol.Replies
+	replays   *protocol.Replays
+	sizes     map[int]int
 	claddr    map[int]*net.TCPAddr
+	outbox    map[int][]protocol.Message
+	wake      map[int]chan bool
 	tempmodel map[int]aggregate
 	testqueue map[int]map[int]bool
+	deadlines map[int]map[int]deadline
 	models    map[int]bclass.Model
 	modelC    map[int]int
 	modelD    int
-	channel   chan message
+	events    chan func()
 	logger    *govec.GoLog
-	l         *net.TCPListener
+	l         net.Listener
 	gmodel    bclass.GlobalModel
+	gversion  int
 	gempty    bclass.GlobalModel
+	sempty    bclass.ColumnStats
+	stats     map[int]bclass.ColumnStats
+	schempty  data.Schema
+	schema    data.Schema
+	journal   *wal.Log
+	commit    policy.Policy
+	versions  *history.History
+	operators map[string]bool
+	ttimeout  time.Duration
+	cpolicy   *string = flag.String("commit", policy.Default, "when a pending model is merged into the global model, e.g. coverage=0.6,accuracy=0.7|wait=10m")
+	datadir   *string = flag.String("data", "", "directory to keep the server state in and recover it from on restart (in memory only when empty)")
+	tlscert   *string = flag.String("tls-cert", "", "certificate file for mutual TLS (CN is the server name)")
+	tlskey    *string = flag.String("tls-key", "", "private key file for mutual TLS")
+	tlsca     *string = flag.String("tls-ca", "", "CA certificate file that signs the federation's certificates")
+	httpaddr  *string = flag.String("http", "", "address to serve the HTTP/JSON API on, e.g. :8080 (off when empty)")
+	opnames   *string = flag.String("operators", "", "comma separated names of the members allowed to roll the global model back (nobody when empty)")
+	tlimit    *string = flag.String("test-timeout", "2m", "how long a node has to answer a test request before it is left out of the coverage and sent again")
 )
 
+// required are the features nodes joining over TCP have to offer
+var required = []string{protocol.FeatureFrame, protocol.FeatureGovec, protocol.FeatureSigned, protocol.ModelBclass}
+
+// myhello is what this server speaks, it packs models for nodes that want
+// them packed
+var myhello = protocol.NewHello(append(required, protocol.PackFeatures...)...)
+
+// aggregate is a pending model, C and D count the committer's data and every
+// test of the model, Correct and Tested the tests of the other nodes only.
+// Rolled is set once an operator rolled the merged model back, it isn't
+// merged again as more test results come in
 type aggregate struct {
-	cnum  int
-	model bclass.Model
-	c     int
-	d     int
+	Cnum    int
+	Model   bclass.Model
+	C       int
+	D       int
+	Nodes   int
+	Correct int
+	Tested  int
+	Since   time.Time
+	Merged  bool
+	Rolled  bool
+}
+
+// deadline is when a node has to answer the test of a model by, Due, and when
+// the test was last sent to it. An expired test is left out of the coverage
+// and sent again while the node is active
+type deadline struct {
+	Due  time.Time
+	Sent time.Time
+}
+
+// outgoing is a message for node id with what sending it needs, taken from
+// the server state on the event loop so it can be sent off the loop. From is
+// the node whose model a test request carries
+type outgoing struct {
+	name  string
+	id    int
+	addr  *net.TCPAddr
+	hello protocol.Hello
+	from  int
+	msg   protocol.Message
 }
 
-type message struct {
-	Id       int
-	NodeIp   string
-	NodeName string
-	Type     string
-	C        int
-	D        int
-	Model    bclass.Model
-	GModel   bclass.GlobalModel
+// entry is a change of the server state as written to the log, joins carry
+// the protocol agreed with the node
+type entry struct {
+	Msg   protocol.Message
+	Hello protocol.Hello
+	At    time.Time
+}
+
+// saved is the server state as written to a snapshot
+type saved struct {
+	Cnum      int
+	Maxnode   int
+	Cnumhist  map[int]int
+	Client    map[string]int
+	Keys      map[int][]byte
+	Hellos    map[int]protocol.Hello
+	Sizes     map[int]int
+	Addrs     map[int]string
+	Tempmodel map[int]aggregate
+	Testqueue map[int]map[int]bool
+	Models    map[int]bclass.Model
+	ModelC    map[int]int
+	ModelD    int
+	Gversion  int
+	Schema    data.Schema
+	Replies   *protocol.Replies
+	History   *history.History
 }
 
 func main() {
 	//Initialize stuff
+	initState()
+	go loop()
+
+	//Parsing inputargs
+	parseArgs()
+
+	//Recover the federation from the data directory
+	if *datadir != "" {
+		do(recoverState)
+	}
+
+	//Initialize TCP Connection and listener
+	var err error
+	l, err = mtls.Listen(myaddr)
+	checkError(err)
+	fmt.Printf("Server initialized.\n")
+	fmt.Printf("--- Commit policy: %v.\n", commit)
+	go sweep()
+	go resendTests()
+	if *httpaddr != "" {
+		go serveHTTP(*httpaddr)
+	}
+
+	for {
+		conn, err := l.Accept()
+		checkError(err)
+		go connHandler(conn)
+	}
+
+}
+
+// Function that creates the empty server state, before the event loop runs
+func initState() {
 	client = make(map[string]int)
+	keys = make(map[int][]byte)
+	hellos = make(map[int]protocol.Hello)
+	live = liveness.NewTracker()
+	replies = protocol.NewReplies()
+	replays = protocol.NewReplays()
+	sizes = make(map[int]int)
 	claddr = make(map[int]*net.TCPAddr)
+	outbox = make(map[int][]protocol.Message)
+	wake = make(map[int]chan bool)
 	models = make(map[int]bclass.Model)
 	modelC = make(map[int]int)
 	modelD = 0
-	gmodel = bclass.GlobalModel{models, modelC, modelD}
+	gmodel = bclass.GlobalModel{ModelList: models, TestSize: modelC, D: modelD}
 	tempmodel = make(map[int]aggregate)
 	testqueue = make(map[int]map[int]bool)
+	deadlines = make(map[int]map[int]deadline)
 	cnumhist = make(map[int]int)
-	channel = make(chan message)
+	stats = make(map[int]bclass.ColumnStats)
+	versions = &history.History{}
+	events = make(chan func())
+}
 
-	go updateGlobal(channel)
+// The server state, from the maps above to the log, is owned by one event
+// loop. Connection handlers and the other goroutines hand it functions to
+// run with do, and keep signature checks, packing and sending off the loop,
+// working on copies taken on it. Functions documented to run on the event
+// loop must only be called within do, and never call do themselves.
 
-	//Parsing inputargs
-	parseArgs()
-
-	//Initialize TCP Connection and listener
-	l, _ = net.ListenTCP("tcp", myaddr)
-	fmt.Printf("Server initialized.\n")
+// Function that runs the functions handed to the event loop, one at a time
+func loop() {
+	for f := range events {
+		f()
+	}
+}
 
-	for {
-		conn, err := l.AcceptTCP()
-		checkError(err)
-		go connHandler(conn)
+// Function that runs f on the event loop and waits for it to finish
+func do(f func()) {
+	done := make(chan bool)
+	events <- func() {
+		f()
+		close(done)
 	}
+	<-done
+}
+
+// Function that looks up a node's id and registered key, from any goroutine
+func lookup(name string) (id int, key []byte, ok bool) {
+	do(func() {
+		id, ok = client[name]
+		key = keys[id]
+	})
+	return id, key, ok
+}
 
+// Function that reads a node's message, a join is preceded by the node's
+// hello, which has to be compatible before the join itself is decoded
+func receive(conn net.Conn) (protocol.Message, *protocol.Hello, error) {
+	hello, p, err := protocol.ReadFirst(conn)
+	if err != nil {
+		return protocol.Message{}, nil, err
+	}
+	if hello != nil {
+		agreed, err := protocol.Negotiate(*hello, myhello, required...)
+		if err != nil {
+			protocol.Reply(conn, protocol.Incompatible, err.Error())
+			return protocol.Message{}, nil, err
+		}
+		hello = &agreed
+	}
+	msg, err := protocol.ReceiveNext(conn, logger, p)
+	return msg, hello, err
 }
 
 // Function for handling client requests
-func connHandler(conn *net.TCPConn) {
-	var msg message
-	p := make([]byte, BUFFSIZE)
-	conn.Read(p)
-	logger.UnpackReceive("Received message", p, &msg)
+func connHandler(conn net.Conn) {
+	msg, agreed, err := receive(conn)
+	if err != nil {
+		fmt.Printf("*** Could not read message from %v: %v.\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if err := mtls.CheckPeer(conn, msg.NodeName); err != nil {
+		protocol.Reply(conn, protocol.Denied, err.Error())
+		fmt.Printf("--> Denied %v from %v: %v.\n", msg.Type, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if err := checkSignature(msg); err != nil {
+		protocol.Reply(conn, protocol.Denied, err.Error())
+		fmt.Printf("--> Denied %v from %v: %v.\n", msg.Type, msg.NodeName, err)
+		conn.Close()
+		return
+	}
+	if msg.Type != protocol.JoinRequest {
+		if err := checkAlive(msg.NodeName, msg.Type.Signed()); err != nil {
+			protocol.Reply(conn, protocol.Restart, err.Error())
+			fmt.Printf("--> Asked %v to rejoin: %v.\n", msg.NodeName, err)
+			conn.Close()
+			return
+		}
+	}
 	switch msg.Type {
-	case "commit_request":
+	case protocol.CommitRequest:
 		// node is sending a model, checking to see if testing is complete
-		flag := checkQueue(client[msg.NodeName])
 		fmt.Printf("<-- Received commit request from %v.\n", msg.NodeName)
-		if flag {
-			// accept commit from node and process outgoing test requests
-			processTestRequest(msg, conn)
-		} else {
-			//denied
-			conn.Write([]byte("Pending tests are not complete"))
-			fmt.Printf("--> Denied commit request from %v.\n", msg.NodeName)
+		if r, ok := resent(msg); ok {
+			protocol.Reply(conn, r.Code, r.Error)
 			conn.Close()
+			return
 		}
-	case "global_request":
-		//node is requesting the global model, will forward
-		conn.Write([]byte("OK"))
+		var code protocol.Code
+		var detail string
+		var tests []outgoing
+		do(func() { code, detail, tests = processCommit(msg) })
+		replies.Finish(msg.NodeName, msg.Key, protocol.Response{Code: code, Error: detail})
+		protocol.Reply(conn, code, detail)
+		conn.Close()
+		// process outgoing test requests
+		sendTests(tests)
+	case protocol.GlobalRequest:
+		//node is requesting the global model, it is sent back on the same connection
 		fmt.Printf("<-- Received global model request from %v.\n", msg.NodeName)
-		genGlobalModel()
-		sendGlobal(msg)
+		var o outgoing
+		do(func() { o = grant(msg) })
+		if o.msg.Version <= msg.Version {
+			protocol.Reply(conn, protocol.NotModified, "")
+			fmt.Printf("--> Global model version %v is current at %v.\n", o.msg.Version, msg.NodeName)
+		} else {
+			protocol.Reply(conn, protocol.OK, "")
+			sendGlobal(conn, o)
+		}
 		conn.Close()
-	case "test_complete":
+	case protocol.TestComplete:
 		// node is submitting test results, update testqueue on all replicas
 		fmt.Printf("<-- Received completed test results from %v.\n", msg.NodeName)
-		//update the pending commit and merge if complete
-		if testqueue[client[msg.NodeName]][cnumhist[msg.Id]] {
-			testqueue[client[msg.NodeName]][cnumhist[msg.Id]] = false
-			channel <- msg
-			conn.Write([]byte("OK"))
-		} else {
-			// if testqueue is already empty
-			conn.Write([]byte("Duplicate Test"))
-			fmt.Printf("--> Ignored test results from %v.\n", msg.NodeName)
+		if r, ok := resent(msg); ok {
+			protocol.Reply(conn, r.Code, r.Error)
+			conn.Close()
+			return
+		}
+		var code protocol.Code
+		do(func() { code = processResults(msg) })
+		replies.Finish(msg.NodeName, msg.Key, protocol.Response{Code: code})
+		protocol.Reply(conn, code, "")
+		conn.Close()
+	case protocol.StatsRequest:
+		// node is sharing column statistics, will forward the merged ones
+		protocol.Reply(conn, protocol.OK, "")
+		fmt.Printf("<-- Received column statistics from %v.\n", msg.NodeName)
+		var o *outgoing
+		do(func() {
+			stats[client[msg.NodeName]] = msg.Stats
+			o = sendStats(msg)
+		})
+		if o != nil {
+			tcpSend(o.addr, o.name, o.msg)
 		}
 		conn.Close()
-	case "join_request":
-		// node is requesting to join or rejoin
-		processJoin(msg)
-		conn.Write([]byte("Joined"))
+	case protocol.Heartbeat:
+		// node is alive, which checkAlive already noted
+		protocol.Reply(conn, protocol.OK, "")
+		conn.Close()
+	case protocol.PollRequest:
+		// node can't be dialed, hand it what is queued as soon as there is any
+		protocol.Reply(conn, protocol.OK, "")
+		id, _, _ := lookup(msg.NodeName)
+		protocol.SendBatch(conn, logger, waitQueued(id))
+		conn.Close()
+	case protocol.JoinRequest:
+		// node is requesting to join or rejoin, its protocol and data have to match the federation's
+		if agreed == nil {
+			protocol.Reply(conn, protocol.Incompatible, protocol.ErrNoHello.Error())
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, protocol.ErrNoHello)
+			conn.Close()
+			return
+		}
+		if err := checkJoinName(msg.NodeName); err != nil {
+			protocol.Reply(conn, protocol.Denied, err.Error())
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, err)
+			conn.Close()
+			return
+		}
+		var mismatch, err error
+		var tests []outgoing
+		do(func() {
+			if mismatch = checkSchema(msg.Schema); mismatch == nil {
+				tests, err = processJoin(msg, *agreed)
+			}
+		})
+		if mismatch != nil {
+			protocol.Reply(conn, protocol.SchemaMismatch, mismatch.Error())
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, mismatch)
+		} else if err != nil {
+			protocol.Reply(conn, protocol.Retry, "join could not be logged")
+		} else {
+			protocol.Reply(conn, protocol.Joined, "")
+			protocol.WriteHello(conn, *agreed)
+		}
 		conn.Close()
+		sendTests(tests)
 	default:
-		conn.Write([]byte("Unknown Request"))
+		protocol.Reply(conn, protocol.Unknown, string(msg.Type))
 		fmt.Printf("something weird happened!\n")
 		conn.Close()
 	}
 }
 
-func updateGlobal(ch chan message) {
-	// Function that aggregates the global model and commits when ready
-	for {
-		m := <-ch
-		id := cnumhist[m.Id]
-		tempAggregate := tempmodel[id]
-		tempAggregate.c += m.C
-		tempAggregate.d += m.D
-		tempmodel[id] = tempAggregate
-		if modelD < tempAggregate.d {
-			modelD = tempAggregate.d
+// Function that commits a pending model to the global model once it meets
+// the commit policy, m are the test results of the model or a check of the
+// server's own. Runs on the event loop
+func updateGlobal(m protocol.Message) {
+	id := cnumhist[m.Id]
+	tempAggregate := tempmodel[id]
+	if m.NodeName == "server" && tempAggregate.Merged {
+		// merged by test results since it was found waiting
+		return
+	}
+	if tempAggregate.Rolled {
+		return
+	}
+	p := progress(id, tempAggregate, time.Now())
+	if commit.Ready(p) {
+		merge := protocol.Message{Id: id, NodeIp: "server", NodeName: "server", Type: protocol.ModelMerged, D: p.Total}
+		if logEntry(merge, protocol.Hello{}) != nil {
+			return
 		}
-		if float64(tempAggregate.d) > float64(modelD)*0.6 {
-			models[id] = tempAggregate.model
-			modelC[id] = tempAggregate.c
-			t := time.Now()
-			logger.LogLocalEvent(fmt.Sprintf("%s - Committed model%v by %v at partial commit %v.", t.Format("15:04:05.0000"), id, client[m.NodeName], tempAggregate.d/modelD*100.0))
-			//logger.LogLocalEvent("commit_complete")
-			fmt.Printf("--- Committed model%v for commit number: %v.\n", id, tempAggregate.cnum)
+		t := time.Now()
+		protocol.LogEvent(logger, fmt.Sprintf("%s - Committed model%v by %v at partial commit %v.", t.Format("15:04:05.0000"), id, client[m.NodeName], 100*p.Coverage()))
+		//logger.LogLocalEvent("commit_complete")
+		fmt.Printf("--- Committed model%v for commit number: %v (%v).\n", id, tempAggregate.Cnum, p)
+	} else if m.NodeName != "server" {
+		fmt.Printf("--- Model%v waits for the commit policy: %v.\n", id, p)
+	}
+}
+
+// Function that sums up how far the validation of a pending model got, the
+// data of dead nodes that still owe its test is left out of the coverage
+func progress(id int, a aggregate, now time.Time) policy.Progress {
+	return policy.Progress{Covered: a.D, Total: modelD - deadD(id) - expiredD(id, now), Nodes: a.Nodes, Correct: a.Correct, Tested: a.Tested, Waited: now.Sub(a.Since)}
+}
+
+// Function that returns the commit numbers of the pending models not merged
+// yet, which time or dead nodes can make ready without new test results.
+// Runs on the event loop
+func waiting() []int {
+	var w []int
+	for _, a := range tempmodel {
+		if !a.Merged {
+			w = append(w, a.Cnum)
 		}
 	}
+	return w
 }
 
-// Generate global model from partial commits
+// Generate global model from partial commits, as a copy the event loop
+// doesn't change while it is sent
 func genGlobalModel() {
-	modelstemp := models
-	modelCtemp := modelC
+	modelstemp := make(map[int]bclass.Model, len(models))
+	for k, v := range models {
+		modelstemp[k] = v
+	}
+	modelCtemp := make(map[int]int, len(modelC))
+	for k, v := range modelC {
+		modelCtemp[k] = v
+	}
 	modelDtemp := modelD
-	gmodel = bclass.GlobalModel{modelstemp, modelCtemp, modelDtemp}
+	gmodel = bclass.GlobalModel{ModelList: modelstemp, TestSize: modelCtemp, D: modelDtemp}
 }
 
-// Function that generates test request following a commit request
-func processTestRequest(m message, conn *net.TCPConn) {
-	tempcnum := cnum
-	cnum++
-	cnumhist[tempcnum] = client[m.NodeName]
-	//initialize new aggregate
-	tempmodel[client[m.NodeName]] = aggregate{tempcnum, m.Model, m.C, m.D}
-	for _, id := range client {
-		if id != client[m.NodeName] {
-			if queue, ok := testqueue[id]; !ok {
-				queue := make(map[int]bool)
-				queue[cnumhist[tempcnum]] = true
-				testqueue[id] = queue
-			} else {
-				queue[cnumhist[tempcnum]] = true
-			}
-		}
+// Function that accepts a commit request once the node has no tests
+// outstanding, queues the test requests for the other nodes and returns
+// those to send. Runs on the event loop
+func processCommit(m protocol.Message) (protocol.Code, string, []outgoing) {
+	if err := checkModel(m.Model); err != nil {
+		fmt.Printf("--> Denied commit request from %v: %v.\n", m.NodeName, err)
+		return protocol.ModelMismatch, err.Error(), nil
 	}
+	if !checkQueue(client[m.NodeName]) {
+		fmt.Printf("--> Denied commit request from %v.\n", m.NodeName)
+		return protocol.Pending, "", nil
+	}
+	if err := logEntry(m, protocol.Hello{}); err != nil {
+		return protocol.Retry, "commit could not be logged", nil
+	}
+	tempcnum := tempmodel[client[m.NodeName]].Cnum
 	fmt.Printf("--- Processed commit %v for node %v.\n", tempcnum, m.NodeName)
-	conn.Write([]byte("OK"))
-	conn.Close()
+	return protocol.OK, "", testRequests(m, tempcnum)
+}
+
+// Function that claims the idempotency key of a commit or test results,
+// returning the earlier response when the node already sent the request
+func resent(m protocol.Message) (protocol.Response, bool) {
+	r, ok := replies.Start(m.NodeName, m.Key)
+	if !ok {
+		fmt.Printf("--> Answered resent %v from %v: %v.\n", m.Type, m.NodeName, r)
+	}
+	return r, !ok
+}
+
+// Function that returns the test requests of a commit for the other nodes.
+// Runs on the event loop
+func testRequests(m protocol.Message, tcnum int) []outgoing {
+	var out []outgoing
 	for name, id := range client {
 		if id != client[m.NodeName] {
-			sendTestRequest(name, id, tempcnum, m.Model)
+			out = append(out, testRequest(name, id, tcnum, m.Model)...)
 		}
 	}
+	return out
 }
 
-// Function that sends test requests via TCP
-func sendTestRequest(name string, id, tcnum int, tmodel bclass.Model) {
+// Function that records a node's test results, the pending commit is merged
+// once enough nodes tested it. Runs on the event loop
+func processResults(m protocol.Message) protocol.Code {
+	if !awaits(m.NodeName, m.Id) {
+		// if testqueue is already empty or the model was replaced
+		fmt.Printf("--> Ignored test results from %v.\n", m.NodeName)
+		return protocol.Duplicate
+	}
+	// the tested model isn't needed to replay the results
+	r := m
+	r.Model = bclass.Model{}
+	if logEntry(r, protocol.Hello{}) != nil {
+		return protocol.Retry
+	}
+	updateGlobal(m)
+	return protocol.OK
+}
+
+// Function that tells whether node name still has to test the model of
+// commit number cnum, results for a model its committer has since replaced
+// by a new commit are stale. Runs on the event loop
+func awaits(name string, cnum int) bool {
+	id := cnumhist[cnum]
+	return tempmodel[id].Cnum == cnum && testqueue[client[name]][id]
+}
+
+// Function that returns the test request for a node, none when the node is
+// dead or polls for its tests. Runs on the event loop
+func testRequest(name string, id, tcnum int, tmodel bclass.Model) []outgoing {
+	if !live.Alive(id) {
+		// the test stays queued until the node rejoins
+		fmt.Printf("--- Held back test request from %v for %v, it is dead.\n", cnumhist[tcnum], name)
+		return nil
+	}
+	if claddr[id] == nil {
+		// the node polls for its test requests
+		fmt.Printf("--- Queued test request from %v for %v.\n", cnumhist[tcnum], name)
+		notify(id)
+		return nil
+	}
 	//create test request (sanitized)
-	msg := message{tcnum, "server", "server", "test_request", 0, 0, tmodel, gempty}
-	//send the request
-	fmt.Printf("--> Sending test request from %v to %v.", cnumhist[tcnum], name)
-	err := tcpSend(claddr[id], msg)
-	if err != nil {
-		fmt.Printf(" [NO]\n*** Could not send test request to %v.\n", name)
+	msg := protocol.Message{Id: tcnum, NodeIp: "server", NodeName: "server", Type: protocol.TestRequest, Model: tmodel, Deadline: deadlines[id][cnumhist[tcnum]].Due}
+	return []outgoing{{name, id, claddr[id], hellos[id], cnumhist[tcnum], msg}}
+}
+
+// Function that sends test requests via TCP
+func sendTests(out []outgoing) {
+	for _, o := range out {
+		msg := pack(o.id, o.hello, o.msg)
+		//send the request
+		fmt.Printf("--> Sending test request from %v to %v.", o.from, o.name)
+		err := tcpSend(o.addr, o.name, msg)
+		if err != nil {
+			fmt.Printf(" [NO]\n*** Could not send test request to %v.\n", o.name)
+		}
 	}
 }
 
-// Function to forward global model
-func sendGlobal(m message) {
-	fmt.Printf("--> Sending global model to %v.", m.NodeName)
-	msg := message{m.Id, "server", "server", "global_grant", 0, 0, m.Model, gmodel}
-	tcpSend(claddr[client[m.NodeName]], msg)
+// Function that returns the answer to a global model request, with the
+// current model and its version. Runs on the event loop
+func grant(m protocol.Message) outgoing {
+	genGlobalModel()
+	id := client[m.NodeName]
+	msg := protocol.Message{Id: m.Id, NodeIp: "server", NodeName: "server", Type: protocol.GlobalGrant, Model: m.Model, GModel: gmodel, Version: gversion}
+	return outgoing{m.NodeName, id, claddr[id], hellos[id], id, msg}
 }
 
-// Function for sending messages to nodes via TCP
-func tcpSend(addr *net.TCPAddr, msg message) error {
-	p := make([]byte, BUFFSIZE)
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err == nil {
-		outbuf := logger.PrepareSend(msg.Type, msg)
-		_, err = conn.Write(outbuf)
-		//checkError(err)
-		n, _ := conn.Read(p)
-		if string(p[:n]) != "OK" {
-			fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", string(p[:n]))
-		} else {
-			fmt.Printf(" [OK]\n")
+// Function that answers a global model request with the model
+func sendGlobal(conn net.Conn, o outgoing) {
+	fmt.Printf("--> Sending global model version %v to %v.", o.msg.Version, o.name)
+	msg := pack(o.id, o.hello, o.msg)
+	if err := protocol.Send(conn, logger, msg); err != nil {
+		fmt.Printf(" [NO]\n*** Could not send global model: %v.\n", err)
+	} else {
+		fmt.Printf(" [OK]\n")
+	}
+}
+
+// Function that packs the models of a message for node id as h, agreed when
+// it joined, says, a message that can't be packed is sent whole
+func pack(id int, h protocol.Hello, msg protocol.Message) protocol.Message {
+	if err := protocol.Pack(&msg, h); err != nil {
+		fmt.Printf("*** Could not pack %v for node%v, sending it whole: %v.\n", msg.Type, id, err)
+	}
+	return msg
+}
+
+// Function to forward the column statistics merged over all nodes, they are
+// queued for a node that can't be dialed and returned to send otherwise.
+// Runs on the event loop
+func sendStats(m protocol.Message) *outgoing {
+	ids := make([]int, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	list := make([]bclass.ColumnStats, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, stats[id])
+	}
+	fmt.Printf("--> Sending column statistics to %v.", m.NodeName)
+	msg := protocol.Message{Id: m.Id, NodeIp: "server", NodeName: "server", Type: protocol.StatsGrant, Model: m.Model, Stats: bclass.MergeStats(list, schema.Width())}
+	id := client[m.NodeName]
+	if claddr[id] == nil {
+		outbox[id] = append(outbox[id], msg)
+		notify(id)
+		fmt.Printf(" [QUEUED]\n")
+		return nil
+	}
+	return &outgoing{m.NodeName, id, claddr[id], hellos[id], id, msg}
+}
+
+// Function that wakes a poll waiting for node id. Runs on the event loop
+func notify(id int) {
+	select {
+	case wake[id] <- true:
+	default:
+	}
+}
+
+// Function that returns the test requests a node still has to answer. Runs
+// on the event loop
+func pendingTests(id int) []protocol.Message {
+	var msgs []protocol.Message
+	for k, v := range testqueue[id] {
+		if v {
+			msgs = append(msgs, protocol.Message{Id: tempmodel[k].Cnum, NodeIp: "server", NodeName: "server", Type: protocol.TestRequest, Model: tempmodel[k].Model, Deadline: deadlines[id][k].Due})
+		}
+	}
+	return msgs
+}
+
+// Function that takes what is queued for a polling node, waiting up to
+// protocol.PollWait for something to arrive when nothing is
+func waitQueued(id int) []protocol.Message {
+	timeout := time.After(protocol.PollWait)
+	for {
+		var msgs []protocol.Message
+		var h protocol.Hello
+		var w chan bool
+		do(func() {
+			msgs = append(outbox[id], pendingTests(id)...)
+			delete(outbox, id)
+			h, w = hellos[id], wake[id]
+		})
+		for i := range msgs {
+			msgs[i] = pack(id, h, msgs[i])
+		}
+		if len(msgs) > 0 {
+			fmt.Printf("--> Handing %v queued messages to node%v.\n", len(msgs), id)
+			return msgs
+		}
+		select {
+		case <-w:
+		case <-timeout:
+			return nil
 		}
 	}
+}
+
+// Function for sending messages to node name via TCP
+func tcpSend(addr *net.TCPAddr, name string, msg protocol.Message) error {
+	if addr == nil {
+		fmt.Printf(" [NO]\n*** Node has no address, it polls for its messages.\n")
+		return fmt.Errorf("node has no address")
+	}
+	r, err := protocol.Request(addr, name, logger, msg)
+	if err != nil {
+		fmt.Printf(" [NO]\n*** No reply from node: %v.\n", err)
+	} else if !r.Accepted() {
+		fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", r)
+	} else {
+		fmt.Printf(" [OK]\n")
+	}
 	return err
 }
 
-// Function that checks the testqueue for outstanding tests
+// Function that checks the testqueue for outstanding tests. Runs on the
+// event loop
 func checkQueue(id int) bool {
 	flag := true
-	for _, v := range testqueue[id] {
-		if flag && v {
+	now := time.Now()
+	for k, v := range testqueue[id] {
+		if flag && v && !expired(id, k, now) {
 			flag = false
 		}
 	}
 	return flag
 }
 
-// Function that processes join requests
-func processJoin(m message) {
+// Function that records that a member was heard from, only signed messages
+// count, and refuses anything but a join from a node declared dead
+func checkAlive(name string, signed bool) error {
+	id, _, ok := lookup(name)
+	if !ok {
+		return nil
+	}
+	if !live.Alive(id) {
+		return fmt.Errorf("node%v was declared dead, join again", id)
+	}
+	if signed {
+		live.Beat(id)
+	}
+	return nil
+}
+
+// Function that marks nodes that went silent as suspect or dead, and has
+// the models still waiting checked against the commit policy
+func sweep() {
+	for {
+		time.Sleep(liveness.Interval)
+		for id, s := range live.Sweep() {
+			fmt.Printf("--- node%v is %v.\n", id, s)
+		}
+		var out []outgoing
+		do(func() {
+			for _, k := range waiting() {
+				// has updateGlobal merge the model if it is ready
+				updateGlobal(protocol.Message{Id: k, NodeIp: "server", NodeName: "server", Type: protocol.ModelMerged})
+			}
+			out = retryTests(time.Now())
+		})
+		sendTests(out)
+	}
+}
+
+// Function that returns the amount of data of dead nodes that still owe the
+// test of node id's model, which is left out of the quorum for its partial
+// commit. Dead nodes that tested it count as usual. Runs on the event loop
+func deadD(id int) int {
+	d := 0
+	for v, n := range sizes {
+		if !live.Alive(v) && testqueue[v][id] {
+			d += n
+		}
+	}
+	return d
+}
+
+// Function that gives node id until the test timeout after at to answer the
+// test of the model of node k. Runs on the event loop
+func setDeadline(id, k int, at time.Time) {
+	if deadlines[id] == nil {
+		deadlines[id] = make(map[int]deadline)
+	}
+	deadlines[id][k] = deadline{at.Add(ttimeout), at}
+}
+
+// Function that notes the test of the model of node k was sent to node id
+// again, its deadline stays. Runs on the event loop
+func markSent(id, k int, now time.Time) {
+	if d, ok := deadlines[id][k]; ok {
+		d.Sent = now
+		deadlines[id][k] = d
+	}
+}
+
+// Function that reports whether node id missed the deadline of its test of
+// the model of node k. Runs on the event loop
+func expired(id, k int, now time.Time) bool {
+	d, ok := deadlines[id][k]
+	return testqueue[id][k] && ok && now.After(d.Due)
+}
+
+// Function that returns the amount of data of live nodes that missed the
+// deadline of their test of node id's model, which is left out of the
+// quorum for its partial commit. Runs on the event loop
+func expiredD(id int, now time.Time) int {
+	d := 0
+	for v := range testqueue {
+		if live.Alive(v) && expired(v, id, now) {
+			d += sizes[v]
+		}
+	}
+	return d
+}
+
+// Function that sends expired tests again to the active nodes that owe them,
+// at most once per test timeout, so a node that missed a test or came back
+// from being suspect answers it after all. Runs on the event loop
+func retryTests(now time.Time) []outgoing {
+	var out []outgoing
+	for name, id := range client {
+		if live.State(id) != liveness.Active {
+			continue
+		}
+		for k, d := range deadlines[id] {
+			if expired(id, k, now) && now.Sub(d.Sent) >= ttimeout {
+				fmt.Printf("--- node%v missed the deadline of its test of model%v, sending it again.\n", id, k)
+				markSent(id, k, now)
+				out = append(out, testRequest(name, id, tempmodel[k].Cnum, tempmodel[k].Model)...)
+			}
+		}
+	}
+	return out
+}
+
+// Function that checks the name a node joins with, the common name of the
+// servers' certificates is reserved so no node can pass for a server
+func checkJoinName(name string) error {
+	if name == mtls.ServerName {
+		return fmt.Errorf("node name %q is reserved for the servers", name)
+	}
+	return nil
+}
+
+// Function that checks a joining node's data schema against the federation's,
+// the first node to join fixes the schema. Runs on the event loop
+func checkSchema(sc data.Schema) error {
+	if sc.Empty() {
+		return fmt.Errorf("join request carries no data schema")
+	}
+	if schema.Empty() {
+		return nil
+	}
+	return sc.Check(schema)
+}
+
+// Function that checks a committed model's dimensions and labels against the
+// federation schema. Runs on the event loop
+func checkModel(m bclass.Model) error {
+	if schema.Empty() {
+		return fmt.Errorf("no federation schema")
+	}
+	return schema.CheckModel(m)
+}
+
+// Function that checks the signature of a message that changes server state,
+// a new node signs its join with the key it registers, members with the
+// registered key. A signature is only accepted once and while it is recent
+func checkSignature(m protocol.Message) error {
+	if !m.Type.Signed() {
+		return nil
+	}
+	key := m.PubKey
+	if _, k, ok := lookup(m.NodeName); ok {
+		key = k
+	} else if m.Type != protocol.JoinRequest {
+		return fmt.Errorf("%v has not joined", m.NodeName)
+	}
+	if err := protocol.Verify(m, key); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := protocol.CheckTime(m.SignedAt, now); err != nil {
+		return fmt.Errorf("message was %v", err)
+	}
+	return replays.Check(m.Sig, now)
+}
+
+// Function that processes join requests, h is the protocol agreed on, and
+// returns the test requests to send the node. Runs on the event loop
+func processJoin(m protocol.Message, h protocol.Hello) ([]outgoing, error) {
+	id, known := client[m.NodeName]
+	// the node's model isn't needed to replay the join
+	m.Model = bclass.Model{}
+	if err := logEntry(m, h); err != nil {
+		return nil, err
+	}
+	var out []outgoing
 	//process depending on if it is a new node or a returning one
-	if _, ok := client[m.NodeName]; !ok {
+	if !known {
 		//adding a node that has never been added before
-		id := maxnode
-		maxnode++
-		client[m.NodeName] = id
-		claddr[id], _ = net.ResolveTCPAddr("tcp", m.NodeIp)
+		id = client[m.NodeName]
 		fmt.Printf("--- Added %v as node%v.\n", m.NodeName, id)
-		queue := make(map[int]bool)
-		for k, _ := range tempmodel {
-			queue[k] = true
-		}
-		testqueue[id] = queue
 		for _, v := range tempmodel {
-			sendTestRequest(m.NodeName, id, v.cnum, v.model)
+			out = append(out, testRequest(m.NodeName, id, v.Cnum, v.Model)...)
 		}
 	} else {
-		//node is rejoining, update address and resend the unfinished test requests
-		id := client[m.NodeName]
-		claddr[id], _ = net.ResolveTCPAddr("tcp", m.NodeIp)
+		//node is rejoining, resend the unfinished test requests
 		fmt.Printf("--- %v at node%v is back online.\n", m.NodeName, id)
 		for k, v := range testqueue[id] {
 			if v {
 				aggregatesendtest := tempmodel[k]
-				sendTestRequest(m.NodeName, id, aggregatesendtest.cnum, aggregatesendtest.model)
+				markSent(id, k, time.Now())
+				out = append(out, testRequest(m.NodeName, id, aggregatesendtest.Cnum, aggregatesendtest.Model)...)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Function that writes a change of the server state to the log and applies
+// it, without a data directory it is only applied. A snapshot replaces the
+// log once it grew long enough. Runs on the event loop
+func logEntry(m protocol.Message, h protocol.Hello) error {
+	e := entry{m, h, time.Now()}
+	if journal != nil {
+		if err := journal.Append(e); err != nil {
+			fmt.Printf("*** Could not log %v from %v: %v.\n", m.Type, m.NodeName, err)
+			return err
+		}
+	}
+	apply(e)
+	if journal != nil && journal.Due() {
+		if err := journal.Snapshot(save()); err != nil {
+			fmt.Printf("*** Could not write snapshot: %v.\n", err)
+		}
+	}
+	return nil
+}
+
+// Function that applies a change of the server state, as it happens and when
+// the log is replayed after a restart, so it changes nothing but the state
+func apply(e entry) {
+	m := e.Msg
+	switch m.Type {
+	case protocol.JoinRequest:
+		if schema.Empty() {
+			schema = m.Schema
+			fmt.Printf("--- Federation schema set by %v: %v features, labels %v.\n", m.NodeName, schema.Width(), schema.Labels)
+		}
+		id, ok := client[m.NodeName]
+		if !ok {
+			id = maxnode
+			maxnode++
+			client[m.NodeName] = id
+			keys[id] = m.PubKey
+			wake[id] = make(chan bool, 1)
+			queue := make(map[int]bool)
+			for k, _ := range tempmodel {
+				queue[k] = true
+				setDeadline(id, k, e.At)
+			}
+			testqueue[id] = queue
+		}
+		claddr[id] = nodeAddr(m.NodeIp)
+		hellos[id] = e.Hello
+		live.Beat(id)
+	case protocol.CommitRequest:
+		sizes[client[m.NodeName]] = m.D
+		tempcnum := cnum
+		cnum++
+		cnumhist[tempcnum] = client[m.NodeName]
+		//initialize new aggregate
+		tempmodel[client[m.NodeName]] = aggregate{tempcnum, m.Model, m.C, m.D, 0, 0, 0, e.At, false, false}
+		for _, id := range client {
+			if id != client[m.NodeName] {
+				if queue, ok := testqueue[id]; !ok {
+					queue := make(map[int]bool)
+					queue[cnumhist[tempcnum]] = true
+					testqueue[id] = queue
+				} else {
+					queue[cnumhist[tempcnum]] = true
+				}
+				setDeadline(id, cnumhist[tempcnum], e.At)
+			}
+		}
+	case protocol.TestComplete:
+		if !awaits(m.NodeName, m.Id) {
+			return
+		}
+		testqueue[client[m.NodeName]][cnumhist[m.Id]] = false
+		delete(deadlines[client[m.NodeName]], cnumhist[m.Id])
+		sizes[client[m.NodeName]] = m.D
+		id := cnumhist[m.Id]
+		tempAggregate := tempmodel[id]
+		tempAggregate.C += m.C
+		tempAggregate.D += m.D
+		tempAggregate.Nodes++
+		tempAggregate.Correct += m.C
+		tempAggregate.Tested += m.D
+		tempmodel[id] = tempAggregate
+		if modelD < tempAggregate.D {
+			modelD = tempAggregate.D
+		}
+	case protocol.ModelMerged:
+		tempAggregate := tempmodel[m.Id]
+		tempAggregate.Merged = true
+		tempmodel[m.Id] = tempAggregate
+		models[m.Id] = tempAggregate.Model
+		modelC[m.Id] = tempAggregate.C
+		p := policy.Progress{Covered: tempAggregate.D, Total: m.D, Nodes: tempAggregate.Nodes, Correct: tempAggregate.Correct, Tested: tempAggregate.Tested, Waited: e.At.Sub(tempAggregate.Since)}
+		// a commit merged again with more test results keeps its version
+		if _, made := versions.Merge(history.Version{Node: m.Id, Cnum: tempAggregate.Cnum, At: e.At, C: tempAggregate.C, Progress: p, Model: tempAggregate.Model}, gversion+1); made {
+			gversion++
+		}
+	case protocol.Rollback:
+		if m.Version > 0 {
+			to, ok := versions.Global(m.Version)
+			if !ok {
+				return
+			}
+			for id := range models {
+				delete(models, id)
+				delete(modelC, id)
+			}
+			for id, seq := range to.Nodes {
+				v, _ := versions.Model(seq)
+				models[id] = v.Model
+				modelC[id] = v.C
+			}
+			gversion++
+			g := versions.RollbackGlobal(to, gversion, e.At)
+			for id, a := range tempmodel {
+				if a.Merged {
+					seq, ok := g.Nodes[id]
+					a.Rolled = !ok || versions.Models[seq-1].Cnum != a.Cnum
+					tempmodel[id] = a
+				}
+			}
+		} else {
+			v, ok := versions.Model(m.Id)
+			if !ok {
+				return
+			}
+			models[v.Node] = v.Model
+			modelC[v.Node] = v.C
+			gversion++
+			versions.RollbackModel(v, gversion, e.At)
+			if a, ok := tempmodel[v.Node]; ok && a.Merged {
+				a.Rolled = a.Cnum != v.Cnum
+				tempmodel[v.Node] = a
+			}
+		}
+	}
+}
+
+// Function that restores the server state from the data directory, the last
+// snapshot and every change logged since. Runs on the event loop
+func recoverState() {
+	var err error
+	journal, err = wal.Open(*datadir)
+	checkError(err)
+	var s saved
+	found, err := journal.ReadSnapshot(&s)
+	checkError(err)
+	if found {
+		restore(s)
+	}
+	n, err := journal.Replay(replay)
+	checkError(err)
+	if journal.Torn > 0 {
+		fmt.Printf("*** Dropped %v bytes of a change cut short by a crash.\n", journal.Torn)
+	}
+	if found || n > 0 {
+		fmt.Printf("--- Recovered %v nodes, %v pending models and global model version %v from %v.\n", len(client), len(tempmodel), gversion, *datadir)
+	}
+}
+
+// Function that applies a logged change, commits and test results were
+// answered OK, which is remembered for their idempotency keys
+func replay(r wal.Record) error {
+	var e entry
+	if err := r.Decode(&e); err != nil {
+		return err
+	}
+	if _, ok := replies.Start(e.Msg.NodeName, e.Msg.Key); ok {
+		replies.Finish(e.Msg.NodeName, e.Msg.Key, protocol.Response{Code: protocol.OK})
+	}
+	apply(e)
+	return nil
+}
+
+// Function that returns the server state for a snapshot
+func save() saved {
+	addrs := make(map[int]string)
+	for id, a := range claddr {
+		if a != nil {
+			addrs[id] = a.String()
+		}
+	}
+	return saved{cnum, maxnode, cnumhist, client, keys, hellos, sizes, addrs, tempmodel, testqueue, models, modelC, modelD, gversion, schema, replies, versions}
+}
+
+// Function that takes over the server state of a snapshot, every node counts
+// as alive until it goes silent
+func restore(s saved) {
+	cnum, maxnode, modelD, gversion, schema = s.Cnum, s.Maxnode, s.ModelD, s.Gversion, s.Schema
+	for k, v := range s.Cnumhist {
+		cnumhist[k] = v
+	}
+	for name, id := range s.Client {
+		client[name] = id
+		wake[id] = make(chan bool, 1)
+		live.Beat(id)
+	}
+	for id, v := range s.Keys {
+		keys[id] = v
+	}
+	for id, v := range s.Hellos {
+		hellos[id] = v
+	}
+	for id, v := range s.Sizes {
+		sizes[id] = v
+	}
+	for id, v := range s.Addrs {
+		claddr[id] = nodeAddr(v)
+	}
+	for id, v := range s.Tempmodel {
+		tempmodel[id] = v
+	}
+	for id, v := range s.Testqueue {
+		if v == nil {
+			v = make(map[int]bool)
+		}
+		testqueue[id] = v
+	}
+	for id, v := range s.Models {
+		models[id] = v
+	}
+	for id, v := range s.ModelC {
+		modelC[id] = v
+	}
+	if s.Replies != nil {
+		replies = s.Replies
+	}
+	if s.History != nil {
+		versions = s.History
+	}
+}
+
+// Function that sends the test requests still pending after a restart, those
+// sent before may have been lost. Nodes answer tests they already did with
+// results the server recognizes as duplicates
+func resendTests() {
+	var out []outgoing
+	do(func() {
+		now := time.Now()
+		for name, id := range client {
+			for k, v := range testqueue[id] {
+				if v {
+					// deadlines start over, like liveness
+					setDeadline(id, k, now)
+					out = append(out, testRequest(name, id, tempmodel[k].Cnum, tempmodel[k].Model)...)
+				}
+			}
+		}
+	})
+	sendTests(out)
+}
+
+// Function that resolves the address a node listens on, nil for nodes that
+// poll instead
+func nodeAddr(ip string) *net.TCPAddr {
+	if ip == "" {
+		return nil
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", ip)
+	return addr
+}
+
+// Function that serves the HTTP/JSON API next to the TCP protocol
+func serveHTTP(addr string) {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	checkError(err)
+	hl, err := mtls.Listen(a)
+	checkError(err)
+	fmt.Printf("HTTP API listening on %v.\n", hl.Addr())
+	checkError(http.Serve(hl, apiMux()))
+}
+
+// Function that routes the paths of the HTTP/JSON API to their handlers
+func apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/join", httpJoin)
+	mux.HandleFunc("/v1/commit", httpCommit)
+	mux.HandleFunc("/v1/results", httpResults)
+	mux.HandleFunc("/v1/tests", httpTests)
+	mux.HandleFunc("/v1/global", httpGlobal)
+	mux.HandleFunc("/v1/heartbeat", httpHeartbeat)
+	mux.HandleFunc("/v1/status", httpStatus)
+	mux.HandleFunc("/v1/history", httpHistory)
+	mux.HandleFunc("/v1/diff", httpDiff)
+	mux.HandleFunc("/v1/rollback", httpRollback)
+	return mux
+}
+
+// Function that authenticates an HTTP request from node name by its client
+// certificate and its signature, a new node signs its join with the key it
+// registers. A signature is only accepted once
+func checkHTTP(r *http.Request, name string, signed, sig, newkey []byte) error {
+	if err := mtls.CheckRequest(r, name); err != nil {
+		return err
+	}
+	key := newkey
+	if _, k, ok := lookup(name); ok {
+		key = k
+	} else if newkey == nil {
+		return fmt.Errorf("%v has not joined", name)
+	}
+	if err := protocol.VerifyBody(signed, sig, key); err != nil {
+		return err
+	}
+	return replays.Check(sig, time.Now())
+}
+
+// Function that rolls the global model back as an operator asked, to model
+// version m.Id of one node or to global model version m.Version. Runs on the
+// event loop
+func processRollback(m protocol.Message) (protocol.Code, string) {
+	if !operators[m.NodeName] {
+		return protocol.Denied, fmt.Sprintf("%v is not an operator", m.NodeName)
+	}
+	if m.Version > 0 {
+		if _, ok := versions.Global(m.Version); !ok {
+			return protocol.Denied, fmt.Sprintf("global model version %v is not in the history", m.Version)
+		}
+	} else if _, ok := versions.Model(m.Id); !ok {
+		return protocol.Denied, fmt.Sprintf("model version %v is not in the history", m.Id)
+	}
+	if logEntry(m, protocol.Hello{}) != nil {
+		return protocol.Retry, "rollback could not be logged"
+	}
+	g, _ := versions.Global(gversion)
+	t := time.Now()
+	protocol.LogEvent(logger, fmt.Sprintf("%s - Global model version %v %v by %v.", t.Format("15:04:05.0000"), gversion, g.Reason, m.NodeName))
+	fmt.Printf("--- Global model version %v %v by %v.\n", gversion, g.Reason, m.NodeName)
+	return protocol.OK, ""
+}
+
+// Function that handles HTTP join requests
+func httpJoin(w http.ResponseWriter, r *http.Request) {
+	var b protocol.JoinBody
+	signed, sig, err := protocol.ReadBody(r, &b)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	fmt.Printf("<-- Received HTTP join request from %v.\n", b.Name)
+	if err := checkHTTP(r, b.Name, signed, sig, b.PubKey); err != nil {
+		fmt.Printf("--> Denied join request from %v: %v.\n", b.Name, err)
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	// JSON needs neither frames nor GoVector
+	err = protocol.ErrNoHello
+	var agreed protocol.Hello
+	if b.Hello.Proto > 0 {
+		agreed, err = protocol.Negotiate(b.Hello, myhello, protocol.FeatureSigned, protocol.ModelBclass)
+	}
+	if err != nil {
+		fmt.Printf("--> Denied join request from %v: %v.\n", b.Name, err)
+		protocol.WriteResponse(w, protocol.Incompatible, err.Error())
+		return
+	}
+	if err := checkJoinName(b.Name); err != nil {
+		fmt.Printf("--> Denied join request from %v: %v.\n", b.Name, err)
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	var mismatch error
+	var tests []outgoing
+	do(func() {
+		if mismatch = checkSchema(b.Schema); mismatch == nil {
+			tests, err = processJoin(protocol.Message{NodeIp: b.Addr, NodeName: b.Name, Type: protocol.JoinRequest, Schema: b.Schema, PubKey: b.PubKey, Sig: sig}, agreed)
+		}
+	})
+	if mismatch != nil {
+		fmt.Printf("--> Denied join request from %v: %v.\n", b.Name, mismatch)
+		protocol.WriteResponse(w, protocol.SchemaMismatch, mismatch.Error())
+		return
+	}
+	if err != nil {
+		protocol.WriteResponse(w, protocol.Retry, "join could not be logged")
+		return
+	}
+	protocol.WriteJSON(w, http.StatusOK, protocol.JoinReply{Code: protocol.Joined, Hello: agreed})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	sendTests(tests)
+}
+
+// Function that handles HTTP commit requests
+func httpCommit(w http.ResponseWriter, r *http.Request) {
+	var b protocol.CommitBody
+	signed, sig, err := protocol.ReadBody(r, &b)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	fmt.Printf("<-- Received HTTP commit request from %v.\n", b.Name)
+	if err := checkHTTP(r, b.Name, signed, sig, nil); err != nil {
+		fmt.Printf("--> Denied commit request from %v: %v.\n", b.Name, err)
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	if err := checkAlive(b.Name, true); err != nil {
+		protocol.WriteResponse(w, protocol.Restart, err.Error())
+		return
+	}
+	msg := protocol.Message{NodeName: b.Name, Type: protocol.CommitRequest, C: b.C, D: b.D, Model: b.Model, Key: b.Key, Sig: sig}
+	if r, ok := resent(msg); ok {
+		protocol.WriteResponse(w, r.Code, r.Error)
+		return
+	}
+	var code protocol.Code
+	var detail string
+	var tests []outgoing
+	do(func() { code, detail, tests = processCommit(msg) })
+	replies.Finish(msg.NodeName, msg.Key, protocol.Response{Code: code, Error: detail})
+	protocol.WriteResponse(w, code, detail)
+	if code == protocol.OK {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		sendTests(tests)
+	}
+}
+
+// Function that handles HTTP test results
+func httpResults(w http.ResponseWriter, r *http.Request) {
+	var b protocol.ResultBody
+	signed, sig, err := protocol.ReadBody(r, &b)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	fmt.Printf("<-- Received HTTP test results from %v.\n", b.Name)
+	if err := checkHTTP(r, b.Name, signed, sig, nil); err != nil {
+		fmt.Printf("--> Denied test results from %v: %v.\n", b.Name, err)
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	if err := checkAlive(b.Name, true); err != nil {
+		protocol.WriteResponse(w, protocol.Restart, err.Error())
+		return
+	}
+	msg := protocol.Message{Id: b.Id, NodeName: b.Name, Type: protocol.TestComplete, C: b.C, D: b.D, Key: b.Key, Sig: sig}
+	if r, ok := resent(msg); ok {
+		protocol.WriteResponse(w, r.Code, r.Error)
+		return
+	}
+	var code protocol.Code
+	do(func() { code = processResults(msg) })
+	replies.Finish(msg.NodeName, msg.Key, protocol.Response{Code: code})
+	protocol.WriteResponse(w, code, "")
+}
+
+// Function that lists the test requests a node still has to answer
+func httpTests(w http.ResponseWriter, r *http.Request) {
+	name, signed, sig, err := protocol.ReadQuery(r)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	if err := checkHTTP(r, name, signed, sig, nil); err != nil {
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	if err := checkAlive(name, true); err != nil {
+		protocol.WriteResponse(w, protocol.Restart, err.Error())
+		return
+	}
+	tests := make([]protocol.TestItem, 0)
+	do(func() {
+		for _, m := range pendingTests(client[name]) {
+			tests = append(tests, protocol.TestItem{Id: m.Id, Model: m.Model, Deadline: deadlines[client[name]][cnumhist[m.Id]].Due})
+		}
+	})
+	protocol.WriteJSON(w, http.StatusOK, tests)
+}
+
+// Function that sends the global model to a node over HTTP
+func httpGlobal(w http.ResponseWriter, r *http.Request) {
+	name, signed, sig, err := protocol.ReadQuery(r)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	if err := checkHTTP(r, name, signed, sig, nil); err != nil {
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	if err := checkAlive(name, true); err != nil {
+		protocol.WriteResponse(w, protocol.Restart, err.Error())
+		return
+	}
+	fmt.Printf("<-- Received HTTP global model request from %v.\n", name)
+	var version int
+	var model bclass.GlobalModel
+	do(func() {
+		genGlobalModel()
+		version, model = gversion, gmodel
+	})
+	if v := r.Header.Get(protocol.NewerHeader); v != "" {
+		newer, err := strconv.Atoi(v)
+		if err != nil {
+			protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: protocol.NewerHeader + ": " + err.Error()})
+			return
+		}
+		if version <= newer {
+			protocol.WriteResponse(w, protocol.NotModified, "")
+			return
+		}
+	}
+	protocol.WriteJSON(w, http.StatusOK, protocol.GlobalBody{Version: version, Model: model})
+}
+
+// Function that handles HTTP heartbeats
+func httpHeartbeat(w http.ResponseWriter, r *http.Request) {
+	name, signed, sig, err := protocol.ReadQuery(r)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	if err := checkHTTP(r, name, signed, sig, nil); err != nil {
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	if err := checkAlive(name, true); err != nil {
+		protocol.WriteResponse(w, protocol.Restart, err.Error())
+		return
+	}
+	protocol.WriteResponse(w, protocol.OK, "")
+}
+
+// Function that reports the commit policy and how far each pending model got
+func httpStatus(w http.ResponseWriter, r *http.Request) {
+	name, signed, sig, err := protocol.ReadQuery(r)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	if err := checkHTTP(r, name, signed, sig, nil); err != nil {
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	var status protocol.StatusBody
+	do(func() {
+		status = protocol.StatusBody{Policy: commit.String(), Version: gversion, Pending: make([]protocol.PendingItem, 0, len(tempmodel))}
+		now := time.Now()
+		for id, a := range tempmodel {
+			status.Pending = append(status.Pending, protocol.PendingItem{Id: id, Cnum: a.Cnum, Merged: a.Merged, Progress: progress(id, a, now)})
+		}
+	})
+	sort.Slice(status.Pending, func(i, j int) bool { return status.Pending[i].Id < status.Pending[j].Id })
+	protocol.WriteJSON(w, http.StatusOK, status)
+}
+
+// Function that lists the model versions, only those of one node with
+// node=id, and the global model versions
+func httpHistory(w http.ResponseWriter, r *http.Request) {
+	name, signed, sig, err := protocol.ReadQuery(r)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	if err := checkHTTP(r, name, signed, sig, nil); err != nil {
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	node := -1
+	if v := r.URL.Query().Get("node"); v != "" {
+		if node, err = strconv.Atoi(v); err != nil || node < 0 {
+			protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: fmt.Sprintf("node %q is not a node id", v)})
+			return
+		}
+	}
+	var h protocol.HistoryBody
+	do(func() {
+		h = protocol.HistoryBody{Version: gversion, Models: make([]protocol.VersionItem, 0, len(versions.Models)), Globals: append([]history.Global(nil), versions.Globals...)}
+		for _, v := range versions.Models {
+			if node < 0 || v.Node == node {
+				h.Models = append(h.Models, protocol.Item(v))
 			}
 		}
+	})
+	protocol.WriteJSON(w, http.StatusOK, h)
+}
+
+// Function that compares the validation of model versions from and to
+func httpDiff(w http.ResponseWriter, r *http.Request) {
+	name, signed, sig, err := protocol.ReadQuery(r)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	if err := checkHTTP(r, name, signed, sig, nil); err != nil {
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	from, err1 := strconv.Atoi(r.URL.Query().Get("from"))
+	to, err2 := strconv.Atoi(r.URL.Query().Get("to"))
+	if err1 != nil || err2 != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: "from and to have to be model versions"})
+		return
+	}
+	var a, b history.Version
+	var oka, okb bool
+	do(func() {
+		a, oka = versions.Model(from)
+		b, okb = versions.Model(to)
+	})
+	if !oka || !okb {
+		missing := from
+		if oka {
+			missing = to
+		}
+		protocol.WriteResponse(w, protocol.Denied, fmt.Sprintf("model version %v is not in the history", missing))
+		return
 	}
+	protocol.WriteJSON(w, http.StatusOK, protocol.DiffBody{From: protocol.Item(a), To: protocol.Item(b), Delta: history.Diff(a, b)})
+}
+
+// Function that handles HTTP rollbacks by operators
+func httpRollback(w http.ResponseWriter, r *http.Request) {
+	var b protocol.RollbackBody
+	signed, sig, err := protocol.ReadBody(r, &b)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: err.Error()})
+		return
+	}
+	fmt.Printf("<-- Received HTTP rollback from %v.\n", b.Name)
+	if err := checkHTTP(r, b.Name, signed, sig, nil); err != nil {
+		fmt.Printf("--> Denied rollback from %v: %v.\n", b.Name, err)
+		protocol.WriteResponse(w, protocol.Denied, err.Error())
+		return
+	}
+	if b.Seq <= 0 && b.Global <= 0 {
+		protocol.WriteJSON(w, http.StatusBadRequest, protocol.Response{Code: protocol.Denied, Error: "rollback needs a model version Seq or a global model version Global"})
+		return
+	}
+	msg := protocol.Message{Id: b.Seq, NodeName: b.Name, Type: protocol.Rollback, Version: b.Global, Sig: sig}
+	var code protocol.Code
+	var detail string
+	do(func() { code, detail = processRollback(msg) })
+	if code != protocol.OK {
+		fmt.Printf("--> Denied rollback from %v: %v.\n", b.Name, detail)
+	}
+	protocol.WriteResponse(w, code, detail)
 }
 
 // Input parser
@@ -276,6 +1516,20 @@ func parseArgs() {
 	flag.Parse()
 	inputargs := flag.Args()
 	var err error
+	checkError(mtls.Setup(*tlscert, *tlskey, *tlsca))
+	commit, err = policy.Parse(*cpolicy)
+	checkError(err)
+	ttimeout, err = time.ParseDuration(*tlimit)
+	if err == nil && ttimeout <= 0 {
+		err = fmt.Errorf("test timeout %v is not positive", ttimeout)
+	}
+	checkError(err)
+	operators = make(map[string]bool)
+	for _, name := range strings.Split(*opnames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			operators[name] = true
+		}
+	}
 	if len(inputargs) < 1 {
 		fmt.Printf("Not enough inputs.\n")
 		return
@@ -2,6 +2,12 @@ package main
 
 import (
 	"../bclass"
+	"../data"
+	"../frame"
+	"../liveness"
+	"../mtls"
+	"../policy"
+	"../protocol"
 	"bytes"
 	"encoding/gob"
 	"flag"
@@ -15,28 +21,60 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const hb = 5
-const BUFFSIZE = 1048576
+
+// electionTick and heartbeatTick are the Raft election timeout and heartbeat
+// interval, in ticks of a tenth of a second
+var electionTick, heartbeatTick = 20 * hb, 4 * hb
+
+// replicateTimeout bounds how long a request waits for its proposal to be
+// applied, it stays below frame.Timeout so the node gets a Retry in time
+var replicateTimeout = 10 * time.Second
+
+// replicatePoll is how often a request checks whether its proposal was
+// applied
+var replicatePoll = time.Second
 
 var (
-	naddr   map[int]string
-	logger  *govec.GoLog
-	nID     int
-	myaddr  *net.TCPAddr
-	channel chan message
-	models  map[int]bclass.Model
-	modelC  map[int]int
-	modelD  int
-	gmodel  bclass.GlobalModel
-	gempty  bclass.GlobalModel
-	mynode  *node
+	naddr    map[int]string
+	logger   *govec.GoLog
+	nID      int
+	myaddr   *net.TCPAddr
+	models   map[int]bclass.Model
+	modelC   map[int]int
+	modelD   int
+	gmodel   bclass.GlobalModel
+	gversion int
+	gempty   bclass.GlobalModel
+	sempty   bclass.ColumnStats
+	schempty data.Schema
+	stats    map[int]bclass.ColumnStats
+	outbox   map[int][]protocol.Message
+	wake     map[int]chan bool
+	replays  *protocol.Replays
+	mynode   *node
+	commit   policy.Policy
+	ttimeout time.Duration
+	cpolicy  *string = flag.String("commit", policy.Default, "when a pending model is merged into the global model, e.g. coverage=0.6,accuracy=0.7|wait=10m, the same on every replica")
+	tlscert  *string = flag.String("tls-cert", "", "certificate file for mutual TLS (CN is the server name)")
+	tlskey   *string = flag.String("tls-key", "", "private key file for mutual TLS")
+	tlsca    *string = flag.String("tls-ca", "", "CA certificate file that signs the federation's certificates")
+	tlimit   *string = flag.String("test-timeout", "2m", "how long a node has to answer a test request before it is left out of the coverage and sent again, the same on every replica")
 )
 
+// required are the features nodes joining over TCP have to offer
+var required = []string{protocol.FeatureFrame, protocol.FeatureGovec, protocol.FeatureSigned, protocol.ModelBclass}
+
+// myhello is what this server speaks, it packs models for nodes that want
+// them packed
+var myhello = protocol.NewHello(append(required, protocol.PackFeatures...)...)
+
 type node struct {
 	id        uint64
 	ctx       context.Context
@@ -48,34 +86,64 @@ type node struct {
 	cnum      int
 	cnumhist  map[int]int
 	client    map[string]int
+	keys      map[int][]byte
+	hellos    map[int]protocol.Hello
+	live      *liveness.Tracker
+	replies   *protocol.Replies
+	sizes     map[int]int
 	tempmodel map[int]aggregate
 	testqueue map[int]map[int]bool
+	deadlines map[int]map[int]deadline
 	claddr    map[int]*net.TCPAddr
+	schema    data.Schema
 	ticker    <-chan time.Time
+	events    chan func()
 	done      <-chan struct{}
 }
 
+// state is a replicated entry, joins carry the protocol agreed with the node
+// so every replica packs models for it alike. At is when it was proposed,
+// the time every replica judges the commit policy by
 type state struct {
 	PropID int
-	Msg    message
+	Msg    protocol.Message
+	Hello  protocol.Hello
+	At     time.Time
 }
 
-type aggregate struct {
-	Cnum  int
-	Model bclass.Model
-	C     int
-	D     int
+// deadline is when a node has to answer the test of a model by, Due, taken
+// from the replicated commit so replicas agree, and when the test was last
+// sent to it. An expired test is left out of the coverage and sent again by
+// the leader while the node is active
+type deadline struct {
+	Due  time.Time
+	Sent time.Time
 }
 
-type message struct {
-	Id       int
-	NodeIp   string
-	NodeName string
-	Type     string
-	C        int
-	D        int
-	Model    bclass.Model
-	GModel   bclass.GlobalModel
+// outgoing is a message for node id with what sending it needs, taken from
+// the node state on the event loop so it can be sent off the loop. From is
+// the node whose model a test request carries
+type outgoing struct {
+	name  string
+	id    int
+	addr  *net.TCPAddr
+	hello protocol.Hello
+	from  int
+	msg   protocol.Message
+}
+
+// aggregate is a pending model, C and D count the committer's data and every
+// test of the model, Correct and Tested the tests of the other nodes only
+type aggregate struct {
+	Cnum    int
+	Model   bclass.Model
+	C       int
+	D       int
+	Nodes   int
+	Correct int
+	Tested  int
+	Since   time.Time
+	Merged  bool
 }
 
 // Function to initialize a new Raft node
@@ -87,8 +155,8 @@ func newNode(id uint64, peers []raft.Peer) *node {
 		store: store,
 		cfg: &raft.Config{
 			ID:              id,
-			ElectionTick:    20 * hb,
-			HeartbeatTick:   4 * hb,
+			ElectionTick:    electionTick,
+			HeartbeatTick:   heartbeatTick,
 			Storage:         store,
 			MaxSizePerMsg:   math.MaxUint16,
 			MaxInflightMsgs: 1024,
@@ -97,11 +165,18 @@ func newNode(id uint64, peers []raft.Peer) *node {
 		maxnode:   0,
 		cnum:      0,
 		client:    make(map[string]int),
+		keys:      make(map[int][]byte),
+		hellos:    make(map[int]protocol.Hello),
+		live:      liveness.NewTracker(),
+		replies:   protocol.NewReplies(),
+		sizes:     make(map[int]int),
 		claddr:    make(map[int]*net.TCPAddr),
 		tempmodel: make(map[int]aggregate),
 		testqueue: make(map[int]map[int]bool),
+		deadlines: make(map[int]map[int]deadline),
 		cnumhist:  make(map[int]int),
 		ticker:    time.Tick(time.Second / 10),
+		events:    make(chan func()),
 		done:      make(chan struct{}),
 	}
 
@@ -130,12 +205,49 @@ func (n *node) run() {
 				}
 			}
 			n.raft.Advance()
+		case f := <-n.events:
+			f()
 		case <-n.done:
 			return
 		}
 	}
 }
 
+// The node state, from the replicated maps to the global model, statistics
+// and outboxes, is owned by the Raft state machine loop above, which applies
+// committed entries and runs the functions other goroutines hand it with do.
+// Connection handlers keep signature checks, replication waits, packing and
+// sending off the loop, working on copies taken on it. Functions documented
+// to run on the event loop must only be called within do or while entries
+// are applied, and never call do themselves.
+
+// Function that runs f on the event loop and waits for it to finish
+func do(f func()) {
+	done := make(chan bool)
+	mynode.events <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// Function that looks up a node's id and registered key, from any goroutine
+func lookup(name string) (id int, key []byte, ok bool) {
+	do(func() {
+		id, ok = mynode.client[name]
+		key = mynode.keys[id]
+	})
+	return id, key, ok
+}
+
+// Function that tells whether node name still has to test the model of
+// commit number cnum, results for a model its committer has since replaced
+// by a new commit are stale. Runs on the event loop
+func (n *node) awaits(name string, cnum int) bool {
+	id := n.cnumhist[cnum]
+	return n.tempmodel[id].Cnum == cnum && n.testqueue[n.client[name]][id]
+}
+
 // Raft operations for saving snapshots
 func (n *node) saveToStorage(hardState raftpb.HardState, entries []raftpb.Entry, snapshot raftpb.Snapshot) {
 	n.store.Append(entries)
@@ -151,24 +263,38 @@ func (n *node) saveToStorage(hardState raftpb.HardState, entries []raftpb.Entry,
 func (n *node) send(messages []raftpb.Message) {
 	for _, m := range messages {
 		//outBuf := logger.PrepareSend("Sending message to other node", m)
-		conn, err := net.Dial("tcp", naddr[int(m.To)])
+		conn, err := mtls.Dial(naddr[int(m.To)], mtls.ServerName)
 		if err == nil {
-			enc := gob.NewEncoder(conn)
-			enc.Encode(m)
+			enc := frame.NewEncoder(conn)
+			if err := enc.Encode(m); err != nil {
+				fmt.Printf("*** Could not send message to Raft node: %v: %v.\n", int(m.To), err)
+			}
+			conn.Close()
 		} else {
 			fmt.Printf("*** Could not send message to Raft node: %v.\n", int(m.To))
 		}
 	}
 }
 
-// Raft receive function using gob encoder [between Raft nodes]
-func (n *node) receive(conn *net.TCPConn) {
+// Raft receive function using gob encoder [between Raft nodes], only
+// messages of the Raft nodes in the node list are stepped
+func (n *node) receive(conn net.Conn) {
 	// Echo all incoming data.
 	var imsg raftpb.Message
-	dec := gob.NewDecoder(conn)
+	dec := frame.NewDecoder(conn)
 	err := dec.Decode(&imsg)
-	checkError(err)
+	if err == nil {
+		err = mtls.CheckPeer(conn, mtls.ServerName)
+	}
 	conn.Close()
+	if err != nil {
+		fmt.Printf("*** Could not read message from Raft node: %v.\n", err)
+		return
+	}
+	if _, ok := naddr[int(imsg.From)]; !ok || imsg.To != n.id {
+		fmt.Printf("*** Dropped message from unknown Raft node %v to %v.\n", imsg.From, imsg.To)
+		return
+	}
 	n.raft.Step(n.ctx, imsg)
 }
 
@@ -187,26 +313,56 @@ func (n *node) process(entry raftpb.Entry) {
 		dec.Decode(&repstate)
 		msg := repstate.Msg
 		switch msg.Type {
-		case "join_request":
+		case protocol.JoinRequest:
+			if id, ok := n.client[msg.NodeName]; ok {
+				// the join was proposed again after a timeout
+				n.claddr[id] = nodeAddr(msg.NodeIp)
+				n.hellos[id] = repstate.Hello
+				n.live.Beat(id)
+				break
+			}
+			if n.schema.Empty() {
+				n.schema = msg.Schema
+				fmt.Printf("--- Federation schema set by %v: %v features, labels %v.\n", msg.NodeName, n.schema.Width(), n.schema.Labels)
+			}
 			id := n.maxnode
 			n.maxnode++
 			n.client[msg.NodeName] = id
-			n.claddr[id], _ = net.ResolveTCPAddr("tcp", msg.NodeIp)
+			n.keys[id] = msg.PubKey
+			n.hellos[id] = repstate.Hello
+			n.claddr[id] = nodeAddr(msg.NodeIp)
+			wake[id] = make(chan bool, 1)
+			n.live.Beat(id)
 			queue := make(map[int]bool)
 			for k, _ := range n.tempmodel {
 				queue[k] = true
+				setDeadline(id, k, repstate.At)
 			}
 			n.testqueue[id] = queue
 			fmt.Printf("--- Added %v as node%v.\n", msg.NodeName, id)
-		case "rejoin_request":
+		case protocol.RejoinRequest:
 			id := n.client[msg.NodeName]
-			n.claddr[id], _ = net.ResolveTCPAddr("tcp", msg.NodeIp)
-		case "commit_request":
+			n.claddr[id] = nodeAddr(msg.NodeIp)
+			n.hellos[id] = repstate.Hello
+			n.live.Beat(id)
+		case protocol.Heartbeat:
+			n.live.Beat(n.client[msg.NodeName])
+		case protocol.NodeState:
+			n.live.Set(msg.Id, liveness.State(msg.C))
+			fmt.Printf("--- node%v is %v.\n", msg.Id, liveness.State(msg.C))
+		case protocol.CommitRequest:
+			n.live.Beat(n.client[msg.NodeName])
+			if _, ok := n.replies.Start(msg.NodeName, msg.Key); !ok {
+				fmt.Printf("--- Skipped resent commit from %v.\n", msg.NodeName)
+				break
+			}
+			n.replies.Finish(msg.NodeName, msg.Key, protocol.Response{Code: protocol.OK})
+			n.sizes[n.client[msg.NodeName]] = msg.D
 			tempcnum := n.cnum
 			n.cnum++
 			n.cnumhist[tempcnum] = n.client[msg.NodeName]
 			//initialize new aggregate
-			n.tempmodel[n.client[msg.NodeName]] = aggregate{tempcnum, msg.Model, msg.C, msg.D}
+			n.tempmodel[n.client[msg.NodeName]] = aggregate{tempcnum, msg.Model, msg.C, msg.D, 0, 0, 0, repstate.At, false}
 			for _, id := range n.client {
 				if id != n.client[msg.NodeName] {
 					if queue, ok := n.testqueue[id]; !ok {
@@ -216,12 +372,29 @@ func (n *node) process(entry raftpb.Entry) {
 					} else {
 						queue[n.cnumhist[tempcnum]] = true
 					}
+					setDeadline(id, n.cnumhist[tempcnum], repstate.At)
+					// polls of the node can be waiting on any replica
+					notify(id)
 				}
 			}
 			fmt.Printf("--- Processed commit %v for node %v.\n", tempcnum, msg.NodeName)
-		case "test_complete":
+		case protocol.TestComplete:
+			n.live.Beat(n.client[msg.NodeName])
+			if !n.awaits(msg.NodeName, msg.Id) {
+				fmt.Printf("--- Skipped test results from %v for a model it no longer tests.\n", msg.NodeName)
+				break
+			}
+			if _, ok := n.replies.Start(msg.NodeName, msg.Key); !ok {
+				fmt.Printf("--- Skipped resent test results from %v.\n", msg.NodeName)
+				break
+			}
+			n.replies.Finish(msg.NodeName, msg.Key, protocol.Response{Code: protocol.OK})
+			n.sizes[n.client[msg.NodeName]] = msg.D
 			n.testqueue[n.client[msg.NodeName]][n.cnumhist[msg.Id]] = false
-			channel <- msg
+			delete(n.deadlines[n.client[msg.NodeName]], n.cnumhist[msg.Id])
+			updateGlobal(repstate)
+		case protocol.ModelMerged:
+			updateGlobal(repstate)
 		default:
 			// Do nothing
 		}
@@ -229,7 +402,8 @@ func (n *node) process(entry raftpb.Entry) {
 	}
 }
 
-// Replicate function that coordinates Raft nodes and blocks until all nodes have been synced
+// Replicate function that coordinates Raft nodes and blocks until all nodes have been synced,
+// or replicateTimeout passed and the request should be resent
 //   The map used to check commit grows as more replication proccesses are done and will start to
 //   cause problems when the number of commits increase past a certain amount. It would be wise to
 //   replace this with a better alternative.
@@ -238,6 +412,7 @@ func replicate(m state) bool {
 
 	r := rand.Intn(999999999999)
 	m.PropID = r
+	m.At = time.Now()
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	err := enc.Encode(m)
@@ -245,11 +420,10 @@ func replicate(m state) bool {
 
 	if err == nil {
 		//block and check the status of the proposal
-		for !flag {
-			time.Sleep(time.Duration(1 * time.Second))
-			if mynode.propID[r] {
-				flag = true
-			}
+		deadline := time.Now().Add(replicateTimeout)
+		for !flag && time.Now().Before(deadline) {
+			time.Sleep(replicatePoll)
+			do(func() { flag = mynode.propID[r] })
 		}
 	}
 
@@ -261,19 +435,15 @@ func main() {
 	parseArgs()
 
 	raftaddr, _ := net.ResolveTCPAddr("tcp", naddr[nID])
-	sl, err := net.ListenTCP("tcp", raftaddr)
+	sl, err := mtls.Listen(raftaddr)
 	checkError(err)
-	cl, err := net.ListenTCP("tcp", myaddr)
+	cl, err := mtls.Listen(myaddr)
 	checkError(err)
 
 	// Wait for proposed entry to be commited in cluster.
 	// Apperently when should add an uniq id to the message and wait until it is
 	// commited in the node.
-	models = make(map[int]bclass.Model)
-	modelC = make(map[int]int)
-	modelD = 0
-	gmodel = bclass.GlobalModel{models, modelC, modelD}
-	channel = make(chan message)
+	initState()
 
 	// start a small cluster
 	mynode = newNode(uint64(nID), []raft.Peer{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}})
@@ -285,14 +455,15 @@ func main() {
 		mynode.raft.Campaign(mynode.ctx)
 	}
 
-	go updateGlobal(channel)
+	go sweep()
 
 	go clientListener(cl)
 
+	fmt.Printf("--- Commit policy: %v.\n", commit)
 	go printLeader()
 
 	for {
-		conn, err := sl.AcceptTCP()
+		conn, err := sl.Accept()
 		if err == nil {
 			go mynode.receive(conn)
 		} else {
@@ -302,6 +473,19 @@ func main() {
 
 }
 
+// Function that creates the empty global model and outboxes, before the
+// Raft node runs
+func initState() {
+	models = make(map[int]bclass.Model)
+	modelC = make(map[int]int)
+	modelD = 0
+	gmodel = bclass.GlobalModel{ModelList: models, TestSize: modelC, D: modelD}
+	stats = make(map[int]bclass.ColumnStats)
+	outbox = make(map[int][]protocol.Message)
+	wake = make(map[int]chan bool)
+	replays = protocol.NewReplays()
+}
+
 // Function to periodically print Raft Leader
 func printLeader() {
 	for {
@@ -312,9 +496,9 @@ func printLeader() {
 }
 
 // Client listener function
-func clientListener(listen *net.TCPListener) {
+func clientListener(listen net.Listener) {
 	for {
-		connC, err := listen.AcceptTCP()
+		connC, err := listen.Accept()
 		if err == nil {
 			go connHandler(connC)
 		} else {
@@ -323,209 +507,669 @@ func clientListener(listen *net.TCPListener) {
 	}
 }
 
+// Function that reads a node's message, a join is preceded by the node's
+// hello, which has to be compatible before the join itself is decoded
+func receive(conn net.Conn) (protocol.Message, *protocol.Hello, error) {
+	hello, p, err := protocol.ReadFirst(conn)
+	if err != nil {
+		return protocol.Message{}, nil, err
+	}
+	if hello != nil {
+		agreed, err := protocol.Negotiate(*hello, myhello, required...)
+		if err != nil {
+			protocol.Reply(conn, protocol.Incompatible, err.Error())
+			return protocol.Message{}, nil, err
+		}
+		hello = &agreed
+	}
+	msg, err := protocol.ReceiveNext(conn, logger, p)
+	return msg, hello, err
+}
+
 // Function for handling client requests
-func connHandler(conn *net.TCPConn) {
-	var msg message
-	p := make([]byte, BUFFSIZE)
-	conn.Read(p)
-	logger.UnpackReceive("Received message", p, &msg)
+func connHandler(conn net.Conn) {
+	msg, agreed, err := receive(conn)
+	if err != nil {
+		fmt.Printf("*** Could not read message from %v: %v.\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if err := mtls.CheckPeer(conn, msg.NodeName); err != nil {
+		protocol.Reply(conn, protocol.Denied, err.Error())
+		fmt.Printf("--> Denied %v from %v: %v.\n", msg.Type, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if err := checkSignature(msg); err != nil {
+		protocol.Reply(conn, protocol.Denied, err.Error())
+		fmt.Printf("--> Denied %v from %v: %v.\n", msg.Type, msg.NodeName, err)
+		conn.Close()
+		return
+	}
+	if msg.Type != protocol.JoinRequest {
+		if err := checkAlive(msg.NodeName); err != nil {
+			protocol.Reply(conn, protocol.Restart, err.Error())
+			fmt.Printf("--> Asked %v to rejoin: %v.\n", msg.NodeName, err)
+			conn.Close()
+			return
+		}
+	}
 	switch msg.Type {
-	case "commit_request":
+	case protocol.CommitRequest:
 		// node is sending a model, checking to see if testing is complete
-		flag := checkQueue(mynode.client[msg.NodeName])
+		var flag bool
+		var err error
+		do(func() {
+			flag = checkQueue(mynode.client[msg.NodeName])
+			err = checkModel(msg.Model)
+		})
 		fmt.Printf("<-- Received commit request from %v.\n", msg.NodeName)
-		if flag {
+		if r, ok := resent(msg); ok {
+			protocol.Reply(conn, r.Code, r.Error)
+			conn.Close()
+		} else if err != nil {
+			protocol.Reply(conn, protocol.ModelMismatch, err.Error())
+			fmt.Printf("--> Denied commit request from %v: %v.\n", msg.NodeName, err)
+			conn.Close()
+		} else if flag {
 			// accept commit from node and process outgoing test requests
 			processTestRequest(msg, conn)
 		} else {
 			//denied
-			conn.Write([]byte("Pending tests are not complete"))
+			protocol.Reply(conn, protocol.Pending, "")
 			fmt.Printf("--> Denied commit request from %v.\n", msg.NodeName)
 			conn.Close()
 		}
-	case "global_request":
-		//node is requesting the global model, will forward
-		conn.Write([]byte("OK"))
+	case protocol.GlobalRequest:
+		//node is requesting the global model, it is sent back on the same connection
 		fmt.Printf("<-- Received global model request from %v.\n", msg.NodeName)
-		genGlobalModel()
-		sendGlobal(msg)
+		var o outgoing
+		do(func() { o = grant(msg) })
+		if o.msg.Version <= msg.Version {
+			protocol.Reply(conn, protocol.NotModified, "")
+			fmt.Printf("--> Global model version %v is current at %v.\n", o.msg.Version, msg.NodeName)
+		} else {
+			protocol.Reply(conn, protocol.OK, "")
+			sendGlobal(conn, o)
+		}
 		conn.Close()
-	case "test_complete":
+	case protocol.TestComplete:
 		//node is submitting test results, will update its queue
 		fmt.Printf("<-- Received completed test results from %v.\n", msg.NodeName)
-		if mynode.testqueue[mynode.client[msg.NodeName]][mynode.cnumhist[msg.Id]] {
-			repstate := state{0, msg}
+		var queued bool
+		do(func() { queued = mynode.awaits(msg.NodeName, msg.Id) })
+		if r, ok := resent(msg); ok {
+			protocol.Reply(conn, r.Code, r.Error)
+		} else if queued {
+			repstate := state{0, msg, protocol.Hello{}, time.Time{}}
 			flag := replicate(repstate)
 			if flag {
-				conn.Write([]byte("OK"))
+				protocol.Reply(conn, protocol.OK, "")
 			} else {
 				// if testqueue could not be replicated
-				conn.Write([]byte("Try again"))
+				protocol.Reply(conn, protocol.Retry, "")
 				fmt.Printf("--> Could not process test from %v.\n", msg.NodeName)
 			}
 		} else {
-			// if testqueue is already empty
-			conn.Write([]byte("Duplicate Test"))
+			// if testqueue is already empty or the model was replaced
+			protocol.Reply(conn, protocol.Duplicate, "")
 			fmt.Printf("--> Ignored test results from %v.\n", msg.NodeName)
 		}
 
 		conn.Close()
-	case "join_request":
+	case protocol.StatsRequest:
+		// node is sharing column statistics, will forward the merged ones
+		protocol.Reply(conn, protocol.OK, "")
+		fmt.Printf("<-- Received column statistics from %v.\n", msg.NodeName)
+		var o *outgoing
+		do(func() {
+			stats[mynode.client[msg.NodeName]] = msg.Stats
+			o = sendStats(msg)
+		})
+		if o != nil {
+			tcpSend(o.addr, o.name, pack(o.id, o.hello, o.msg))
+		}
+		conn.Close()
+	case protocol.Heartbeat:
+		// node is alive, every replica notes it
+		if replicate(state{0, msg, protocol.Hello{}, time.Time{}}) {
+			protocol.Reply(conn, protocol.OK, "")
+		} else {
+			protocol.Reply(conn, protocol.Retry, "")
+		}
+		conn.Close()
+	case protocol.PollRequest:
+		// node can't be dialed, hand it what is queued as soon as there is any
+		protocol.Reply(conn, protocol.OK, "")
+		id, _, _ := lookup(msg.NodeName)
+		protocol.SendBatch(conn, logger, waitQueued(id))
+		conn.Close()
+	case protocol.JoinRequest:
 		// node is requesting to join or rejoin
 		fmt.Printf("<-- Received join request from %v.\n", msg.NodeName)
-		flag := processJoin(msg)
-		if flag {
-			conn.Write([]byte("Joined"))
+		denied := checkJoinName(msg.NodeName)
+		var err error
+		if agreed != nil && denied == nil {
+			do(func() { err = checkSchema(msg.Schema) })
+		}
+		if agreed == nil {
+			protocol.Reply(conn, protocol.Incompatible, protocol.ErrNoHello.Error())
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, protocol.ErrNoHello)
+		} else if denied != nil {
+			protocol.Reply(conn, protocol.Denied, denied.Error())
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, denied)
+		} else if err != nil {
+			protocol.Reply(conn, protocol.SchemaMismatch, err.Error())
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, err)
+		} else if tests, ok := processJoin(msg, *agreed); ok {
+			protocol.Reply(conn, protocol.Joined, "")
+			protocol.WriteHello(conn, *agreed)
+			conn.Close()
+			sendTests(tests)
+			return
 		} else {
 			fmt.Printf("*** Could not process join for node %v.\n", msg.NodeName)
-			conn.Write([]byte("Failed Join"))
+			protocol.Reply(conn, protocol.Retry, "join was not replicated")
 		}
 		conn.Close()
 	default:
-		conn.Write([]byte("Unknown Request"))
+		protocol.Reply(conn, protocol.Unknown, string(msg.Type))
 		fmt.Printf("something weird happened!\n")
 		conn.Close()
 	}
 }
 
 // Global model update function
-func updateGlobal(ch chan message) {
-	// Function that aggregates the global model and commits when ready
-	for {
-		m := <-ch
-		id := mynode.cnumhist[m.Id]
-		tempAggregate := mynode.tempmodel[id]
-		tempAggregate.C += m.C
-		tempAggregate.D += m.D
-		mynode.tempmodel[id] = tempAggregate
-		if modelD < tempAggregate.D {
-			modelD = tempAggregate.D
+func updateGlobal(repstate state) {
+	// Function that aggregates the global model and commits when ready, as
+	// test results or merges are applied on the event loop
+	m := repstate.Msg
+	id := mynode.cnumhist[m.Id]
+	tempAggregate := mynode.tempmodel[id]
+	if m.Type == protocol.ModelMerged {
+		// the leader found the model ready without new test results
+		if tempAggregate.Cnum == m.Id && !tempAggregate.Merged {
+			merge(id, m, progress(id, tempAggregate, repstate.At))
 		}
+		return
+	}
+	tempAggregate.C += m.C
+	tempAggregate.D += m.D
+	tempAggregate.Nodes++
+	tempAggregate.Correct += m.C
+	tempAggregate.Tested += m.D
+	mynode.tempmodel[id] = tempAggregate
+	if modelD < tempAggregate.D {
+		modelD = tempAggregate.D
+	}
 
-		if float64(tempAggregate.D) > float64(modelD)*0.6 {
-			models[id] = tempAggregate.Model
-			modelC[id] = tempAggregate.C
-			t := time.Now()
-			logger.LogLocalEvent(fmt.Sprintf("%s - Committed model%v by %v at partial commit %v.", t.Format("15:04:05.0000"), id, mynode.client[m.NodeName], tempAggregate.D/modelD*100.0))
-			//logger.LogLocalEvent("commit_complete")
-			fmt.Printf("--- Committed model%v for commit number: %v.\n", id, tempAggregate.Cnum)
-		}
+	// judged at the time the results were proposed, so replicas agree
+	p := progress(id, tempAggregate, repstate.At)
+	if commit.Ready(p) {
+		merge(id, m, p)
+	} else {
+		fmt.Printf("--- Model%v waits for the commit policy: %v.\n", id, p)
+	}
+}
+
+// Function that merges the pending model of node id into the global model
+func merge(id int, m protocol.Message, p policy.Progress) {
+	tempAggregate := mynode.tempmodel[id]
+	// every replica commits the same models, so versions agree. A commit
+	// merged again with more test results keeps its version
+	if !tempAggregate.Merged {
+		gversion++
 	}
+	tempAggregate.Merged = true
+	mynode.tempmodel[id] = tempAggregate
+	models[id] = tempAggregate.Model
+	modelC[id] = tempAggregate.C
+	t := time.Now()
+	protocol.LogEvent(logger, fmt.Sprintf("%s - Committed model%v by %v at partial commit %v.", t.Format("15:04:05.0000"), id, mynode.client[m.NodeName], 100*p.Coverage()))
+	//logger.LogLocalEvent("commit_complete")
+	fmt.Printf("--- Committed model%v for commit number: %v (%v).\n", id, tempAggregate.Cnum, p)
 }
 
-// Generate global model from partial commits
+// Function that sums up how far the validation of a pending model got at
+// time now, the data of dead nodes that still owe its test is left out of
+// the coverage
+func progress(id int, a aggregate, now time.Time) policy.Progress {
+	return policy.Progress{Covered: a.D, Total: modelD - deadD(id) - expiredD(id, now), Nodes: a.Nodes, Correct: a.Correct, Tested: a.Tested, Waited: now.Sub(a.Since)}
+}
+
+// Generate global model from partial commits, as a copy the event loop
+// doesn't change while it is sent. Runs on the event loop
 func genGlobalModel() {
-	modelstemp := models
-	modelCtemp := modelC
+	modelstemp := make(map[int]bclass.Model, len(models))
+	for k, v := range models {
+		modelstemp[k] = v
+	}
+	modelCtemp := make(map[int]int, len(modelC))
+	for k, v := range modelC {
+		modelCtemp[k] = v
+	}
 	modelDtemp := modelD
-	gmodel = bclass.GlobalModel{modelstemp, modelCtemp, modelDtemp}
+	gmodel = bclass.GlobalModel{ModelList: modelstemp, TestSize: modelCtemp, D: modelDtemp}
+}
+
+// Function that returns the response to a commit or test results whose
+// idempotency key was already applied, on this or any other replica
+func resent(m protocol.Message) (protocol.Response, bool) {
+	r, ok := mynode.replies.Lookup(m.NodeName, m.Key)
+	if ok {
+		fmt.Printf("--> Answered resent %v from %v: %v.\n", m.Type, m.NodeName, r)
+	}
+	return r, ok
 }
 
 // Function that generates test request following a commit request
-func processTestRequest(m message, conn *net.TCPConn) {
-	repstate := state{0, m}
+func processTestRequest(m protocol.Message, conn net.Conn) {
+	repstate := state{0, m, protocol.Hello{}, time.Time{}}
 	flag := replicate(repstate)
 	if flag {
-		//sanitize the model for testing
-		tempcnum := 0
-		//get the latest cnum, necessary as cnum is updated in raft
-		for k, v := range mynode.cnumhist {
-			if v == mynode.client[m.NodeName] {
-				tempcnum = k
+		var out []outgoing
+		do(func() {
+			//sanitize the model for testing
+			tempcnum := 0
+			//get the latest cnum, necessary as cnum is updated in raft
+			for k, v := range mynode.cnumhist {
+				if v == mynode.client[m.NodeName] {
+					tempcnum = k
+				}
 			}
-		}
-		conn.Write([]byte("OK"))
-		conn.Close()
-		for name, id := range mynode.client {
-			if id != mynode.client[m.NodeName] {
-				sendTestRequest(name, id, tempcnum, m.Model)
+			for name, id := range mynode.client {
+				if id != mynode.client[m.NodeName] {
+					out = append(out, testRequest(name, id, tempcnum, m.Model)...)
+				}
 			}
-		}
+		})
+		protocol.Reply(conn, protocol.OK, "")
+		conn.Close()
+		sendTests(out)
 	} else {
-		conn.Write([]byte("Try again"))
+		protocol.Reply(conn, protocol.Retry, "")
 		conn.Close()
 		fmt.Printf("--> Failed to commit request from %v.\n", m.NodeName)
 	}
 }
 
-// Function that sends test requests via TCP
-func sendTestRequest(name string, id, tcnum int, tmodel bclass.Model) {
+// Function that returns the test request for a node, none when the node is
+// dead or polls for its tests. Runs on the event loop
+func testRequest(name string, id, tcnum int, tmodel bclass.Model) []outgoing {
+	if !mynode.live.Alive(id) {
+		// the test stays queued until the node rejoins
+		fmt.Printf("--- Held back test request from %v for %v, it is dead.\n", mynode.cnumhist[tcnum], name)
+		return nil
+	}
+	if mynode.claddr[id] == nil {
+		// the node polls for its test requests
+		fmt.Printf("--- Queued test request from %v for %v.\n", mynode.cnumhist[tcnum], name)
+		notify(id)
+		return nil
+	}
 	//create test request (sanitized)
-	msg := message{tcnum, "server", "server", "test_request", 0, 0, tmodel, gempty}
-	//send the request
-	fmt.Printf("--> Sending test request from %v to %v.", mynode.cnumhist[tcnum], name)
-	err := tcpSend(mynode.claddr[id], msg)
-	if err != nil {
-		fmt.Printf(" [NO]\n*** Could not send test request to %v.\n", name)
+	msg := protocol.Message{Id: tcnum, NodeIp: "server", NodeName: "server", Type: protocol.TestRequest, Model: tmodel, Deadline: mynode.deadlines[id][mynode.cnumhist[tcnum]].Due}
+	return []outgoing{{name, id, mynode.claddr[id], mynode.hellos[id], mynode.cnumhist[tcnum], msg}}
+}
+
+// Function that sends test requests via TCP
+func sendTests(out []outgoing) {
+	for _, o := range out {
+		msg := pack(o.id, o.hello, o.msg)
+		//send the request
+		fmt.Printf("--> Sending test request from %v to %v.", o.from, o.name)
+		err := tcpSend(o.addr, o.name, msg)
+		if err != nil {
+			fmt.Printf(" [NO]\n*** Could not send test request to %v.\n", o.name)
+		}
 	}
 }
 
-// Function to forward global model
-func sendGlobal(m message) {
-	fmt.Printf("--> Sending global model to %v.", m.NodeName)
-	msg := message{m.Id, "server", "server", "global_grant", 0, 0, m.Model, gmodel}
-	tcpSend(mynode.claddr[mynode.client[m.NodeName]], msg)
+// Function that returns the answer to a global model request, with the
+// current model and its version. Runs on the event loop
+func grant(m protocol.Message) outgoing {
+	genGlobalModel()
+	id := mynode.client[m.NodeName]
+	msg := protocol.Message{Id: m.Id, NodeIp: "server", NodeName: "server", Type: protocol.GlobalGrant, Model: m.Model, GModel: gmodel, Version: gversion}
+	return outgoing{m.NodeName, id, mynode.claddr[id], mynode.hellos[id], id, msg}
 }
 
-// Function for sending messages to nodes via TCP
-func tcpSend(addr *net.TCPAddr, msg message) error {
-	p := make([]byte, BUFFSIZE)
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err == nil {
-		outbuf := logger.PrepareSend(msg.Type, msg)
-		_, err = conn.Write(outbuf)
-		//checkError(err)
-		n, _ := conn.Read(p)
-		if string(p[:n]) != "OK" {
-			fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", string(p[:n]))
-		} else {
-			fmt.Printf(" [OK]\n")
+// Function that answers a global model request with the model
+func sendGlobal(conn net.Conn, o outgoing) {
+	fmt.Printf("--> Sending global model version %v to %v.", o.msg.Version, o.name)
+	msg := pack(o.id, o.hello, o.msg)
+	if err := protocol.Send(conn, logger, msg); err != nil {
+		fmt.Printf(" [NO]\n*** Could not send global model: %v.\n", err)
+	} else {
+		fmt.Printf(" [OK]\n")
+	}
+}
+
+// Function that packs the models of a message for node id as h, agreed when
+// it joined, says, a message that can't be packed is sent whole
+func pack(id int, h protocol.Hello, msg protocol.Message) protocol.Message {
+	if err := protocol.Pack(&msg, h); err != nil {
+		fmt.Printf("*** Could not pack %v for node%v, sending it whole: %v.\n", msg.Type, id, err)
+	}
+	return msg
+}
+
+// Function to forward the column statistics merged over all nodes.
+// Statistics are soft state held by the replica the node talked to, nodes
+// resend them after a leader change. They are queued for a node that can't
+// be dialed and returned to send otherwise. Runs on the event loop
+func sendStats(m protocol.Message) *outgoing {
+	ids := make([]int, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	list := make([]bclass.ColumnStats, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, stats[id])
+	}
+	fmt.Printf("--> Sending column statistics to %v.", m.NodeName)
+	msg := protocol.Message{Id: m.Id, NodeIp: "server", NodeName: "server", Type: protocol.StatsGrant, Model: m.Model, Stats: bclass.MergeStats(list, mynode.schema.Width())}
+	id := mynode.client[m.NodeName]
+	if mynode.claddr[id] == nil {
+		// queued statistics are held by this replica only, test requests are
+		// found in the replicated test queue by whichever replica the node polls
+		outbox[id] = append(outbox[id], msg)
+		notify(id)
+		fmt.Printf(" [QUEUED]\n")
+		return nil
+	}
+	return &outgoing{m.NodeName, id, mynode.claddr[id], mynode.hellos[id], id, msg}
+}
+
+// Function that wakes a poll waiting for node id
+func notify(id int) {
+	select {
+	case wake[id] <- true:
+	default:
+	}
+}
+
+// Function that returns the test requests a node still has to answer. Runs
+// on the event loop
+func pendingTests(id int) []protocol.Message {
+	var msgs []protocol.Message
+	for k, v := range mynode.testqueue[id] {
+		if v {
+			agg := mynode.tempmodel[k]
+			msgs = append(msgs, protocol.Message{Id: agg.Cnum, NodeIp: "server", NodeName: "server", Type: protocol.TestRequest, Model: agg.Model, Deadline: mynode.deadlines[id][k].Due})
+		}
+	}
+	return msgs
+}
+
+// Function that takes what is queued for a polling node, waiting up to
+// protocol.PollWait for something to arrive when nothing is
+func waitQueued(id int) []protocol.Message {
+	timeout := time.After(protocol.PollWait)
+	for {
+		var msgs []protocol.Message
+		var h protocol.Hello
+		var w chan bool
+		do(func() {
+			msgs = append(outbox[id], pendingTests(id)...)
+			delete(outbox, id)
+			h, w = mynode.hellos[id], wake[id]
+		})
+		for i := range msgs {
+			msgs[i] = pack(id, h, msgs[i])
+		}
+		if len(msgs) > 0 {
+			fmt.Printf("--> Handing %v queued messages to node%v.\n", len(msgs), id)
+			return msgs
+		}
+		select {
+		case <-w:
+		case <-timeout:
+			return nil
 		}
 	}
+}
+
+// Function for sending messages to node name via TCP
+func tcpSend(addr *net.TCPAddr, name string, msg protocol.Message) error {
+	if addr == nil {
+		fmt.Printf(" [NO]\n*** Node has no address, it polls for its messages.\n")
+		return fmt.Errorf("node has no address")
+	}
+	r, err := protocol.Request(addr, name, logger, msg)
+	if err != nil {
+		fmt.Printf(" [NO]\n*** No reply from node: %v.\n", err)
+	} else if !r.Accepted() {
+		fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", r)
+	} else {
+		fmt.Printf(" [OK]\n")
+	}
 	return err
 }
 
-// Function that checks the testqueue for outstanding tests
+// Function that checks the testqueue for outstanding tests. Runs on the event
+// loop
 func checkQueue(id int) bool {
 	flag := true
-	for _, v := range mynode.testqueue[id] {
-		if flag && v {
+	now := time.Now()
+	for k, v := range mynode.testqueue[id] {
+		if flag && v && !expired(id, k, now) {
 			flag = false
 		}
 	}
 	return flag
 }
 
-// Function that processes join requests and forwards response to Raft nodes
-func processJoin(m message) bool {
-	//process depending on if it is a new node or a returning one
-	flag := false
+// Function that refuses anything but a join from a node declared dead, nodes
+// are marked alive as their messages are applied on every replica
+func checkAlive(name string) error {
+	if id, _, ok := lookup(name); ok && !mynode.live.Alive(id) {
+		return fmt.Errorf("node%v was declared dead, join again", id)
+	}
+	return nil
+}
+
+// Function that has the leader replicate its verdict on nodes that went
+// silent, so all replicas agree on who is left out of the quorum, and on
+// models that became ready for the commit policy without new test results
+func sweep() {
+	for {
+		time.Sleep(liveness.Interval)
+		if mynode.raft.Status().Lead != mynode.id {
+			continue
+		}
+		for id, s := range mynode.live.Due() {
+			msg := protocol.Message{Id: id, NodeIp: "server", NodeName: "server", Type: protocol.NodeState, C: int(s)}
+			replicate(state{0, msg, protocol.Hello{}, time.Time{}})
+		}
+		var ready []int
+		var out []outgoing
+		do(func() {
+			for id, a := range mynode.tempmodel {
+				if !a.Merged && commit.Ready(progress(id, a, time.Now())) {
+					ready = append(ready, a.Cnum)
+				}
+			}
+			out = retryTests(time.Now())
+		})
+		sendTests(out)
+		for _, cnum := range ready {
+			msg := protocol.Message{Id: cnum, NodeIp: "server", NodeName: "server", Type: protocol.ModelMerged}
+			replicate(state{0, msg, protocol.Hello{}, time.Time{}})
+		}
+	}
+}
+
+// Function that returns the amount of data of dead nodes that still owe the
+// test of node id's model, which is left out of the quorum for its partial
+// commit. Dead nodes that tested it count as usual. Runs on the event loop
+func deadD(id int) int {
+	d := 0
+	for v, n := range mynode.sizes {
+		if !mynode.live.Alive(v) && mynode.testqueue[v][id] {
+			d += n
+		}
+	}
+	return d
+}
+
+// Function that gives node id until the test timeout after at to answer the
+// test of the model of node k. Runs on the event loop
+func setDeadline(id, k int, at time.Time) {
+	if mynode.deadlines[id] == nil {
+		mynode.deadlines[id] = make(map[int]deadline)
+	}
+	mynode.deadlines[id][k] = deadline{at.Add(ttimeout), at}
+}
+
+// Function that notes the test of the model of node k was sent to node id
+// again, its deadline stays. Runs on the event loop
+func markSent(id, k int, now time.Time) {
+	if d, ok := mynode.deadlines[id][k]; ok {
+		d.Sent = now
+		mynode.deadlines[id][k] = d
+	}
+}
+
+// Function that reports whether node id missed the deadline of its test of
+// the model of node k. Runs on the event loop
+func expired(id, k int, now time.Time) bool {
+	d, ok := mynode.deadlines[id][k]
+	return mynode.testqueue[id][k] && ok && now.After(d.Due)
+}
+
+// Function that returns the amount of data of live nodes that missed the
+// deadline of their test of node id's model, which is left out of the
+// quorum for its partial commit. Runs on the event loop
+func expiredD(id int, now time.Time) int {
+	d := 0
+	for v := range mynode.testqueue {
+		if mynode.live.Alive(v) && expired(v, id, now) {
+			d += mynode.sizes[v]
+		}
+	}
+	return d
+}
+
+// Function that sends expired tests again to the active nodes that owe them,
+// at most once per test timeout, so a node that missed a test or came back
+// from being suspect answers it after all. Runs on the event loop
+func retryTests(now time.Time) []outgoing {
+	var out []outgoing
+	for name, id := range mynode.client {
+		if mynode.live.State(id) != liveness.Active {
+			continue
+		}
+		for k, d := range mynode.deadlines[id] {
+			if expired(id, k, now) && now.Sub(d.Sent) >= ttimeout {
+				fmt.Printf("--- node%v missed the deadline of its test of model%v, sending it again.\n", id, k)
+				markSent(id, k, now)
+				out = append(out, testRequest(name, id, mynode.tempmodel[k].Cnum, mynode.tempmodel[k].Model)...)
+			}
+		}
+	}
+	return out
+}
+
+// Function that checks the name a node joins with, the common name of the
+// servers' certificates is reserved so no node can pass for a server
+func checkJoinName(name string) error {
+	if name == mtls.ServerName {
+		return fmt.Errorf("node name %q is reserved for the servers", name)
+	}
+	return nil
+}
+
+// Function that checks a joining node's data schema against the federation's,
+// the first node to join fixes the schema. Runs on the event loop
+func checkSchema(sc data.Schema) error {
+	if sc.Empty() {
+		return fmt.Errorf("join request carries no data schema")
+	}
+	if mynode.schema.Empty() {
+		return nil
+	}
+	return sc.Check(mynode.schema)
+}
 
-	if id, ok := mynode.client[m.NodeName]; !ok {
+// Function that checks the signature of a message that changes server state,
+// a new node signs its join with the key it registers, members with the
+// registered key. A signature is only accepted once and while it is recent
+func checkSignature(m protocol.Message) error {
+	if !m.Type.Signed() {
+		return nil
+	}
+	key := m.PubKey
+	if _, k, ok := lookup(m.NodeName); ok {
+		key = k
+	} else if m.Type != protocol.JoinRequest {
+		return fmt.Errorf("%v has not joined", m.NodeName)
+	}
+	if err := protocol.Verify(m, key); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := protocol.CheckTime(m.SignedAt, now); err != nil {
+		return fmt.Errorf("message was %v", err)
+	}
+	return replays.Check(m.Sig, now)
+}
+
+// Function that checks a committed model's dimensions and labels against the
+// federation schema. Runs on the event loop
+func checkModel(m bclass.Model) error {
+	if mynode.schema.Empty() {
+		return fmt.Errorf("no federation schema")
+	}
+	return mynode.schema.CheckModel(m)
+}
+
+// Function that processes join requests and forwards response to Raft nodes,
+// h is the protocol agreed on. Returns the test requests to send the node
+func processJoin(m protocol.Message, h protocol.Hello) ([]outgoing, bool) {
+	//process depending on if it is a new node or a returning one
+	var out []outgoing
+	id, _, ok := lookup(m.NodeName)
+	if !ok {
 		//adding a node that has never been added before
-		repstate := state{0, m}
-		flag = replicate(repstate)
-		if flag {
+		repstate := state{0, m, h, time.Time{}}
+		if !replicate(repstate) {
+			return nil, false
+		}
+		do(func() {
 			for _, v := range mynode.tempmodel {
-				sendTestRequest(m.NodeName, mynode.client[m.NodeName], v.Cnum, v.Model)
+				out = append(out, testRequest(m.NodeName, mynode.client[m.NodeName], v.Cnum, v.Model)...)
 			}
-		}
+		})
 	} else {
 		//node is rejoining, update address and resend the unfinished test requests
-		m.Type = "rejoin_request"
-		repstate := state{0, m}
-		flag = replicate(repstate)
-		if flag {
-			//time.Sleep(time.Duration(2 * time.Second))
+		m.Type = protocol.RejoinRequest
+		repstate := state{0, m, h, time.Time{}}
+		if !replicate(repstate) {
+			return nil, false
+		}
+		do(func() {
 			for k, v := range mynode.testqueue[id] {
 				if v {
 					aggregate := mynode.tempmodel[k]
-					sendTestRequest(m.NodeName, id, aggregate.Cnum, aggregate.Model)
+					markSent(id, k, time.Now())
+					out = append(out, testRequest(m.NodeName, id, aggregate.Cnum, aggregate.Model)...)
 				}
 			}
-		}
+		})
 	}
-	return flag
+	return out, true
+}
+
+// Function that resolves the address a node listens on, nil for nodes that
+// poll instead
+func nodeAddr(ip string) *net.TCPAddr {
+	if ip == "" {
+		return nil
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", ip)
+	return addr
 }
 
 // Input parser
@@ -534,6 +1178,14 @@ func parseArgs() {
 	flag.Parse()
 	inputargs := flag.Args()
 	var err error
+	checkFatal(mtls.Setup(*tlscert, *tlskey, *tlsca))
+	commit, err = policy.Parse(*cpolicy)
+	checkFatal(err)
+	ttimeout, err = time.ParseDuration(*tlimit)
+	if err == nil && ttimeout <= 0 {
+		err = fmt.Errorf("test timeout %v is not positive", ttimeout)
+	}
+	checkFatal(err)
 	if len(inputargs) < 2 {
 		fmt.Printf("Not enough inputs.\n")
 		return
@@ -562,3 +1214,10 @@ func checkError(err error) {
 		//os.Exit(1)
 	}
 }
+
+func checkFatal(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
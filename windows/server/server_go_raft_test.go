@@ -0,0 +1,353 @@
+package main
+
+// The Raft server is a command next to the single one, test it on its own
+// and with the race detector:
+//
+//	go test -race server_go_raft.go server_go_raft_test.go
+
+import (
+	"../bclass"
+	"../data"
+	"../liveness"
+	"../mtls"
+	"../policy"
+	"../protocol"
+	"crypto/ed25519"
+	"fmt"
+	"github.com/arcaneiceman/GoVector/govec"
+	"github.com/coreos/etcd/raft"
+	"github.com/gonum/matrix/mat64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testSchema = data.Schema{Columns: []data.Column{{Name: "x1", Type: data.Numeric}, {Name: "x2", Type: data.Numeric}}, Labels: bclass.DefaultLabels}
+
+// testNode is a node driving the server in a test over TCP to addr, it
+// gives no address so it polls for its test requests
+type testNode struct {
+	name    string
+	key     ed25519.PrivateKey
+	addr    string
+	keys    int
+	version int
+}
+
+func newTestNode(t *testing.T, name, addr string) *testNode {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testNode{name: name, key: key, addr: addr}
+}
+
+// testModel returns a degree 1 model over the test schema
+func testModel(w float64) bclass.Model {
+	return bclass.Model{W: *mat64.NewDense(3, 1, []float64{w, w, w}), Deg: 1, Labels: bclass.DefaultLabels}
+}
+
+// newKey returns a fresh idempotency key, every attempt is a new request
+func (n *testNode) newKey() string {
+	n.keys++
+	return n.name + "-" + strconv.Itoa(n.keys)
+}
+
+// request signs m and sends it over a new connection, which is returned open
+// for what the server sends after the response
+func (n *testNode) request(m protocol.Message) (net.Conn, protocol.Response, error) {
+	m.NodeName = n.name
+	protocol.Sign(&m, n.key)
+	return n.send(m)
+}
+
+// send sends m as it is, see request
+func (n *testNode) send(m protocol.Message) (net.Conn, protocol.Response, error) {
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		return nil, protocol.Response{}, err
+	}
+	if m.Type == protocol.JoinRequest {
+		err = protocol.WriteHello(conn, protocol.NewHello(required...))
+	}
+	if err == nil {
+		err = protocol.Send(conn, logger, m)
+	}
+	var r protocol.Response
+	if err == nil {
+		r, err = protocol.ReadResponse(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, r, err
+	}
+	return conn, r, nil
+}
+
+// code sends m and returns the code of the response
+func (n *testNode) code(m protocol.Message) (protocol.Code, error) {
+	conn, r, err := n.request(m)
+	if err != nil {
+		return r.Code, err
+	}
+	conn.Close()
+	return r.Code, nil
+}
+
+func (n *testNode) join() error {
+	conn, r, err := n.request(protocol.Message{Type: protocol.JoinRequest, Schema: testSchema, PubKey: n.key.Public().(ed25519.PublicKey)})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if r.Code != protocol.Joined {
+		return fmt.Errorf("join: %v", r)
+	}
+	_, err = protocol.ReadHello(conn)
+	return err
+}
+
+// poll returns the commit numbers of the models the node has to test
+func (n *testNode) poll() ([]int, error) {
+	conn, r, err := n.request(protocol.Message{Type: protocol.PollRequest})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if r.Code != protocol.OK {
+		return nil, fmt.Errorf("poll: %v", r)
+	}
+	msgs, err := protocol.ReceiveBatch(conn, logger)
+	var ids []int
+	for _, m := range msgs {
+		if m.Type == protocol.TestRequest {
+			ids = append(ids, m.Id)
+		}
+	}
+	return ids, err
+}
+
+// global fetches the global model when it is newer than the node's
+func (n *testNode) global() error {
+	conn, r, err := n.request(protocol.Message{Type: protocol.GlobalRequest, Version: n.version})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	switch r.Code {
+	case protocol.NotModified:
+		return nil
+	case protocol.OK:
+		m, err := protocol.Receive(conn, logger)
+		if err == nil && m.Type != protocol.GlobalGrant {
+			err = fmt.Errorf("global: got %v", m.Type)
+		}
+		n.version = m.Version
+		return err
+	}
+	return fmt.Errorf("global: %v", r)
+}
+
+// answer tests every model the node polled, counting the results that count
+func (n *testNode) answer(tested *int64) (int, error) {
+	ids, err := n.poll()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		code, err := n.code(protocol.Message{Id: id, Type: protocol.TestComplete, C: 8, D: 10, Key: n.newKey()})
+		if err != nil {
+			return 0, err
+		}
+		switch code {
+		case protocol.OK:
+			atomic.AddInt64(tested, 1)
+		case protocol.Duplicate:
+		default:
+			return 0, fmt.Errorf("results of %v: %v", id, code)
+		}
+	}
+	return len(ids), nil
+}
+
+// Nodes join at once, then commit, poll, test, fetch the global model and
+// beat at once until every model is committed and tested by every other
+// node. Every change goes through a one node Raft cluster, which has to
+// apply each exactly once
+func TestConcurrentNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the server's goroutines outlive the test, so these stay set
+	protocol.PollWait = 20 * time.Millisecond
+	liveness.Interval = 10 * time.Millisecond
+	replicatePoll = 5 * time.Millisecond
+	// a single replica elects itself after an election timeout
+	electionTick, heartbeatTick = 3, 1
+
+	initState()
+	logger = govec.Initialize("server", filepath.Join(dir, "server"))
+	if commit, err = policy.Parse("nodes=1"); err != nil {
+		t.Fatal(err)
+	}
+	ttimeout = time.Minute
+	mynode = newNode(1, []raft.Peer{{ID: 1}})
+	go mynode.run()
+	// Raft refuses to campaign until the node applied its initial conf
+	// change, so it campaigns again until it leads
+	for deadline := time.Now().Add(replicateTimeout); mynode.raft.Status().Lead != mynode.id; {
+		if time.Now().After(deadline) {
+			t.Fatal("the Raft node did not become leader")
+		}
+		mynode.raft.Campaign(mynode.ctx)
+		time.Sleep(10 * time.Millisecond)
+	}
+	go sweep()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go clientListener(ln)
+
+	var nodes []*testNode
+	for i := 0; i < 8; i++ {
+		nodes = append(nodes, newTestNode(t, fmt.Sprintf("node%v", i), ln.Addr().String()))
+	}
+	all := func(f func(i int, n *testNode) error) {
+		var wg sync.WaitGroup
+		for i, n := range nodes {
+			wg.Add(1)
+			go func(i int, n *testNode) {
+				defer wg.Done()
+				if err := f(i, n); err != nil {
+					t.Errorf("%v: %v", n.name, err)
+				}
+			}(i, n)
+		}
+		wg.Wait()
+	}
+
+	all(func(i int, n *testNode) error { return n.join() })
+	if t.Failed() {
+		return
+	}
+	// no node can take the name of the servers' certificates
+	for _, n := range []*testNode{newTestNode(t, mtls.ServerName, ln.Addr().String())} {
+		if err := n.join(); err == nil {
+			t.Errorf("a node joined as %q", n.name)
+		}
+	}
+	// a signed message is accepted once, and only while it is recent
+	beat := protocol.Message{Type: protocol.Heartbeat, NodeName: nodes[0].name}
+	protocol.Sign(&beat, nodes[0].key)
+	stale := beat
+	stale.SignedAt = stale.SignedAt.Add(-2 * protocol.SignWindow)
+	stale.Sig = ed25519.Sign(nodes[0].key, protocol.Digest(stale))
+	for _, tt := range []struct {
+		name string
+		m    protocol.Message
+		ok   bool
+	}{
+		{"fresh", beat, true},
+		{"replayed", beat, false},
+		{"stale", stale, false},
+	} {
+		conn, r, err := nodes[0].send(tt.m)
+		if err == nil {
+			conn.Close()
+		}
+		if ok := err == nil && r.Code == protocol.OK; ok != tt.ok {
+			t.Errorf("%s heartbeat: %v, %v, want ok %v", tt.name, r, err, tt.ok)
+		}
+	}
+	var tested int64
+	all(func(i int, n *testNode) error {
+		for {
+			if _, err := n.answer(&tested); err != nil {
+				return err
+			}
+			code, err := n.code(protocol.Message{Type: protocol.CommitRequest, C: 8, D: 10, Model: testModel(float64(i)), Key: n.newKey()})
+			if err != nil {
+				return err
+			}
+			if err := n.global(); err != nil {
+				return err
+			}
+			if beat, err := n.code(protocol.Message{Type: protocol.Heartbeat}); err != nil || beat != protocol.OK {
+				return fmt.Errorf("heartbeat: %v, %v", beat, err)
+			}
+			switch code {
+			case protocol.OK:
+				return nil
+			case protocol.Pending:
+			default:
+				return fmt.Errorf("commit: %v", code)
+			}
+		}
+	})
+	// every model is committed, test what is left
+	all(func(i int, n *testNode) error {
+		for {
+			if k, err := n.answer(&tested); err != nil || k == 0 {
+				return err
+			}
+		}
+	})
+
+	want := len(nodes) * (len(nodes) - 1)
+	if tested != int64(want) {
+		t.Errorf("%v test results counted, want %v", tested, want)
+	}
+	do(func() {
+		ids := make(map[int]bool)
+		for name, id := range mynode.client {
+			if ids[id] {
+				t.Errorf("%v joined as node%v twice", name, id)
+			}
+			ids[id] = true
+		}
+		if len(mynode.client) != len(nodes) {
+			t.Errorf("%v nodes joined, want %v", len(mynode.client), len(nodes))
+		}
+		for id, queue := range mynode.testqueue {
+			for k, v := range queue {
+				if v {
+					t.Errorf("node%v still has to test model%v", id, k)
+				}
+			}
+		}
+		if len(mynode.tempmodel) != len(nodes) {
+			t.Errorf("%v models committed, want %v", len(mynode.tempmodel), len(nodes))
+		}
+		for id, a := range mynode.tempmodel {
+			if !a.Merged || a.Nodes != len(nodes)-1 {
+				t.Errorf("model%v merged %v after %v tests, want merged after %v", id, a.Merged, a.Nodes, len(nodes)-1)
+			}
+		}
+		// every result meets the commit policy, but only the first merge
+		// of a commit makes a new global model version
+		if gversion != len(nodes) {
+			t.Errorf("global model version %v, want one per commit, %v", gversion, len(nodes))
+		}
+	})
+
+	// results for a model its committer has since replaced are stale, though
+	// the tester has to test the new one
+	var old int
+	do(func() { old = mynode.tempmodel[mynode.client[nodes[0].name]].Cnum })
+	if code, err := nodes[0].code(protocol.Message{Type: protocol.CommitRequest, C: 8, D: 10, Model: testModel(-1), Key: nodes[0].newKey()}); err != nil || code != protocol.OK {
+		t.Fatalf("new commit of %v: %v, %v", nodes[0].name, code, err)
+	}
+	if code, err := nodes[1].code(protocol.Message{Id: old, Type: protocol.TestComplete, C: 8, D: 10, Key: nodes[1].newKey()}); err != nil || code != protocol.Duplicate {
+		t.Errorf("results for replaced commit %v: %v, %v, want %v", old, code, err, protocol.Duplicate)
+	}
+}
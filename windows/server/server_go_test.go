@@ -0,0 +1,474 @@
+package main
+
+// The server is a command next to the Raft one, test it on its own and with
+// the race detector:
+//
+//	go test -race server_go.go server_go_test.go
+
+import (
+	"../bclass"
+	"../data"
+	"../liveness"
+	"../mtls"
+	"../policy"
+	"../protocol"
+	"../wal"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/arcaneiceman/GoVector/govec"
+	"github.com/gonum/matrix/mat64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testSchema = data.Schema{Columns: []data.Column{{Name: "x1", Type: data.Numeric}, {Name: "x2", Type: data.Numeric}}, Labels: bclass.DefaultLabels}
+
+// testNode is a node driving the server in a test, over TCP to addr or, when
+// url is set, over the HTTP/JSON API. Neither gives an address, so both poll
+// for their test requests
+type testNode struct {
+	name    string
+	key     ed25519.PrivateKey
+	addr    string
+	url     string
+	keys    int
+	version int
+}
+
+func newTestNode(t *testing.T, name, addr, url string) *testNode {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testNode{name: name, key: key, addr: addr, url: url}
+}
+
+// testModel returns a degree 1 model over the test schema
+func testModel(w float64) bclass.Model {
+	return bclass.Model{W: *mat64.NewDense(3, 1, []float64{w, w, w}), Deg: 1, Labels: bclass.DefaultLabels}
+}
+
+// newKey returns a fresh idempotency key, every attempt is a new request
+func (n *testNode) newKey() string {
+	n.keys++
+	return n.name + "-" + strconv.Itoa(n.keys)
+}
+
+// request signs m and sends it over a new connection, which is returned open
+// for what the server sends after the response
+func (n *testNode) request(m protocol.Message) (net.Conn, protocol.Response, error) {
+	m.NodeName = n.name
+	protocol.Sign(&m, n.key)
+	return n.send(m)
+}
+
+// send sends m as it is, see request
+func (n *testNode) send(m protocol.Message) (net.Conn, protocol.Response, error) {
+	conn, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		return nil, protocol.Response{}, err
+	}
+	if m.Type == protocol.JoinRequest {
+		err = protocol.WriteHello(conn, protocol.NewHello(required...))
+	}
+	if err == nil {
+		err = protocol.Send(conn, logger, m)
+	}
+	var r protocol.Response
+	if err == nil {
+		r, err = protocol.ReadResponse(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, r, err
+	}
+	return conn, r, nil
+}
+
+// call signs an HTTP request and decodes its answer into out when it is
+// 200 OK and out is given, and into the returned response otherwise
+func (n *testNode) call(method, path string, body interface{}, header http.Header, out interface{}) (protocol.Response, error) {
+	var payload []byte
+	target := n.url + path
+	if method == http.MethodGet {
+		payload = []byte("name=" + n.name)
+		target += "?" + string(payload)
+	} else {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return protocol.Response{}, err
+		}
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// identical requests within a second would be replays
+	at := time.Now().UTC().Format(time.RFC3339Nano)
+	req.Header.Set(protocol.TimeHeader, at)
+	req.Header.Set(protocol.SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(n.key, protocol.Signed(method, path, at, payload))))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		// 304 has no body
+		return protocol.Response{Code: protocol.NotModified}, nil
+	}
+	if resp.StatusCode == http.StatusOK && out != nil {
+		return protocol.Response{Code: protocol.OK}, json.NewDecoder(resp.Body).Decode(out)
+	}
+	var r protocol.Response
+	return r, json.NewDecoder(resp.Body).Decode(&r)
+}
+
+func (n *testNode) join() error {
+	pub := n.key.Public().(ed25519.PublicKey)
+	if n.url != "" {
+		r, err := n.call(http.MethodPost, "/v1/join", protocol.JoinBody{Name: n.name, Schema: testSchema, PubKey: pub, Hello: protocol.NewHello(protocol.FeatureSigned, protocol.ModelBclass)}, nil, nil)
+		if err == nil && r.Code != protocol.Joined {
+			err = fmt.Errorf("join: %v", r)
+		}
+		return err
+	}
+	conn, r, err := n.request(protocol.Message{Type: protocol.JoinRequest, Schema: testSchema, PubKey: pub})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if r.Code != protocol.Joined {
+		return fmt.Errorf("join: %v", r)
+	}
+	_, err = protocol.ReadHello(conn)
+	return err
+}
+
+// poll returns the commit numbers of the models the node has to test
+func (n *testNode) poll() ([]int, error) {
+	var ids []int
+	if n.url != "" {
+		var tests []protocol.TestItem
+		r, err := n.call(http.MethodGet, "/v1/tests", nil, nil, &tests)
+		if err == nil && r.Code != protocol.OK {
+			err = fmt.Errorf("tests: %v", r)
+		}
+		for _, m := range tests {
+			ids = append(ids, m.Id)
+		}
+		return ids, err
+	}
+	conn, r, err := n.request(protocol.Message{Type: protocol.PollRequest})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if r.Code != protocol.OK {
+		return nil, fmt.Errorf("poll: %v", r)
+	}
+	msgs, err := protocol.ReceiveBatch(conn, logger)
+	for _, m := range msgs {
+		if m.Type == protocol.TestRequest {
+			ids = append(ids, m.Id)
+		}
+	}
+	return ids, err
+}
+
+// result reports the test of commit id, the code says whether it counted
+func (n *testNode) result(id int) (protocol.Code, error) {
+	key := n.newKey()
+	if n.url != "" {
+		r, err := n.call(http.MethodPost, "/v1/results", protocol.ResultBody{Name: n.name, Id: id, C: 8, D: 10, Key: key}, nil, nil)
+		return r.Code, err
+	}
+	conn, r, err := n.request(protocol.Message{Id: id, Type: protocol.TestComplete, C: 8, D: 10, Key: key})
+	if err != nil {
+		return r.Code, err
+	}
+	conn.Close()
+	return r.Code, nil
+}
+
+func (n *testNode) commit(m bclass.Model) (protocol.Code, error) {
+	key := n.newKey()
+	if n.url != "" {
+		r, err := n.call(http.MethodPost, "/v1/commit", protocol.CommitBody{Name: n.name, C: 8, D: 10, Model: m, Key: key}, nil, nil)
+		return r.Code, err
+	}
+	conn, r, err := n.request(protocol.Message{Type: protocol.CommitRequest, C: 8, D: 10, Model: m, Key: key})
+	if err != nil {
+		return r.Code, err
+	}
+	conn.Close()
+	return r.Code, nil
+}
+
+// global fetches the global model when it is newer than the node's
+func (n *testNode) global() error {
+	if n.url != "" {
+		var g protocol.GlobalBody
+		r, err := n.call(http.MethodGet, "/v1/global", nil, http.Header{protocol.NewerHeader: {strconv.Itoa(n.version)}}, &g)
+		if err != nil || (r.Code != protocol.OK && r.Code != protocol.NotModified) {
+			return fmt.Errorf("global: %v, %v", r, err)
+		}
+		if r.Code == protocol.OK {
+			n.version = g.Version
+		}
+		return nil
+	}
+	conn, r, err := n.request(protocol.Message{Type: protocol.GlobalRequest, Version: n.version})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	switch r.Code {
+	case protocol.NotModified:
+		return nil
+	case protocol.OK:
+		m, err := protocol.Receive(conn, logger)
+		if err == nil && m.Type != protocol.GlobalGrant {
+			err = fmt.Errorf("global: got %v", m.Type)
+		}
+		n.version = m.Version
+		return err
+	}
+	return fmt.Errorf("global: %v", r)
+}
+
+func (n *testNode) heartbeat() error {
+	var r protocol.Response
+	var err error
+	if n.url != "" {
+		var status protocol.StatusBody
+		if r, err = n.call(http.MethodGet, "/v1/heartbeat", nil, nil, nil); err == nil && r.Code == protocol.OK {
+			r, err = n.call(http.MethodGet, "/v1/status", nil, nil, &status)
+		}
+	} else {
+		var conn net.Conn
+		if conn, r, err = n.request(protocol.Message{Type: protocol.Heartbeat}); err == nil {
+			conn.Close()
+		}
+	}
+	if err == nil && r.Code != protocol.OK {
+		err = fmt.Errorf("heartbeat: %v", r)
+	}
+	return err
+}
+
+// answer tests every model the node polled, counting the results that count
+func (n *testNode) answer(tested *int64) (int, error) {
+	ids, err := n.poll()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		code, err := n.result(id)
+		if err != nil {
+			return 0, err
+		}
+		switch code {
+		case protocol.OK:
+			atomic.AddInt64(tested, 1)
+		case protocol.Duplicate:
+		default:
+			return 0, fmt.Errorf("results of %v: %v", id, code)
+		}
+	}
+	return len(ids), nil
+}
+
+// Nodes join over TCP and HTTP at once, then commit, poll, test, fetch the
+// global model and beat at once until every model is committed and tested by
+// every other node. The server has to account for each exactly once
+func TestConcurrentNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the server's goroutines outlive the test, so these stay set
+	protocol.PollWait = 20 * time.Millisecond
+	liveness.Interval = 10 * time.Millisecond
+	wal.SnapshotEvery = 16
+
+	initState()
+	logger = govec.Initialize("server", filepath.Join(dir, "server"))
+	if commit, err = policy.Parse("nodes=1"); err != nil {
+		t.Fatal(err)
+	}
+	ttimeout = time.Minute
+	if journal, err = wal.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	go loop()
+	go sweep()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go connHandler(conn)
+		}
+	}()
+	hs := httptest.NewServer(apiMux())
+	defer hs.Close()
+
+	const tcpNodes, httpNodes = 6, 6
+	var nodes []*testNode
+	for i := 0; i < tcpNodes; i++ {
+		nodes = append(nodes, newTestNode(t, fmt.Sprintf("tcp%v", i), ln.Addr().String(), ""))
+	}
+	for i := 0; i < httpNodes; i++ {
+		nodes = append(nodes, newTestNode(t, fmt.Sprintf("http%v", i), "", hs.URL))
+	}
+	all := func(f func(i int, n *testNode) error) {
+		var wg sync.WaitGroup
+		for i, n := range nodes {
+			wg.Add(1)
+			go func(i int, n *testNode) {
+				defer wg.Done()
+				if err := f(i, n); err != nil {
+					t.Errorf("%v: %v", n.name, err)
+				}
+			}(i, n)
+		}
+		wg.Wait()
+	}
+
+	all(func(i int, n *testNode) error { return n.join() })
+	if t.Failed() {
+		return
+	}
+	// no node can take the name of the servers' certificates
+	for _, n := range []*testNode{newTestNode(t, mtls.ServerName, ln.Addr().String(), ""), newTestNode(t, mtls.ServerName, "", hs.URL)} {
+		if err := n.join(); err == nil {
+			t.Errorf("a node joined as %q", n.name)
+		}
+	}
+	// a signed message is accepted once, and only while it is recent
+	beat := protocol.Message{Type: protocol.Heartbeat, NodeName: nodes[0].name}
+	protocol.Sign(&beat, nodes[0].key)
+	stale := beat
+	stale.SignedAt = stale.SignedAt.Add(-2 * protocol.SignWindow)
+	stale.Sig = ed25519.Sign(nodes[0].key, protocol.Digest(stale))
+	for _, tt := range []struct {
+		name string
+		m    protocol.Message
+		ok   bool
+	}{
+		{"fresh", beat, true},
+		{"replayed", beat, false},
+		{"stale", stale, false},
+	} {
+		conn, r, err := nodes[0].send(tt.m)
+		if err == nil {
+			conn.Close()
+		}
+		if ok := err == nil && r.Code == protocol.OK; ok != tt.ok {
+			t.Errorf("%s heartbeat: %v, %v, want ok %v", tt.name, r, err, tt.ok)
+		}
+	}
+	var tested int64
+	all(func(i int, n *testNode) error {
+		for {
+			if _, err := n.answer(&tested); err != nil {
+				return err
+			}
+			code, err := n.commit(testModel(float64(i)))
+			if err != nil {
+				return err
+			}
+			if err := n.global(); err != nil {
+				return err
+			}
+			if err := n.heartbeat(); err != nil {
+				return err
+			}
+			switch code {
+			case protocol.OK:
+				return nil
+			case protocol.Pending:
+			default:
+				return fmt.Errorf("commit: %v", code)
+			}
+		}
+	})
+	// every model is committed, test what is left
+	all(func(i int, n *testNode) error {
+		for {
+			if k, err := n.answer(&tested); err != nil || k == 0 {
+				return err
+			}
+		}
+	})
+
+	want := len(nodes) * (len(nodes) - 1)
+	if tested != int64(want) {
+		t.Errorf("%v test results counted, want %v", tested, want)
+	}
+	do(func() {
+		ids := make(map[int]bool)
+		for name, id := range client {
+			if ids[id] {
+				t.Errorf("%v joined as node%v twice", name, id)
+			}
+			ids[id] = true
+		}
+		if len(client) != len(nodes) {
+			t.Errorf("%v nodes joined, want %v", len(client), len(nodes))
+		}
+		for id, queue := range testqueue {
+			for k, v := range queue {
+				if v {
+					t.Errorf("node%v still has to test model%v", id, k)
+				}
+			}
+		}
+		if len(tempmodel) != len(nodes) {
+			t.Errorf("%v models committed, want %v", len(tempmodel), len(nodes))
+		}
+		for id, a := range tempmodel {
+			if !a.Merged || a.Nodes != len(nodes)-1 {
+				t.Errorf("model%v merged %v after %v tests, want merged after %v", id, a.Merged, a.Nodes, len(nodes)-1)
+			}
+		}
+		// every result meets the commit policy, but only the first merge
+		// of a commit makes a new global model version
+		if gversion != len(nodes) {
+			t.Errorf("global model version %v, want one per commit, %v", gversion, len(nodes))
+		}
+	})
+
+	// results for a model its committer has since replaced are stale, though
+	// the tester has to test the new one
+	var old int
+	do(func() { old = tempmodel[client[nodes[0].name]].Cnum })
+	if code, err := nodes[0].commit(testModel(-1)); err != nil || code != protocol.OK {
+		t.Fatalf("new commit of %v: %v, %v", nodes[0].name, code, err)
+	}
+	if code, err := nodes[1].result(old); err != nil || code != protocol.Duplicate {
+		t.Errorf("results for replaced commit %v: %v, %v, want %v", old, code, err, protocol.Duplicate)
+	}
+}
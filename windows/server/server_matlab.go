@@ -2,7 +2,8 @@ package main
 
 import (
 	"../distmlMatlab"
-	"encoding/gob"
+	"../frame"
+	"../protocol"
 	"flag"
 	"fmt"
 	"github.com/arcaneiceman/GoVector/govec"
@@ -31,6 +32,10 @@ var (
 	gempty    distmlMatlab.MatGlobalModel
 )
 
+// myhello is what this server speaks, every feature of it is required of
+// joining nodes
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.ModelMatlab)
+
 type aggregate struct {
 	cnum  int
 	model distmlMatlab.MatModel
@@ -43,16 +48,11 @@ type message struct {
 	Id       int
 	NodeIp   string
 	NodeName string
-	Type     string
+	Type     protocol.Kind
 	Model    distmlMatlab.MatModel
 	GModel   distmlMatlab.MatGlobalModel
 }
 
-type response struct {
-	Resp  string
-	Error string
-}
-
 func main() {
 	//Initialize
 	client = make(map[string]int)
@@ -61,7 +61,7 @@ func main() {
 	modelR = make(map[int]map[int]float64)
 	modelC = make(map[int]float64)
 	modelD = 0.0
-	gmodel = distmlMatlab.MatGlobalModel{nil}
+	gmodel = distmlMatlab.MatGlobalModel{}
 	tempmodel = make(map[int]aggregate)
 	testqueue = make(map[int]map[int]bool)
 	cnumhist = make(map[int]int)
@@ -89,15 +89,36 @@ func main() {
 
 }
 
+// Function that reads a node's message, a join is preceded by the node's
+// hello, which has to be compatible before the join itself is decoded
+func receive(conn net.Conn, msg *message) (*protocol.Hello, error) {
+	hello, p, err := protocol.ReadFirst(conn)
+	if err != nil {
+		return nil, err
+	}
+	if hello != nil {
+		agreed, err := protocol.Negotiate(*hello, myhello, myhello.Features...)
+		if err != nil {
+			frame.NewEncoder(conn).Encode(protocol.Response{Code: protocol.Incompatible, Error: err.Error()})
+			return nil, err
+		}
+		hello = &agreed
+	}
+	return hello, protocol.DecodeNext(conn, p, msg)
+}
+
 // Function for handling client requests
 func connHandler(conn *net.TCPConn) {
 	var msg message
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	err := dec.Decode(&msg)
-	checkError(err)
+	enc := frame.NewEncoder(conn)
+	hello, err := receive(conn, &msg)
+	if err != nil {
+		fmt.Printf("*** Could not read message from %v: %v.\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
 	switch msg.Type {
-	case "commit_request":
+	case protocol.CommitRequest:
 		//node is sending a model, must forward to others for testing
 		flag := checkQueue(client[msg.NodeName])
 		fmt.Printf("<-- Received commit request from %v.\n", msg.NodeName)
@@ -106,38 +127,46 @@ func connHandler(conn *net.TCPConn) {
 			processTestRequest(msg, conn)
 		} else {
 			// deny commit request
-			enc.Encode(response{"NO", "Pending tests are not complete"})
+			enc.Encode(protocol.Response{Code: protocol.Pending})
 			fmt.Printf("--> Denied commit request from %v.\n", msg.NodeName)
 			conn.Close()
 		}
-	case "global_request":
+	case protocol.GlobalRequest:
 		//node is requesting the global model, will forward
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		fmt.Printf("<-- Received global model request from %v.\n", msg.NodeName)
 		genGlobalModel()
 		sendGlobal(msg)
 		conn.Close()
-	case "test_complete":
+	case protocol.TestComplete:
 		// node is submitting test results, update testqueue on all replicas
 		fmt.Printf("<-- Received completed test results from %v.\n", msg.NodeName)
 		//update the pending commit and merge if complete
 		if testqueue[client[msg.NodeName]][cnumhist[msg.Id]] {
 			testqueue[client[msg.NodeName]][cnumhist[msg.Id]] = false
 			channel <- msg
-			enc.Encode(response{"OK", "Test Processed"})
+			enc.Encode(protocol.Response{Code: protocol.OK})
 		} else {
 			// if testqueue is already empty
-			enc.Encode(response{"NO", "Duplicate Test"})
+			enc.Encode(protocol.Response{Code: protocol.Duplicate})
 			fmt.Printf("--> Ignored test results from %v.\n", msg.NodeName)
 		}
 		conn.Close()
-	case "join_request":
+	case protocol.JoinRequest:
+		if hello == nil {
+			// the node's messages can't be trusted to decode
+			enc.Encode(protocol.Response{Code: protocol.Incompatible, Error: protocol.ErrNoHello.Error()})
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, protocol.ErrNoHello)
+			conn.Close()
+			break
+		}
 		processJoin(msg)
-		enc.Encode(response{"OK", "Joined"})
+		enc.Encode(protocol.Response{Code: protocol.Joined})
+		protocol.WriteHello(conn, *hello)
 		conn.Close()
 	default:
 		fmt.Printf("something weird happened!\n")
-		enc.Encode(response{"NO", "Unknown Request"})
+		enc.Encode(protocol.Response{Code: protocol.Unknown, Error: string(msg.Type)})
 		conn.Close()
 	}
 
@@ -183,7 +212,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 	tempcnum := cnum
 	cnum++
 	cnumhist[tempcnum] = client[m.NodeName]
-	enc := gob.NewEncoder(conn)
+	enc := frame.NewEncoder(conn)
 	//initialize new aggregate
 	tempweight := make(map[int]float64)
 	r := m.Model.Weight
@@ -205,7 +234,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 	//sanitize the model for testing
 	m.Model.Weight = 0.0
 	m.Model.Size = 0.0
-	enc.Encode(response{"OK", "Committed"})
+	enc.Encode(protocol.Response{Code: protocol.Committed})
 	conn.Close()
 	for name, id := range client {
 		if id != client[m.NodeName] {
@@ -217,7 +246,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 // Function that sends test requests via TCP
 func sendTestRequest(name string, id, tcnum int, tmodel distmlMatlab.MatModel) {
 	//create test request
-	msg := message{tcnum, myaddr.String(), "server", "test_request", tmodel, gempty}
+	msg := message{tcnum, myaddr.String(), "server", protocol.TestRequest, tmodel, gempty}
 	//send the request
 	fmt.Printf("--> Sending test request from %v to %v.", cnumhist[tcnum], name)
 	err := tcpSend(claddr[id], msg)
@@ -251,7 +280,7 @@ func sendTestRequest(name string, id, tcnum int, tmodel distmlMatlab.MatModel) {
 // Function to forward global model
 func sendGlobal(m message) {
 	fmt.Printf("--> Sending global model to %v.", m.NodeName)
-	msg := message{m.Id, myaddr.String(), "server", "global_grant", m.Model, gmodel}
+	msg := message{m.Id, myaddr.String(), "server", protocol.GlobalGrant, m.Model, gmodel}
 	tcpSend(claddr[client[m.NodeName]], msg)
 }
 
@@ -259,17 +288,17 @@ func sendGlobal(m message) {
 func tcpSend(addr *net.TCPAddr, msg message) error {
 	conn, err := net.DialTCP("tcp", nil, addr)
 	if err == nil {
-		enc := gob.NewEncoder(conn)
-		dec := gob.NewDecoder(conn)
+		enc := frame.NewEncoder(conn)
+		dec := frame.NewDecoder(conn)
 		err := enc.Encode(msg)
 		checkError(err)
-		var r response
+		var r protocol.Response
 		err = dec.Decode(&r)
 		checkError(err)
-		if r.Resp == "OK" {
+		if r.Accepted() {
 			fmt.Printf(" [OK]\n")
 		} else {
-			fmt.Printf(" [%s]\n<-- Request was denied by node: %v.\nEnter command: ", r.Resp, r.Error)
+			fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", r)
 		}
 	}
 	return err
@@ -6,6 +6,8 @@ import (
 	"flag"
 	"fmt"
 	"github.com/4180122/distbayes/distmlMatlab"
+	"github.com/4180122/distbayes/frame"
+	"github.com/4180122/distbayes/protocol"
 	"github.com/arcaneiceman/GoVector/govec"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
@@ -37,6 +39,10 @@ var (
 	mynode  *node
 )
 
+// myhello is what this server speaks, every feature of it is required of
+// joining nodes
+var myhello = protocol.NewHello(protocol.FeatureFrame, protocol.ModelMatlab)
+
 type node struct {
 	id        uint64
 	ctx       context.Context
@@ -72,16 +78,11 @@ type message struct {
 	Id       int
 	NodeIp   string
 	NodeName string
-	Type     string
+	Type     protocol.Kind
 	Model    distmlMatlab.MatModel
 	GModel   distmlMatlab.MatGlobalModel
 }
 
-type response struct {
-	Resp  string
-	Error string
-}
-
 // Function to initialize a new Raft node
 func newNode(id uint64, peers []raft.Peer) *node {
 	store := raft.NewMemoryStorage()
@@ -155,7 +156,7 @@ func (n *node) send(messages []raftpb.Message) {
 	for _, m := range messages {
 		conn, err := net.Dial("tcp", naddr[int(m.To)])
 		if err == nil {
-			enc := gob.NewEncoder(conn)
+			enc := frame.NewEncoder(conn)
 			enc.Encode(m)
 		} else {
 			fmt.Printf("*** Could not send message to Raft node: %v.\n", int(m.To))
@@ -167,7 +168,7 @@ func (n *node) send(messages []raftpb.Message) {
 func (n *node) receive(conn *net.TCPConn) {
 	// Echo all incoming data.
 	var imsg raftpb.Message
-	dec := gob.NewDecoder(conn)
+	dec := frame.NewDecoder(conn)
 	err := dec.Decode(&imsg)
 	checkError(err)
 	conn.Close()
@@ -189,7 +190,7 @@ func (n *node) process(entry raftpb.Entry) {
 		dec.Decode(&repstate)
 		msg := repstate.Msg
 		switch msg.Type {
-		case "join_request":
+		case protocol.JoinRequest:
 			id := n.maxnode
 			n.maxnode++
 			n.client[msg.NodeName] = id
@@ -200,10 +201,10 @@ func (n *node) process(entry raftpb.Entry) {
 			}
 			n.testqueue[id] = queue
 			fmt.Printf("--- Added %v as node%v.\n", msg.NodeName, id)
-		case "rejoin_request":
+		case protocol.RejoinRequest:
 			id := n.client[msg.NodeName]
 			n.claddr[id], _ = net.ResolveTCPAddr("tcp", msg.NodeIp)
-		case "commit_request":
+		case protocol.CommitRequest:
 			tempcnum := n.cnum
 			n.cnum++
 			n.cnumhist[tempcnum] = n.client[msg.NodeName]
@@ -225,7 +226,7 @@ func (n *node) process(entry raftpb.Entry) {
 				}
 			}
 			fmt.Printf("--- Processed commit %v for node %v.\n", tempcnum, msg.NodeName)
-		case "test_complete":
+		case protocol.TestComplete:
 			n.testqueue[n.client[msg.NodeName]][n.cnumhist[msg.Id]] = false
 			channel <- msg
 		default:
@@ -278,7 +279,7 @@ func main() {
 	modelR = make(map[int]map[int]float64)
 	modelC = make(map[int]float64)
 	modelD = 0.0
-	gmodel = distmlMatlab.MatGlobalModel{nil}
+	gmodel = distmlMatlab.MatGlobalModel{}
 	channel = make(chan message)
 	// start a cluster R = 7
 	//mynode = newNode(uint64(nID), []raft.Peer{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}, {ID: 6}, {ID: 7}})
@@ -336,15 +337,36 @@ func clientListener(listen *net.TCPListener) {
 	}
 }
 
+// Function that reads a node's message, a join is preceded by the node's
+// hello, which has to be compatible before the join itself is decoded
+func receive(conn net.Conn, msg *message) (*protocol.Hello, error) {
+	hello, p, err := protocol.ReadFirst(conn)
+	if err != nil {
+		return nil, err
+	}
+	if hello != nil {
+		agreed, err := protocol.Negotiate(*hello, myhello, myhello.Features...)
+		if err != nil {
+			frame.NewEncoder(conn).Encode(protocol.Response{Code: protocol.Incompatible, Error: err.Error()})
+			return nil, err
+		}
+		hello = &agreed
+	}
+	return hello, protocol.DecodeNext(conn, p, msg)
+}
+
 // Function for handling client requests and replicating on Raft if necessary
 func connHandler(conn *net.TCPConn) {
 	var msg message
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	err := dec.Decode(&msg)
-	checkError(err)
+	enc := frame.NewEncoder(conn)
+	hello, err := receive(conn, &msg)
+	if err != nil {
+		fmt.Printf("*** Could not read message from %v: %v.\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
 	switch msg.Type {
-	case "commit_request":
+	case protocol.CommitRequest:
 		// node is sending a model, checking to see if testing is complete
 		flag := checkQueue(mynode.client[msg.NodeName])
 		fmt.Printf("<-- Received commit request from %v.\n", msg.NodeName)
@@ -353,49 +375,57 @@ func connHandler(conn *net.TCPConn) {
 			processTestRequest(msg, conn)
 		} else {
 			// deny commit request
-			enc.Encode(response{"NO", "Restart"})
+			enc.Encode(protocol.Response{Code: protocol.Restart})
 			fmt.Printf("--> Denied commit request from %v.\n", msg.NodeName)
 			conn.Close()
 		}
-	case "global_request":
+	case protocol.GlobalRequest:
 		// node is requesting the global model -> generate and forward
-		enc.Encode(response{"OK", ""})
+		enc.Encode(protocol.Response{Code: protocol.OK})
 		fmt.Printf("<-- Received global model request from %v.\n", msg.NodeName)
 		genGlobalModel()
 		sendGlobal(msg)
 		conn.Close()
-	case "test_complete":
+	case protocol.TestComplete:
 		// node is submitting test results, update testqueue on all replicas
 		fmt.Printf("<-- Received completed test results from %v.\n", msg.NodeName)
 		if mynode.testqueue[mynode.client[msg.NodeName]][mynode.cnumhist[msg.Id]] {
 			repstate := state{0, msg}
 			flag := replicate(repstate)
 			if flag {
-				enc.Encode(response{"OK", "Test Processed"})
+				enc.Encode(protocol.Response{Code: protocol.OK})
 			} else {
 				// if testqueue could not be replicated
-				enc.Encode(response{"NO", "Try Again"})
+				enc.Encode(protocol.Response{Code: protocol.Retry})
 			}
 		} else {
 			// if testqueue is already empty
-			enc.Encode(response{"NO", "Duplicate Test"})
+			enc.Encode(protocol.Response{Code: protocol.Duplicate})
 			fmt.Printf("--> Ignored test results from %v.\n", msg.NodeName)
 		}
 		conn.Close()
-	case "join_request":
+	case protocol.JoinRequest:
+		if hello == nil {
+			// the node's messages can't be trusted to decode
+			enc.Encode(protocol.Response{Code: protocol.Incompatible, Error: protocol.ErrNoHello.Error()})
+			fmt.Printf("--> Denied join request from %v: %v.\n", msg.NodeName, protocol.ErrNoHello)
+			conn.Close()
+			break
+		}
 		// node is requesting to join or rejoin
 		fmt.Printf("<-- Received join request from %v.\n", msg.NodeName)
 		flag := processJoin(msg)
 		if flag {
-			enc.Encode(response{"OK", "Joined"})
+			enc.Encode(protocol.Response{Code: protocol.Joined})
+			protocol.WriteHello(conn, *hello)
 		} else {
 			fmt.Printf("*** Could not process join for node %v.\n", msg.NodeName)
-			enc.Encode(response{"NO", "Failed Join"})
+			enc.Encode(protocol.Response{Code: protocol.Retry, Error: "join was not replicated"})
 		}
 		conn.Close()
 	default:
 		fmt.Printf("something weird happened!\n")
-		enc.Encode(response{"NO", "Unknown Request"})
+		enc.Encode(protocol.Response{Code: protocol.Unknown, Error: string(msg.Type)})
 		conn.Close()
 	}
 }
@@ -440,7 +470,7 @@ func genGlobalModel() {
 func processTestRequest(m message, conn *net.TCPConn) {
 	repstate := state{0, m}
 	flag := replicate(repstate)
-	enc := gob.NewEncoder(conn)
+	enc := frame.NewEncoder(conn)
 	if flag {
 		//sanitize the model for testing
 		m.Model.Weight = 0.0
@@ -452,7 +482,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 				tempcnum = k
 			}
 		}
-		enc.Encode(response{"OK", "Committed"})
+		enc.Encode(protocol.Response{Code: protocol.Committed})
 		conn.Close()
 		for name, id := range mynode.client {
 			if id != mynode.client[m.NodeName] {
@@ -460,7 +490,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 			}
 		}
 	} else {
-		enc.Encode(response{"NO", "Try Again!"})
+		enc.Encode(protocol.Response{Code: protocol.Retry})
 		conn.Close()
 		fmt.Printf("--> Failed to commit request from %v.\n", m.NodeName)
 	}
@@ -469,7 +499,7 @@ func processTestRequest(m message, conn *net.TCPConn) {
 // Function that sends test requests via TCP
 func sendTestRequest(name string, id, tcnum int, tmodel distmlMatlab.MatModel) {
 	//create test request
-	msg := message{tcnum, "server", "server", "test_request", tmodel, gempty}
+	msg := message{tcnum, "server", "server", protocol.TestRequest, tmodel, gempty}
 	//send the request
 	fmt.Printf("--> Sending test request from %v to %v.", mynode.cnumhist[tcnum], name)
 	err := tcpSend(mynode.claddr[id], msg)
@@ -481,7 +511,7 @@ func sendTestRequest(name string, id, tcnum int, tmodel distmlMatlab.MatModel) {
 // Function to forward global model
 func sendGlobal(m message) {
 	fmt.Printf("--> Sending global model to %v.", m.NodeName)
-	msg := message{m.Id, myaddr.String(), "server", "global_grant", m.Model, gmodel}
+	msg := message{m.Id, myaddr.String(), "server", protocol.GlobalGrant, m.Model, gmodel}
 	tcpSend(mynode.claddr[mynode.client[m.NodeName]], msg)
 }
 
@@ -489,17 +519,17 @@ func sendGlobal(m message) {
 func tcpSend(addr *net.TCPAddr, msg message) error {
 	conn, err := net.DialTCP("tcp", nil, addr)
 	if err == nil {
-		enc := gob.NewEncoder(conn)
-		dec := gob.NewDecoder(conn)
+		enc := frame.NewEncoder(conn)
+		dec := frame.NewDecoder(conn)
 		err := enc.Encode(msg)
 		checkError(err)
-		var r response
+		var r protocol.Response
 		err = dec.Decode(&r)
 		checkError(err)
-		if r.Resp == "OK" {
+		if r.Accepted() {
 			fmt.Printf(" [OK]\n")
 		} else {
-			fmt.Printf(" [%s]\n<-- Request was denied by node: %v.\nEnter command: ", r.Resp, r.Error)
+			fmt.Printf(" [NO]\n<-- Request was denied by node: %v.\nEnter command: ", r)
 		}
 	}
 	return err
@@ -532,7 +562,7 @@ func processJoin(m message) bool {
 		}
 	} else {
 		//node is rejoining, update address and resend the unfinished test requests
-		m.Type = "rejoin_request"
+		m.Type = protocol.RejoinRequest
 		repstate := state{0, m}
 		flag = replicate(repstate)
 		if flag {
@@ -3,10 +3,9 @@ package main
 import (
 	"fmt"
 	"github.com/4180122/distbayes/bclass"
+	"github.com/4180122/distbayes/data"
 	"github.com/gonum/matrix/mat64"
-	"io/ioutil"
-	"strconv"
-	"strings"
+	"os"
 )
 
 func main() {
@@ -90,7 +89,7 @@ func main() {
 		}
 	}
 
-	modelg := bclass.GlobalModel{modlist, C, dmax}
+	modelg := bclass.GlobalModel{ModelList: modlist, TestSize: C, D: dmax}
 
 	// v_hatg := modelg.Predict(t)
 	// cg, dg := bclass.TestResults(v_hatg, v)
@@ -110,17 +109,10 @@ func main() {
 }
 
 func ReadData(filename string) *mat64.Dense {
-	dat, _ := ioutil.ReadFile(filename)
-	array := strings.Split(string(dat), "\n")
-	r := len(array) - 1
-	temp := strings.Split(array[0], ",")
-	c := len(temp)
-	vdat := make([]float64, c*r)
-	for i := 0; i < r; i++ {
-		temp = strings.Split(array[i], ",")
-		for j := 0; j < c; j++ {
-			vdat[i*c+j], _ = strconv.ParseFloat(temp[j], 64)
-		}
+	x, err := data.ReadDense(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
+		os.Exit(1)
 	}
-	return mat64.NewDense(r, c, vdat)
+	return x
 }
@@ -0,0 +1,226 @@
+// Package wal keeps a server's state in a data directory, so a restarted
+// server carries on where it stopped. The directory holds a snapshot of the
+// whole state and a write-ahead log of every change since. Records are gob
+// encoded and synced to disk before Append returns, every SnapshotEvery
+// records the state is written out anew and the log starts over.
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SnapshotEvery is how many records are logged before Due asks for a
+// snapshot.
+var SnapshotEvery = 1000
+
+const (
+	logFile      = "wal"
+	snapshotFile = "snapshot"
+	// length, CRC-32 of the record and sequence number
+	headerSize = 16
+)
+
+// Log is the write-ahead log and snapshot of one data directory. Records are
+// numbered, the snapshot notes the last record it contains, so records still
+// in the log after a crash during Snapshot are not applied twice.
+type Log struct {
+	mu  sync.Mutex
+	dir string
+	f   *os.File
+	seq uint64
+	n   int
+	end int64
+	// Torn is how many bytes of a record cut short by a crash Replay dropped.
+	Torn int64
+}
+
+// Record is one logged change, Decode fills in the value it was logged from.
+type Record []byte
+
+func (r Record) Decode(v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(r)).Decode(v)
+}
+
+// Open opens the log in dir, creating the directory if needed.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{dir: dir, f: f}, nil
+}
+
+// ReadSnapshot decodes the snapshot into v, it returns false when there is
+// none yet.
+func (l *Log) ReadSnapshot(v interface{}) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(b) < 8 {
+		return false, fmt.Errorf("snapshot of %v bytes is too short", len(b))
+	}
+	l.seq = binary.BigEndian.Uint64(b)
+	if err := gob.NewDecoder(bytes.NewReader(b[8:])).Decode(v); err != nil {
+		return false, fmt.Errorf("snapshot: %v", err)
+	}
+	return true, nil
+}
+
+// Replay calls apply with every record logged after the snapshot read by
+// ReadSnapshot, in order, and returns how many there were. The log ends at a
+// record cut short or garbled by a crash, which is cut off so new records
+// follow the last whole one.
+func (l *Log) Replay(apply func(r Record) error) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := l.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var end int64
+	for {
+		var head [headerSize]byte
+		if _, err := io.ReadFull(l.f, head[:]); err != nil {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(head[0:]))
+		sum := binary.BigEndian.Uint32(head[4:])
+		seq := binary.BigEndian.Uint64(head[8:])
+		if end+headerSize+size > fi.Size() {
+			break
+		}
+		r := make(Record, size)
+		if _, err := io.ReadFull(l.f, r); err != nil || crc32.ChecksumIEEE(r) != sum {
+			break
+		}
+		end += headerSize + size
+		if seq <= l.seq {
+			// already in the snapshot
+			continue
+		}
+		if err := apply(r); err != nil {
+			return l.n, fmt.Errorf("record %v: %v", seq, err)
+		}
+		l.seq = seq
+		l.n++
+	}
+	if l.Torn = fi.Size() - end; l.Torn > 0 {
+		if err := l.f.Truncate(end); err != nil {
+			return l.n, err
+		}
+	}
+	l.end = end
+	_, err = l.f.Seek(end, io.SeekStart)
+	return l.n, err
+}
+
+// Append logs v and returns once it is on disk.
+func (l *Log) Append(v interface{}) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, headerSize))
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[0:], uint32(len(b)-headerSize))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[headerSize:]))
+	binary.BigEndian.PutUint64(b[8:], l.seq+1)
+	_, err := l.f.Write(b)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// cut off what was written of the record
+		l.f.Truncate(l.end)
+		l.f.Seek(l.end, io.SeekStart)
+		return err
+	}
+	l.end += int64(len(b))
+	l.seq++
+	l.n++
+	return nil
+}
+
+// Due reports whether SnapshotEvery records were logged since the last
+// snapshot.
+func (l *Log) Due() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n >= SnapshotEvery
+}
+
+// Snapshot replaces the snapshot with v, which has to be the state with
+// every logged record applied, and empties the log. The new snapshot is
+// written next to the old one and renamed over it, so a crash leaves one or
+// the other.
+func (l *Log) Snapshot(v interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, l.seq)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	name := filepath.Join(l.dir, snapshotFile)
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	syncDir(l.dir)
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.n, l.end = 0, 0
+	return l.f.Sync()
+}
+
+// syncDir makes a rename in dir durable, where the system allows it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,165 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// replay opens the log in dir and returns the snapshot and the records
+// logged after it.
+func replay(t *testing.T, dir string) (*Log, []int, []int) {
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap []int
+	if _, err := l.ReadSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	_, err = l.Replay(func(r Record) error {
+		var v int
+		if err := r.Decode(&v); err != nil {
+			return err
+		}
+		got = append(got, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, snap, got
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplayTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the log of records 1, 2 and 3
+		damage func(b []byte) []byte
+		want   []int
+		torn   bool
+	}{
+		{"intact", func(b []byte) []byte { return b }, []int{1, 2, 3}, false},
+		{"cut header", func(b []byte) []byte { return append(b, 0, 0, 0) }, []int{1, 2, 3}, true},
+		{"cut payload", func(b []byte) []byte { return b[:len(b)-1] }, []int{1, 2}, true},
+		{"cut after header", func(b []byte) []byte { return b[:len(b)-4] }, []int{1, 2}, true},
+		{"garbled", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }, []int{1, 2}, true},
+		{"garbage", func(b []byte) []byte { return append(b, []byte("not a record at all")...) }, []int{1, 2, 3}, true},
+	}
+	for _, tt := range tests {
+		dir := tempDir(t)
+		l, _ := Open(dir)
+		for v := 1; v <= 3; v++ {
+			if err := l.Append(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l.Close()
+		name := filepath.Join(dir, logFile)
+		b, _ := ioutil.ReadFile(name)
+		ioutil.WriteFile(name, tt.damage(b), 0600)
+
+		l, _, got := replay(t, dir)
+		if !equal(got, tt.want) || (l.Torn > 0) != tt.torn {
+			t.Errorf("%s: replayed %v with %v bytes torn, want %v, torn %v", tt.name, got, l.Torn, tt.want, tt.torn)
+		}
+		// new records follow the last whole one
+		if err := l.Append(4); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		l, _, got = replay(t, dir)
+		l.Close()
+		if want := append(tt.want, 4); !equal(got, want) {
+			t.Errorf("%s: replayed %v after an append, want %v", tt.name, got, want)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSnapshotSkipsLoggedRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash keeps the log as it was before the snapshot, as if the
+		// server stopped between writing the snapshot and emptying the log
+		crash bool
+		after []int
+		want  []int
+	}{
+		{"clean", false, nil, nil},
+		{"clean then more", false, []int{4, 5}, []int{4, 5}},
+		{"crash", true, nil, nil},
+		{"crash then more", true, []int{4, 5}, []int{4, 5}},
+	}
+	for _, tt := range tests {
+		dir := tempDir(t)
+		l, _ := Open(dir)
+		for v := 1; v <= 3; v++ {
+			l.Append(v)
+		}
+		name := filepath.Join(dir, logFile)
+		before, _ := ioutil.ReadFile(name)
+		if err := l.Snapshot([]int{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		if tt.crash {
+			ioutil.WriteFile(name, before, 0600)
+		}
+		l, snap, _ := replay(t, dir)
+		for _, v := range tt.after {
+			l.Append(v)
+		}
+		l.Close()
+
+		l, snap, got := replay(t, dir)
+		l.Close()
+		if !equal(snap, []int{1, 2, 3}) || !equal(got, tt.want) {
+			t.Errorf("%s: snapshot %v and records %v, want [1 2 3] and %v", tt.name, snap, got, tt.want)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDue(t *testing.T) {
+	defer func(n int) { SnapshotEvery = n }(SnapshotEvery)
+	SnapshotEvery = 3
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	l, _ := Open(dir)
+	defer l.Close()
+	for v := 1; v <= 4; v++ {
+		l.Append(v)
+		if due := l.Due(); due != (v >= 3) {
+			t.Errorf("Due after %v records = %v", v, due)
+		}
+	}
+	if err := l.Snapshot([]int{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Due() {
+		t.Errorf("Due right after a snapshot")
+	}
+}